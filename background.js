@@ -2,21 +2,32 @@
 // Uses a local proxy helper for actual DNS override
 // Supports per-tab enable/disable
 
-const PROXY_PORT = 8899;
+// Default listen port; the proxy reports the port it actually bound
+const DEFAULT_PROXY_PORT = 8899;
 const NATIVE_HOST = 'fhosts_proxy';
 
+// The proxy exits if it hears nothing for HEARTBEAT_TIMEOUT_MS, so a
+// crashed browser doesn't leave it holding the port
+const HEARTBEAT_INTERVAL_MS = 20000;
+const HEARTBEAT_TIMEOUT_MS = 60000;
+
 let hostMappings = {};
 let enabledTabs = new Set();
 let nativePort = null;
 let proxyReady = false;
 let proxyError = false;
 let proxyConnecting = false;
+let proxyFeatures = new Set();
+let heartbeatTimer = null;
+let configuredPort = null;  // Port requested in the start message (storage key proxyPort, 0 = any free port)
+let proxyPort = DEFAULT_PROXY_PORT;
 
 // Load settings from storage
 async function loadSettings() {
   try {
-    const result = await browser.storage.local.get(['hostMappings']);
+    const result = await browser.storage.local.get(['hostMappings', 'proxyPort']);
     hostMappings = result.hostMappings || {};
+    configuredPort = result.proxyPort ?? null;
   } catch (error) {
     console.error('fhosts: Error loading settings:', error);
   }
@@ -42,6 +53,25 @@ function getActiveMappings() {
   return active;
 }
 
+// Find the mapping for a hostname - exact match first, then the most
+// specific wildcard ("*.example.com") covering it
+function findMapping(hostname) {
+  if (hostMappings[hostname]) {
+    return hostMappings[hostname];
+  }
+  let suffix = hostname;
+  let dot = suffix.indexOf('.');
+  while (dot !== -1) {
+    suffix = suffix.substring(dot + 1);
+    const wildcard = hostMappings['*.' + suffix];
+    if (wildcard) {
+      return wildcard;
+    }
+    dot = suffix.indexOf('.');
+  }
+  return null;
+}
+
 // Connect to native messaging host - returns a promise that resolves when connected or rejects on failure
 function connectToProxy() {
   return new Promise((resolve, reject) => {
@@ -83,16 +113,33 @@ function connectToProxy() {
         if (message.type === 'ready') {
           // Proxy is ready, send start command with mappings
           proxyError = false;
+          if (message.protocol) {
+            // Newer hosts negotiate features; older ones would reject hello
+            nativePort.postMessage({
+              action: 'hello',
+              protocol: 1,
+              version: browser.runtime.getManifest().version
+            });
+          }
           nativePort.postMessage({
             action: 'start',
-            mappings: getActiveMappings()
+            mappings: getActiveMappings(),
+            heartbeatTimeoutMs: HEARTBEAT_TIMEOUT_MS,
+            ...(configuredPort !== null ? { port: configuredPort } : {})
           });
         } else if (message.type === 'started') {
           proxyReady = true;
           proxyError = false;
           proxyConnecting = false;
-          console.log(`fhosts: Proxy started on port ${message.port}`);
+          proxyPort = message.port || DEFAULT_PROXY_PORT;
+          console.log(`fhosts: Proxy started on port ${proxyPort}`);
+          startHeartbeat();
           resolve(true);
+        } else if (message.type === 'restarted') {
+          proxyPort = message.port || proxyPort;
+          console.log(`fhosts: Proxy moved to port ${proxyPort}`);
+        } else if (message.type === 'hello') {
+          proxyFeatures = new Set(message.features || []);
         } else if (message.type === 'stopped') {
           proxyReady = false;
         } else if (message.type === 'error') {
@@ -114,6 +161,7 @@ function connectToProxy() {
           proxyConnecting = false;
           reject(new Error('Native host not available'));
         }
+        stopHeartbeat();
         nativePort = null;
         proxyReady = false;
         proxyConnecting = false;
@@ -137,6 +185,7 @@ function disconnectFromProxy() {
     } catch (e) {
       // Ignore errors when stopping
     }
+    stopHeartbeat();
     nativePort.disconnect();
     nativePort = null;
     proxyReady = false;
@@ -144,12 +193,38 @@ function disconnectFromProxy() {
   }
 }
 
-// Update proxy with current mappings
-function updateProxyMappings() {
+// Ping the proxy periodically so its watchdog knows we're still alive
+function startHeartbeat() {
+  stopHeartbeat();
+  heartbeatTimer = setInterval(() => {
+    if (nativePort) {
+      nativePort.postMessage({ action: 'ping' });
+    }
+  }, HEARTBEAT_INTERVAL_MS);
+}
+
+function stopHeartbeat() {
+  if (heartbeatTimer) {
+    clearInterval(heartbeatTimer);
+    heartbeatTimer = null;
+  }
+}
+
+// Send a single mapping change to the proxy without replacing the whole set
+function addProxyMapping(hostname, ip) {
   if (nativePort && proxyReady) {
     nativePort.postMessage({
-      action: 'updateMappings',
-      mappings: getActiveMappings()
+      action: 'addMappings',
+      mappings: { [hostname]: ip }
+    });
+  }
+}
+
+function removeProxyMapping(hostname) {
+  if (nativePort && proxyReady) {
+    nativePort.postMessage({
+      action: 'removeMappings',
+      hosts: [hostname]
     });
   }
 }
@@ -175,7 +250,7 @@ function handleProxyRequest(requestInfo) {
   const hostname = url.hostname;
 
   // Check if we have a mapping for this hostname
-  const mapping = hostMappings[hostname];
+  const mapping = findMapping(hostname);
   if (mapping && mapping.enabled) {
     // If proxy isn't ready, block the request to prevent confusion
     // This will show a connection error instead of the real site
@@ -195,7 +270,7 @@ function handleProxyRequest(requestInfo) {
     return {
       type: 'http',
       host: '127.0.0.1',
-      port: PROXY_PORT
+      port: proxyPort
     };
   }
 
@@ -259,6 +334,14 @@ browser.runtime.onMessage.addListener((message, sender, sendResponse) => {
         });
       return true; // Keep message channel open for async response
 
+    case 'setPaused':
+      // Pass all traffic through to the real hosts without dropping mappings
+      if (nativePort && proxyReady) {
+        nativePort.postMessage({ action: message.paused ? 'pause' : 'resume' });
+      }
+      sendResponse({ success: true });
+      break;
+
     case 'toggleTab':
       if (message.enabled) {
         // First tab being enabled - start proxy and wait for connection
@@ -298,14 +381,14 @@ browser.runtime.onMessage.addListener((message, sender, sendResponse) => {
         enabled: true
       };
       saveSettings();
-      updateProxyMappings();
+      addProxyMapping(message.hostname, message.ip);
       sendResponse({ success: true });
       break;
 
     case 'removeMapping':
       delete hostMappings[message.hostname];
       saveSettings();
-      updateProxyMappings();
+      removeProxyMapping(message.hostname);
       sendResponse({ success: true });
       break;
 
@@ -313,7 +396,11 @@ browser.runtime.onMessage.addListener((message, sender, sendResponse) => {
       if (hostMappings[message.hostname]) {
         hostMappings[message.hostname].enabled = message.enabled;
         saveSettings();
-        updateProxyMappings();
+        if (message.enabled) {
+          addProxyMapping(message.hostname, hostMappings[message.hostname].ip);
+        } else {
+          removeProxyMapping(message.hostname);
+        }
       }
       sendResponse({ success: true });
       break;
@@ -322,7 +409,9 @@ browser.runtime.onMessage.addListener((message, sender, sendResponse) => {
       if (hostMappings[message.hostname]) {
         hostMappings[message.hostname].ip = message.ip;
         saveSettings();
-        updateProxyMappings();
+        if (hostMappings[message.hostname].enabled) {
+          addProxyMapping(message.hostname, message.ip);
+        }
       }
       sendResponse({ success: true });
       break;
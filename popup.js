@@ -137,8 +137,11 @@ function escapeHtml(text) {
   return div.innerHTML;
 }
 
-// Validate hostname
+// Validate hostname (a leading "*." makes it a wildcard for all subdomains)
 function isValidHostname(hostname) {
+  if (hostname.startsWith('*.')) {
+    hostname = hostname.substring(2);
+  }
   const pattern = /^[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?(\.[a-zA-Z0-9]([a-zA-Z0-9-]*[a-zA-Z0-9])?)*$/;
   return pattern.test(hostname) && hostname.length <= 253;
 }
@@ -166,6 +169,20 @@ function isValidIp(ip) {
   return false;
 }
 
+// Validate a mapping target - an IP address with an optional port
+// ("127.0.0.1:8443", "[::1]:8443"), or a Unix socket ("unix:///run/app.sock")
+function isValidTarget(target) {
+  if (target.startsWith('unix://')) {
+    return target.length > 'unix://'.length;
+  }
+  const match = target.match(/^\[(.+)\]:(\d+)$/) || target.match(/^([^:]+):(\d+)$/);
+  if (match) {
+    const port = Number(match[2]);
+    return port >= 1 && port <= 65535 && isValidIp(match[1]);
+  }
+  return isValidIp(target);
+}
+
 // Handle toggling the current tab
 async function handleToggleTab() {
   const wantEnabled = tabToggle.checked;
@@ -219,7 +236,7 @@ async function handleAddMapping() {
     return;
   }
 
-  if (!isValidIp(ip)) {
+  if (!isValidTarget(ip)) {
     showError('Invalid IP address');
     ipInput.focus();
     return;
@@ -0,0 +1,5 @@
+// Package controlpb is the helper's gRPC control API, generated from
+// control.proto with protoc-gen-go and protoc-gen-go-grpc.
+package controlpb
+
+//go:generate protoc --go_out=. --go_opt=paths=source_relative --go-grpc_out=. --go-grpc_opt=paths=source_relative control.proto
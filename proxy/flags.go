@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"io"
+	"os"
+	"strings"
+
+	"fhosts-proxy/proxy"
+)
+
+// Command-line options. Browsers launch native messaging hosts with their
+// own arguments (the manifest path and extension id, or an origin), so
+// parsing is lenient: unknown arguments are ignored except in standalone
+// mode, which reports parseErr.
+var flags struct {
+	proxy.Options
+
+	exportHosts bool
+	standalone  bool
+	daemon      bool
+	service     string
+	plist       bool
+
+	parseErr error
+}
+
+type stringList []string
+
+func (l *stringList) String() string     { return strings.Join(*l, ",") }
+func (l *stringList) Set(v string) error { *l = append(*l, v); return nil }
+
+func parseFlags() {
+	fs := flag.NewFlagSet(os.Args[0], flag.ContinueOnError)
+	fs.SetOutput(io.Discard)
+	fs.Var((*stringList)(&flags.ImportHosts), "import-hosts", "merge mappings from a hosts-format `file` at startup (repeatable)")
+	fs.BoolVar(&flags.exportHosts, "export-hosts", false, "print the saved mappings in hosts-file format and exit")
+	fs.BoolVar(&flags.daemon, "daemon", false, "run as the detached daemon (started by the host itself)")
+	fs.BoolVar(&flags.AutoStart, "start", false, "daemon: start the proxy at launch instead of on the first start message")
+	fs.BoolVar(&flags.plist, "launchd-plist", false, "print a macOS launchd agent plist that runs the daemon at login and exit")
+	fs.StringVar(&flags.service, "service", "", "Windows: `install` or uninstall the fhosts service (run elevated); run is used by the service itself")
+	fs.StringVar(&flags.ServiceUser, "service-user", "", "Windows service: SID of the user to serve (set by -service install)")
+	fs.StringVar(&flags.ConfigDir, "config-dir", "", "keep state, certificates and sockets in this `directory`")
+	fs.BoolVar(&flags.standalone, "standalone", false, "run without native messaging, logging to stderr")
+	fs.StringVar(&flags.MappingsFile, "mappings", "", "standalone: load mappings and rules from a JSON `file` (exportConfig format)")
+	fs.Var((*stringList)(&flags.Maps), "map", "standalone: add a `host=target` mapping (repeatable)")
+	fs.IntVar(&flags.Port, "port", -1, "standalone: listen port (0 picks a free one)")
+	fs.BoolVar(&flags.IPv6, "ipv6", false, "standalone: also listen on [::1]")
+	fs.StringVar(&flags.BindAddress, "bind", "", "standalone: listen on this `address` instead of 127.0.0.1; beyond loopback needs -allow-remote and -proxy-auth")
+	fs.BoolVar(&flags.AllowRemote, "allow-remote", false, "standalone: confirm a -bind address reachable from the network")
+	fs.BoolVar(&flags.ProxyAuth, "proxy-auth", false, "standalone: require the token printed at startup in Proxy-Authorization")
+	fs.BoolVar(&flags.SystemHosts, "system-hosts", false, "standalone: use the system hosts file for unmapped hosts")
+	fs.StringVar(&flags.DebugAddr, "debug-addr", "", "serve pprof and expvar on this loopback `address` (e.g. 127.0.0.1:6060)")
+	fs.IntVar(&flags.AdminPort, "admin-port", 0, "standalone: serve the admin API and dashboard on this loopback port")
+	flags.parseErr = fs.Parse(os.Args[1:])
+}
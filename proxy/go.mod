@@ -1,3 +1,22 @@
 module fhosts-proxy
 
 go 1.21
+
+require (
+	github.com/Azure/go-ntlmssp v0.0.0-20221128193559-754e69321358
+	github.com/Microsoft/go-winio v0.6.2
+	github.com/alexbrainman/sspi v0.0.0-20231016080023-1a75b4708caa
+	github.com/fsnotify/fsnotify v1.7.0
+	golang.org/x/net v0.30.0
+	golang.org/x/sys v0.26.0
+	google.golang.org/grpc v1.65.0
+	google.golang.org/protobuf v1.34.2
+	sigs.k8s.io/yaml v1.4.0
+	software.sslmate.com/src/go-pkcs12 v0.7.3
+)
+
+require (
+	golang.org/x/crypto v0.28.0 // indirect
+	golang.org/x/text v0.19.0 // indirect
+	google.golang.org/genproto/googleapis/rpc v0.0.0-20240528184218-531527333157 // indirect
+)
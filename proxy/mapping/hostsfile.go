@@ -0,0 +1,66 @@
+package mapping
+
+import (
+	"bufio"
+	"fmt"
+	"io"
+	"net"
+	"sort"
+	"strings"
+)
+
+// Parse hosts-file syntax ("IP name [name...]", # comments) into mappings.
+// As in a real hosts file, the first entry for a name wins.
+func ParseHostsFile(r io.Reader) (map[string]string, error) {
+	mappings := make(map[string]string)
+	scanner := bufio.NewScanner(r)
+	for line := 1; scanner.Scan(); line++ {
+		text := scanner.Text()
+		if i := strings.IndexByte(text, '#'); i >= 0 {
+			text = text[:i]
+		}
+		fields := strings.Fields(text)
+		if len(fields) == 0 {
+			continue
+		}
+		if len(fields) < 2 || net.ParseIP(fields[0]) == nil {
+			return nil, fmt.Errorf("line %d: expected an IP address followed by hostnames", line)
+		}
+		for _, name := range fields[1:] {
+			name = NormalizeHost(name)
+			if _, ok := mappings[name]; !ok {
+				mappings[name] = fields[0]
+			}
+		}
+	}
+	return mappings, scanner.Err()
+}
+
+// Render mappings as a hosts-file snippet. Entries a hosts file can't
+// express (wildcards, ports, Unix sockets, regex rules) are listed as
+// comments.
+func RenderHostsFile(hosts map[string]string, rules []Regex) string {
+	names := make([]string, 0, len(hosts))
+	for host := range hosts {
+		names = append(names, host)
+	}
+	sort.Strings(names)
+
+	var b strings.Builder
+	b.WriteString("# Generated by fhosts\n")
+	for _, host := range names {
+		target := hosts[host]
+		switch {
+		case strings.HasPrefix(host, "*."):
+			fmt.Fprintf(&b, "# %s -> %s (wildcard, not supported in hosts files)\n", host, target)
+		case net.ParseIP(target) == nil:
+			fmt.Fprintf(&b, "# %s -> %s (not a plain IP address)\n", host, target)
+		default:
+			fmt.Fprintf(&b, "%s\t%s\n", target, host)
+		}
+	}
+	for _, rule := range rules {
+		fmt.Fprintf(&b, "# /%s/ -> %s (regex, not supported in hosts files)\n", rule.Pattern(), rule.Target)
+	}
+	return b.String()
+}
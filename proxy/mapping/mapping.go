@@ -0,0 +1,137 @@
+// Package mapping holds the host-matching rules shared by the proxy, its
+// PAC script and the mapping file formats: normalized hostnames, exact and
+// wildcard ("*.example.com") keys, regex rules and hosts-file syntax.
+package mapping
+
+import (
+	"encoding/json"
+	"fmt"
+	"regexp"
+	"strings"
+)
+
+// A host-keyed mapping table. In JSON a value is either one target or an
+// ordered list of failover targets, which is kept joined with commas.
+type Set map[string]string
+
+func (m *Set) UnmarshalJSON(data []byte) error {
+	var raw map[string]json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+	if raw == nil {
+		*m = nil
+		return nil
+	}
+	set := make(Set, len(raw))
+	for host, value := range raw {
+		var target string
+		if err := json.Unmarshal(value, &target); err == nil {
+			set[host] = target
+			continue
+		}
+		var targets []string
+		if err := json.Unmarshal(value, &targets); err != nil || len(targets) == 0 {
+			return fmt.Errorf("mapping for %q must be a target or a list of targets", host)
+		}
+		set[host] = strings.Join(targets, ",")
+	}
+	*m = set
+	return nil
+}
+
+// A regular-expression mapping rule as sent by the extension. The target
+// may reference capture groups ($1, ${name}).
+type RegexMapping struct {
+	Pattern string `json:"pattern"`
+	Target  string `json:"target"`
+}
+
+// A compiled RegexMapping
+type Regex struct {
+	re     *regexp.Regexp
+	Target string
+}
+
+// Compile regex mapping rules, keeping their order
+func CompileRegex(rules []RegexMapping) ([]Regex, error) {
+	compiled := make([]Regex, 0, len(rules))
+	for _, rule := range rules {
+		re, err := regexp.Compile(rule.Pattern)
+		if err != nil {
+			return nil, fmt.Errorf("invalid regex mapping %q: %v", rule.Pattern, err)
+		}
+		compiled = append(compiled, Regex{re: re, Target: rule.Target})
+	}
+	return compiled, nil
+}
+
+// The rule's source pattern
+func (r Regex) Pattern() string {
+	return r.re.String()
+}
+
+// The target for a normalized hostname with capture groups expanded, if
+// the rule matches it
+func (r Regex) Match(hostname string) (string, bool) {
+	match := r.re.FindStringSubmatchIndex(hostname)
+	if match == nil {
+		return "", false
+	}
+	return string(r.re.ExpandString(nil, r.Target, hostname, match)), true
+}
+
+// Normalize a hostname for mapping lookup (lowercase, no trailing dot,
+// IPv6 literals without brackets)
+func NormalizeHost(hostname string) string {
+	return strings.TrimSuffix(strings.ToLower(Unbracket(hostname)), ".")
+}
+
+// Strip the brackets from an IPv6 literal ("[::1]" -> "::1")
+func Unbracket(host string) string {
+	if strings.HasPrefix(host, "[") && strings.HasSuffix(host, "]") {
+		return host[1 : len(host)-1]
+	}
+	return host
+}
+
+// Normalize host keys so lookups are case-insensitive
+func NormalizeKeys[V any](m map[string]V) map[string]V {
+	normalized := make(map[string]V, len(m))
+	for key, value := range m {
+		normalized[NormalizeHost(key)] = value
+	}
+	return normalized
+}
+
+// Find the entry for a normalized hostname in a host-keyed map. Exact keys
+// win, then wildcard keys ("*.example.com") from the most specific suffix to
+// the least specific.
+func Match[V any](m map[string]V, hostname string) (V, bool) {
+	if value, ok := m[hostname]; ok {
+		return value, true
+	}
+	for suffix, i := hostname, strings.IndexByte(hostname, '.'); i >= 0; i = strings.IndexByte(suffix, '.') {
+		suffix = suffix[i+1:]
+		if value, ok := m["*."+suffix]; ok {
+			return value, true
+		}
+	}
+	var zero V
+	return zero, false
+}
+
+// Find the mapping for a hostname: exact and wildcard keys first, then regex
+// rules in order
+func Lookup(hosts map[string]string, rules []Regex, hostname string) (string, bool) {
+	hostname = NormalizeHost(hostname)
+	if mapped, ok := Match(hosts, hostname); ok {
+		return mapped, true
+	}
+	for _, rule := range rules {
+		if mapped, ok := rule.Match(hostname); ok {
+			return mapped, true
+		}
+	}
+	return "", false
+}
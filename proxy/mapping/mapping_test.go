@@ -0,0 +1,56 @@
+package mapping
+
+import "testing"
+
+func TestUnbracket(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"[::1]", "::1"},
+		{"[fe80::1%eth0]", "fe80::1%eth0"},
+		{"::1", "::1"},
+		{"example.com", "example.com"},
+		{"[::1", "[::1"},
+		{"", ""},
+	}
+	for _, tt := range tests {
+		if got := Unbracket(tt.in); got != tt.want {
+			t.Errorf("Unbracket(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestNormalizeHost(t *testing.T) {
+	tests := []struct{ in, want string }{
+		{"[::1]", "::1"},
+		{"[2001:DB8::1]", "2001:db8::1"},
+		{"2001:DB8::1", "2001:db8::1"},
+		{"Example.COM.", "example.com"},
+		{"127.0.0.1", "127.0.0.1"},
+	}
+	for _, tt := range tests {
+		if got := NormalizeHost(tt.in); got != tt.want {
+			t.Errorf("NormalizeHost(%q) = %q, want %q", tt.in, got, tt.want)
+		}
+	}
+}
+
+func TestLookupIPv6Keys(t *testing.T) {
+	hosts := NormalizeKeys(map[string]string{
+		"[::1]":       "localhost:3000",
+		"2001:db8::2": "localhost:4000",
+	})
+	tests := []struct {
+		host, want string
+		ok         bool
+	}{
+		{"::1", "localhost:3000", true},
+		{"[::1]", "localhost:3000", true},
+		{"[2001:DB8::2]", "localhost:4000", true},
+		{"::2", "", false},
+	}
+	for _, tt := range tests {
+		got, ok := Lookup(hosts, nil, tt.host)
+		if got != tt.want || ok != tt.ok {
+			t.Errorf("Lookup(%q) = %q, %v, want %q, %v", tt.host, got, ok, tt.want, tt.ok)
+		}
+	}
+}
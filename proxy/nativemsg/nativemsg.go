@@ -0,0 +1,73 @@
+// Package nativemsg implements the framing of the WebExtension native
+// messaging protocol: every message is a 32-bit length in native (here
+// little-endian) byte order followed by that many bytes of UTF-8 JSON.
+package nativemsg
+
+import (
+	"bufio"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+)
+
+// Largest frame accepted in either direction. Chrome caps messages from
+// the host at 1MB (messages to it may be up to 4GB), so nothing larger is
+// written, and a prefix past it on input is taken as a corrupt stream.
+const MaxMessageSize = 1 << 20
+
+var ErrFrameTooLarge = errors.New("message exceeds 1MB limit")
+
+// Read one message body. After an oversized length prefix, which most
+// likely means a corrupt or misaligned stream, the reader skips to the
+// next plausible frame and ErrFrameTooLarge is returned.
+func Read(r *bufio.Reader) ([]byte, error) {
+	// Read 4-byte length prefix (little-endian)
+	lengthBytes := make([]byte, 4)
+	if _, err := io.ReadFull(r, lengthBytes); err != nil {
+		return nil, err
+	}
+	length := binary.LittleEndian.Uint32(lengthBytes)
+	if length > MaxMessageSize {
+		// Don't trust the prefix
+		if err := resync(r); err != nil {
+			return nil, err
+		}
+		return nil, fmt.Errorf("%w: %d bytes", ErrFrameTooLarge, length)
+	}
+
+	// Read message body
+	body := make([]byte, length)
+	if _, err := io.ReadFull(r, body); err != nil {
+		return nil, err
+	}
+	return body, nil
+}
+
+// Skip ahead to the next plausible frame after a bad length prefix: a
+// length within the limit followed by the '{' that starts every message.
+func resync(r *bufio.Reader) error {
+	for {
+		head, err := r.Peek(5)
+		if err != nil {
+			r.Discard(len(head)) // Trailing bytes too short to be a frame
+			return err
+		}
+		length := binary.LittleEndian.Uint32(head)
+		if length >= 2 && length <= MaxMessageSize && head[4] == '{' {
+			return nil
+		}
+		r.Discard(1)
+	}
+}
+
+// Write one message body as a single frame
+func Write(w io.Writer, body []byte) error {
+	if len(body) > MaxMessageSize {
+		return ErrFrameTooLarge
+	}
+	frame := make([]byte, 4, 4+len(body))
+	binary.LittleEndian.PutUint32(frame, uint32(len(body)))
+	_, err := w.Write(append(frame, body...))
+	return err
+}
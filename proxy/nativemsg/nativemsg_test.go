@@ -0,0 +1,64 @@
+package nativemsg
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/binary"
+	"errors"
+	"io"
+	"testing"
+)
+
+func frame(body string) []byte {
+	var buf bytes.Buffer
+	Write(&buf, []byte(body))
+	return buf.Bytes()
+}
+
+func TestReadResyncsAfterOversizedPrefix(t *testing.T) {
+	var in []byte
+	in = binary.LittleEndian.AppendUint32(in, MaxMessageSize+1)
+	in = append(in, "garbage"...)
+	in = append(in, frame(`{"action":"ping"}`)...)
+	r := bufio.NewReader(bytes.NewReader(in))
+
+	if _, err := Read(r); !errors.Is(err, ErrFrameTooLarge) {
+		t.Fatalf("first Read error = %v, want ErrFrameTooLarge", err)
+	}
+	body, err := Read(r)
+	if err != nil || string(body) != `{"action":"ping"}` {
+		t.Fatalf("second Read = %q, %v", body, err)
+	}
+	if _, err := Read(r); err != io.EOF {
+		t.Fatalf("third Read error = %v, want EOF", err)
+	}
+}
+
+func FuzzRead(f *testing.F) {
+	f.Add(frame(`{"action":"ping"}`))
+	f.Add(append(frame(`{}`), frame(`{"id":1}`)...))
+	f.Add(binary.LittleEndian.AppendUint32(nil, MaxMessageSize+1))
+	f.Add(append(binary.LittleEndian.AppendUint32(nil, 1<<31), frame(`{"a":1}`)...))
+	f.Add([]byte{2, 0, 0, 0, '{'})
+	f.Fuzz(func(t *testing.T, data []byte) {
+		r := bufio.NewReader(bytes.NewReader(data))
+		for {
+			body, err := Read(r)
+			if len(body) > MaxMessageSize {
+				t.Fatalf("Read returned %d bytes, over MaxMessageSize", len(body))
+			}
+			if errors.Is(err, ErrFrameTooLarge) {
+				// Resync stopped at a frame that looks valid
+				if head, err := r.Peek(5); err == nil {
+					if n := binary.LittleEndian.Uint32(head); n > MaxMessageSize || head[4] != '{' {
+						t.Fatalf("resync stopped at % x", head)
+					}
+				}
+				continue
+			}
+			if err != nil {
+				return
+			}
+		}
+	})
+}
@@ -0,0 +1,84 @@
+package proxy
+
+import (
+	"encoding/json"
+	"sync"
+	"time"
+)
+
+// One line of the access log: a finished request or tunnel
+type AccessLogEntry struct {
+	Time   time.Time `json:"time"`
+	Client string    `json:"client"`
+	TrafficEvent
+}
+
+var (
+	accessLog   *rotatingFile
+	accessLogMu sync.Mutex
+)
+
+// Open the access log for appending, replacing any open one. An empty path
+// turns access logging off.
+func openAccessLog(path string) error {
+	closeAccessLog()
+	if path == "" {
+		return nil
+	}
+	f, err := openRotatingFile(path)
+	if err != nil {
+		return err
+	}
+	accessLogMu.Lock()
+	accessLog = f
+	accessLogMu.Unlock()
+	return nil
+}
+
+func closeAccessLog() {
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+	if accessLog != nil {
+		accessLog.Close()
+		accessLog = nil
+	}
+}
+
+func accessLogOpen() bool {
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+	return accessLog != nil
+}
+
+// Start new log and access log files now, regardless of the rotation limits
+func rotateLogs() error {
+	logMu.Lock()
+	f := logFile
+	logMu.Unlock()
+	accessLogMu.Lock()
+	a := accessLog
+	accessLogMu.Unlock()
+
+	var firstErr error
+	for _, r := range []*rotatingFile{f, a} {
+		if r != nil {
+			if err := r.Rotate(); err != nil && firstErr == nil {
+				firstErr = err
+			}
+		}
+	}
+	return firstErr
+}
+
+// Append one JSON line for a finished request
+func writeAccessLog(entry AccessLogEntry) {
+	line, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+	accessLogMu.Lock()
+	defer accessLogMu.Unlock()
+	if accessLog != nil {
+		accessLog.Write(append(line, '\n'))
+	}
+}
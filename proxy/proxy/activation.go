@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// systemd socket activation: a socket unit passes the daemon its listening
+// sockets as file descriptors from 3 up, named with FileDescriptorName=.
+// The one named "control" is the control socket; the others serve the
+// proxy, which then starts at launch instead of waiting for the extension.
+const listenFDsStart = 3
+
+var activated struct {
+	proxy   []net.Listener
+	control net.Listener
+}
+
+// Pick up the sockets systemd passed, if any. The variables are cleared so
+// processes we launch don't mistake the sockets for theirs.
+func inheritListeners() {
+	pid, _ := strconv.Atoi(os.Getenv("LISTEN_PID"))
+	count, _ := strconv.Atoi(os.Getenv("LISTEN_FDS"))
+	names := strings.Split(os.Getenv("LISTEN_FDNAMES"), ":")
+	os.Unsetenv("LISTEN_PID")
+	os.Unsetenv("LISTEN_FDS")
+	os.Unsetenv("LISTEN_FDNAMES")
+	if pid != os.Getpid() {
+		return
+	}
+
+	for i := 0; i < count; i++ {
+		fd := listenFDsStart + i
+		name := ""
+		if i < len(names) {
+			name = names[i]
+		}
+		f := os.NewFile(uintptr(fd), name)
+		l, err := net.FileListener(f)
+		f.Close() // FileListener holds its own copy
+		if err != nil {
+			logWarn("Ignoring inherited socket %d: %v", fd, err)
+			continue
+		}
+		if name == "control" {
+			activated.control = l
+		} else {
+			activated.proxy = append(activated.proxy, l)
+		}
+	}
+}
+
+// Hand over the inherited proxy listeners. Only the first start gets them;
+// a restart on another port listens anew.
+func takeActivatedProxy() []net.Listener {
+	ls := activated.proxy
+	activated.proxy = nil
+	return ls
+}
+
+func takeActivatedControl() net.Listener {
+	l := activated.control
+	activated.control = nil
+	return l
+}
@@ -0,0 +1,227 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fhosts-proxy/nativemsg"
+)
+
+// Admin API for local tools (test runners, IDE plugins) that want to drive
+// the proxy over HTTP instead of native messaging. It listens on loopback
+// only, and every request must carry the token written to admin.json in the
+// config directory:
+//
+//	GET  /mappings   current mapping set (exportConfig format)
+//	PUT  /mappings   replace it (importConfig)
+//	GET  /status     proxy status
+//	POST /stop       stop the proxy and exit
+//	POST /action     any native messaging action, e.g.
+//	                 {"action":"addMappings",...}
+//	GET  /requests   recently finished requests
+//
+// The web dashboard at / is the one page served without the token.
+const adminFile = "admin.json"
+
+var (
+	adminServer *http.Server
+	adminInfoMu sync.Mutex
+	adminURL    string // Dashboard URL including the token, empty while off
+	adminAddr   *net.TCPAddr
+)
+
+// Where local tools find the admin API
+type adminInfo struct {
+	Port  int    `json:"port"`
+	Token string `json:"token"`
+}
+
+// Start the admin API on the loopback port with a fresh token. Port 0
+// leaves the API off. Once started it lives until the process exits, so
+// tools can still reach it after stopping and restarting the proxy.
+func startAdmin(port int) error {
+	if port == 0 || adminServer != nil {
+		return nil
+	}
+	if port < 0 || port > 65535 {
+		return errInvalidPort
+	}
+
+	secret := make([]byte, 32)
+	if _, err := rand.Read(secret); err != nil {
+		return err
+	}
+	token := hex.EncodeToString(secret)
+
+	l, err := net.Listen("tcp", net.JoinHostPort("127.0.0.1", strconv.Itoa(port)))
+	if err != nil {
+		return err
+	}
+	port = l.Addr().(*net.TCPAddr).Port
+	if err := writeAdminInfo(adminInfo{Port: port, Token: token}); err != nil {
+		l.Close()
+		return err
+	}
+
+	mux := http.NewServeMux()
+	mux.HandleFunc("/", handleDashboard)
+	mux.HandleFunc("/requests", adminRequests)
+	mux.HandleFunc("/mappings", adminMappings)
+	mux.HandleFunc("/status", adminRoute(http.MethodGet, func(*http.Request) (*Message, error) {
+		return &Message{Action: "status"}, nil
+	}))
+	mux.HandleFunc("/stop", adminRoute(http.MethodPost, func(*http.Request) (*Message, error) {
+		return &Message{Action: "stop"}, nil
+	}))
+	mux.HandleFunc("/action", adminRoute(http.MethodPost, func(r *http.Request) (*Message, error) {
+		var msg Message
+		err := json.NewDecoder(io.LimitReader(r.Body, nativemsg.MaxMessageSize)).Decode(&msg)
+		return &msg, err
+	}))
+
+	adminServer = &http.Server{
+		Handler:           requireToken(token, mux),
+		ReadHeaderTimeout: 10 * time.Second,
+	}
+	adminInfoMu.Lock()
+	adminURL = fmt.Sprintf("http://127.0.0.1:%d/#token=%s", port, token)
+	adminAddr = l.Addr().(*net.TCPAddr)
+	adminInfoMu.Unlock()
+	keepRecent.Store(true)
+
+	logInfo("Admin API listening on %s", l.Addr())
+	go adminServer.Serve(l)
+	return nil
+}
+
+// Dashboard URL with the token in its fragment, or "" when the admin API
+// is off
+func dashboardURL() string {
+	adminInfoMu.Lock()
+	defer adminInfoMu.Unlock()
+	return adminURL
+}
+
+func stopAdmin() {
+	if adminServer != nil {
+		adminServer.Close()
+		adminServer = nil
+		keepRecent.Store(false)
+		adminInfoMu.Lock()
+		adminURL = ""
+		adminAddr = nil
+		adminInfoMu.Unlock()
+		if dir, err := configDir(); err == nil {
+			os.Remove(filepath.Join(dir, adminFile))
+		}
+	}
+}
+
+func writeAdminInfo(info adminInfo) error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(info, "", "  ")
+	return writeFileAtomic(filepath.Join(dir, adminFile), data)
+}
+
+// Reject requests without "Authorization: Bearer <token>", except for the
+// dashboard page
+func requireToken(token string, next http.Handler) http.Handler {
+	return http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		got, _ := strings.CutPrefix(r.Header.Get("Authorization"), "Bearer ")
+		if r.URL.Path != "/" && subtle.ConstantTimeCompare([]byte(got), []byte(token)) != 1 {
+			writeAdminJSON(w, http.StatusUnauthorized, Message{Type: "error", Message: "Missing or invalid admin token"})
+			return
+		}
+		next.ServeHTTP(w, r)
+	})
+}
+
+func adminMappings(w http.ResponseWriter, r *http.Request) {
+	switch r.Method {
+	case http.MethodGet:
+		runAdminAction(w, &Message{Action: "exportConfig"})
+	case http.MethodPut:
+		var cfg ProxyConfig
+		if err := json.NewDecoder(io.LimitReader(r.Body, nativemsg.MaxMessageSize)).Decode(&cfg); err != nil {
+			writeAdminJSON(w, http.StatusBadRequest, Message{Type: "error", Message: "Invalid config: " + err.Error(), ErrorCode: ErrCodeBadMessage})
+			return
+		}
+		runAdminAction(w, &Message{Action: "importConfig", Config: &cfg})
+	default:
+		methodNotAllowed(w)
+	}
+}
+
+// Handler for an endpoint that maps to one action
+func adminRoute(method string, build func(*http.Request) (*Message, error)) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if r.Method != method {
+			methodNotAllowed(w)
+			return
+		}
+		msg, err := build(r)
+		if err != nil {
+			writeAdminJSON(w, http.StatusBadRequest, Message{Type: "error", Message: "Invalid message: " + err.Error(), ErrorCode: ErrCodeBadMessage})
+			return
+		}
+		runAdminAction(w, msg)
+	}
+}
+
+// Run an action through handleMessage and write its reply as the response.
+// The reply is flushed as soon as it is sent, since stop exits right after.
+func runAdminAction(w http.ResponseWriter, msg *Message) {
+	replied := false
+	engine.handleMessage(msg, sourceAdmin, func(reply Message) {
+		if replied {
+			return
+		}
+		replied = true
+		writeAdminJSON(w, adminStatusCode(reply), reply)
+		if f, ok := w.(http.Flusher); ok {
+			f.Flush()
+		}
+	})
+	if !replied {
+		w.WriteHeader(http.StatusNoContent)
+	}
+}
+
+// HTTP status for an action's reply
+func adminStatusCode(reply Message) int {
+	if reply.Type != "error" {
+		return http.StatusOK
+	}
+	switch reply.ErrorCode {
+	case ErrCodeUnknownAction, ErrCodeNotFound:
+		return http.StatusNotFound
+	case ErrCodeServerError, ErrCodeFileError, ErrCodeCAError:
+		return http.StatusInternalServerError
+	}
+	return http.StatusBadRequest
+}
+
+func methodNotAllowed(w http.ResponseWriter) {
+	writeAdminJSON(w, http.StatusMethodNotAllowed, Message{Type: "error", Message: "Method not allowed"})
+}
+
+func writeAdminJSON(w http.ResponseWriter, status int, v any) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	json.NewEncoder(w).Encode(v)
+}
@@ -0,0 +1,185 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/json"
+	"os"
+	"os/user"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+
+	"fhosts-proxy/nativemsg"
+)
+
+// Every change to the mappings, rules and profiles is appended to
+// audit.jsonl in the config directory, one JSON line per change, so shared
+// machines have a record of who pointed which host where. The file is never
+// rewritten or rotated by the proxy.
+const auditFile = "audit.jsonl"
+
+// Where a change came from
+const (
+	sourceExtension = "extension" // Native messaging, directly or relayed to the daemon
+	sourceCtl       = "ctl"       // The ctl subcommand or another control socket client
+	sourceAdmin     = "admin"     // The admin API or dashboard
+	sourceFile      = "file"      // watchFile reloads
+	sourceBackend   = "backend"   // Consul or etcd sync
+	sourceEmbedded  = "embedded"  // Proxy.Do in a program embedding the engine
+	sourceGRPC      = "grpc"      // The gRPC control API
+)
+
+// Actions whose changes are audited
+var auditedActions = map[string]bool{
+	"start": true, "restart": true,
+	"updateMappings": true, "addMappings": true, "removeMappings": true,
+	"disableMappings": true, "enableMappings": true,
+	"importHostsFile": true, "importConfig": true,
+	"saveProfile": true, "switchProfile": true, "deleteProfile": true,
+	"pause": true, "resume": true, "setHostOffline": true,
+}
+
+// One audited change
+type AuditEntry struct {
+	Time    time.Time     `json:"time"`
+	Source  string        `json:"source"`
+	User    string        `json:"user,omitempty"` // OS account the proxy runs as
+	Action  string        `json:"action"`
+	Profile string        `json:"profile,omitempty"`
+	Path    string        `json:"path,omitempty"` // File the change was read from
+	Changes []AuditChange `json:"changes,omitempty"`
+}
+
+// One table entry that changed. From is omitted for additions and To for
+// removals.
+type AuditChange struct {
+	Table string          `json:"table"` // mappings, disabled, regexMappings, options, blocked, headerRules, mocks or bodyRules
+	Key   string          `json:"key"`   // Host, or the pattern for regex mappings
+	From  json.RawMessage `json:"from,omitempty"`
+	To    json.RawMessage `json:"to,omitempty"`
+}
+
+var (
+	auditMu   sync.Mutex
+	auditUser = sync.OnceValue(func() string {
+		if u, err := user.Current(); err == nil {
+			return u.Username
+		}
+		return ""
+	})
+)
+
+// Record entry with the changes from before to the active tables. Mapping
+// actions that changed nothing aren't recorded.
+func (p *Proxy) auditChange(entry AuditEntry, before *ProxyConfig) {
+	if p.embedded {
+		return
+	}
+	entry.Changes = diffConfigs(before, p.exportConfig())
+	if len(entry.Changes) == 0 && !auditAlways(entry.Action) {
+		return
+	}
+	entry.Time = time.Now().UTC()
+	entry.User = auditUser()
+	data, err := json.Marshal(entry)
+	if err != nil {
+		return
+	}
+
+	auditMu.Lock()
+	defer auditMu.Unlock()
+	dir, err := configDir()
+	if err == nil {
+		var f *os.File
+		if f, err = os.OpenFile(filepath.Join(dir, auditFile), os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600); err == nil {
+			_, err = f.Write(append(data, '\n'))
+			f.Close()
+		}
+	}
+	if err != nil {
+		logWarn("Failed to write audit log: %v", err)
+	}
+}
+
+// Actions recorded even though they don't change the active tables
+func auditAlways(action string) bool {
+	switch action {
+	case "saveProfile", "deleteProfile", "pause", "resume":
+		return true
+	}
+	return false
+}
+
+// The latest limit audit entries (all of them for limit 0), oldest first
+func readAuditLog(limit int) ([]AuditEntry, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, err
+	}
+	auditMu.Lock()
+	data, err := os.ReadFile(filepath.Join(dir, auditFile))
+	auditMu.Unlock()
+	if os.IsNotExist(err) {
+		return []AuditEntry{}, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	entries := []AuditEntry{}
+	scanner := bufio.NewScanner(bytes.NewReader(data))
+	scanner.Buffer(make([]byte, 64*1024), nativemsg.MaxMessageSize)
+	for scanner.Scan() {
+		var entry AuditEntry
+		if json.Unmarshal(scanner.Bytes(), &entry) == nil {
+			entries = append(entries, entry)
+		}
+	}
+	if limit > 0 && len(entries) > limit {
+		entries = entries[len(entries)-limit:]
+	}
+	return entries, nil
+}
+
+// Entries that differ between two snapshots of the mapping tables
+func diffConfigs(before, after *ProxyConfig) []AuditChange {
+	regex := func(cfg *ProxyConfig) map[string]string {
+		m := make(map[string]string, len(cfg.Regex))
+		for _, rule := range cfg.Regex {
+			m[rule.Pattern] = rule.Target
+		}
+		return m
+	}
+	var changes []AuditChange
+	changes = append(changes, diffTable("mappings", before.Mappings, after.Mappings)...)
+	changes = append(changes, diffTable("disabled", before.Disabled, after.Disabled)...)
+	changes = append(changes, diffTable("regexMappings", regex(before), regex(after))...)
+	changes = append(changes, diffTable("options", before.Options, after.Options)...)
+	changes = append(changes, diffTable("blocked", before.Blocked, after.Blocked)...)
+	changes = append(changes, diffTable("headerRules", before.HeaderRules, after.HeaderRules)...)
+	changes = append(changes, diffTable("mocks", before.Mocks, after.Mocks)...)
+	changes = append(changes, diffTable("bodyRules", before.BodyRules, after.BodyRules)...)
+	return changes
+}
+
+func diffTable[V any](table string, before, after map[string]V) []AuditChange {
+	var changes []AuditChange
+	for key, old := range before {
+		from, _ := json.Marshal(old)
+		if value, ok := after[key]; !ok {
+			changes = append(changes, AuditChange{Table: table, Key: key, From: from})
+		} else if to, _ := json.Marshal(value); !bytes.Equal(from, to) {
+			changes = append(changes, AuditChange{Table: table, Key: key, From: from, To: to})
+		}
+	}
+	for key, value := range after {
+		if _, ok := before[key]; !ok {
+			to, _ := json.Marshal(value)
+			changes = append(changes, AuditChange{Table: table, Key: key, To: to})
+		}
+	}
+	sort.Slice(changes, func(i, j int) bool { return changes[i].Key < changes[j].Key })
+	return changes
+}
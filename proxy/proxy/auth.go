@@ -0,0 +1,51 @@
+package proxy
+
+import (
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/base64"
+	"encoding/hex"
+	"net/http"
+	"strings"
+)
+
+// With proxyAuth on, clients must present the token generated at start in
+// Proxy-Authorization, either as a bearer token or as the password of
+// basic credentials (any username), so other local processes can't use
+// the proxy and its mappings. The same token is the SOCKS5 password. Each
+// proxy has its own, kept in its settings.
+func newProxyToken() (string, error) {
+	secret := make([]byte, 16)
+	if _, err := rand.Read(secret); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(secret), nil
+}
+
+// Whether a credential matches token. Always true when auth is off.
+func validProxyToken(token, got string) bool {
+	return token == "" || subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1
+}
+
+// Check a request's Proxy-Authorization header against token, answering
+// 407 when it is missing or wrong
+func authorizeProxy(w http.ResponseWriter, r *http.Request, token string) bool {
+	if token == "" {
+		return true
+	}
+	header := r.Header.Get("Proxy-Authorization")
+	var got string
+	if token, ok := strings.CutPrefix(header, "Bearer "); ok {
+		got = token
+	} else if encoded, ok := strings.CutPrefix(header, "Basic "); ok {
+		if creds, err := base64.StdEncoding.DecodeString(encoded); err == nil {
+			_, got, _ = strings.Cut(string(creds), ":")
+		}
+	}
+	if got != "" && validProxyToken(token, got) {
+		return true
+	}
+	w.Header().Set("Proxy-Authenticate", `Basic realm="fhosts-proxy"`)
+	http.Error(w, "Proxy Authentication Required", http.StatusProxyAuthRequired)
+	return false
+}
@@ -0,0 +1,279 @@
+package proxy
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"encoding/base64"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"strconv"
+	"strings"
+	"time"
+
+	"fhosts-proxy/nativemsg"
+)
+
+// A key-value store to take mappings from. Each key under Prefix names a
+// host (the rest of the key) and its value is the target.
+type MappingBackend struct {
+	Type    string `json:"type"`              // "consul" or "etcd"
+	Address string `json:"address,omitempty"` // Base URL, the agent's local default when empty
+	Prefix  string `json:"prefix"`
+	Token   string `json:"token,omitempty"` // Consul ACL token or etcd auth token
+}
+
+// Wait this long after a failed read or watch before trying again
+const backendRetry = 5 * time.Second
+
+var backendClient = &http.Client{Transport: &http.Transport{Proxy: nil}}
+
+// A proxy's mapping backend watch
+type backendState struct {
+	cancel context.CancelFunc
+	hosts  map[string]bool // Hosts the backend contributed last time
+
+	// The backend's last mappings, layered under every full mapping set
+	mappings map[string]string
+}
+
+// Start keeping the backend's mappings merged into the active set
+func (p *Proxy) startBackend(b *MappingBackend) error {
+	p.stopBackend()
+	if b == nil || b.Type == "" {
+		return nil
+	}
+	var watch func(context.Context, *MappingBackend, func(map[string]string)) error
+	switch b.Type {
+	case "consul":
+		watch = watchConsul
+	case "etcd":
+		watch = watchEtcd
+	default:
+		return fmt.Errorf("unknown mapping backend %q", b.Type)
+	}
+
+	ctx, cancel := context.WithCancel(context.Background())
+	p.backend.cancel = cancel
+	go func() {
+		failing := false
+		for ctx.Err() == nil {
+			err := watch(ctx, b, func(mappings map[string]string) {
+				failing = false
+				actionsMu.Lock()
+				defer actionsMu.Unlock()
+				if ctx.Err() == nil {
+					p.applyBackend(b, mappings)
+				}
+			})
+			if ctx.Err() != nil {
+				return
+			}
+			if !failing {
+				logWarn("Watching %s mappings under %q: %v", b.Type, b.Prefix, err)
+				failing = true
+			}
+			select {
+			case <-ctx.Done():
+			case <-time.After(backendRetry):
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *Proxy) stopBackend() {
+	if p.backend.cancel != nil {
+		p.backend.cancel()
+	}
+	p.backend = backendState{}
+}
+
+// Apply the backend's current mappings and tell the extension. Callers
+// must hold actionsMu.
+func (p *Proxy) applyBackend(b *MappingBackend, mappings map[string]string) {
+	before := p.exportConfig()
+	hosts, err := p.syncMappings(&ProxyConfig{Mappings: mappings}, p.backend.hosts)
+	if err != nil {
+		logWarn("Failed to apply %s mappings: %v", b.Type, err)
+		return
+	}
+	p.auditChange(AuditEntry{Source: sourceBackend, Action: "sync", Path: b.Address + "/" + b.Prefix}, before)
+	p.backend.mappings, p.backend.hosts = mappings, hosts
+	p.saveState()
+
+	logInfo("Loaded %d mappings from %s", len(mappings), b.Type)
+	count, revision := p.mappingsState()
+	sendMessage(Message{Type: "mappingsUpdated", Count: count, Revision: revision})
+}
+
+// Host named by a key under prefix, or "" for keys that aren't mappings
+func backendHost(key, prefix string) string {
+	host, ok := strings.CutPrefix(key, prefix)
+	if !ok || host == "" || strings.Contains(host, "/") {
+		return ""
+	}
+	return host
+}
+
+// Consul KV entry as returned by GET /v1/kv/<prefix>?recurse
+type consulEntry struct {
+	Key   string `json:"Key"`
+	Value []byte `json:"Value"` // Base64 in JSON
+}
+
+// Long-poll Consul's KV store with blocking queries, calling apply with
+// the mappings each time the prefix changes. Returns on the first error.
+func watchConsul(ctx context.Context, b *MappingBackend, apply func(map[string]string)) error {
+	base := strings.TrimSuffix(b.Address, "/")
+	if base == "" {
+		base = "http://127.0.0.1:8500"
+	}
+	index := "0"
+	for {
+		query := url.Values{"recurse": {"true"}, "index": {index}, "wait": {"5m"}}
+		req, err := http.NewRequestWithContext(ctx, http.MethodGet, base+"/v1/kv/"+strings.TrimPrefix(b.Prefix, "/")+"?"+query.Encode(), nil)
+		if err != nil {
+			return err
+		}
+		if b.Token != "" {
+			req.Header.Set("X-Consul-Token", b.Token)
+		}
+		resp, err := backendClient.Do(req)
+		if err != nil {
+			return err
+		}
+		var entries []consulEntry
+		switch resp.StatusCode {
+		case http.StatusOK:
+			err = json.NewDecoder(resp.Body).Decode(&entries)
+		case http.StatusNotFound: // Nothing under the prefix yet
+		default:
+			err = fmt.Errorf("consul returned %s", resp.Status)
+		}
+		resp.Body.Close()
+		if err != nil {
+			return err
+		}
+
+		next := resp.Header.Get("X-Consul-Index")
+		if next == index {
+			continue // The wait timed out without changes
+		}
+		if n, err := strconv.ParseUint(next, 10, 64); err != nil || n == 0 {
+			next = "0"
+		}
+		index = next
+
+		mappings := make(map[string]string)
+		prefix := strings.TrimPrefix(b.Prefix, "/")
+		for _, entry := range entries {
+			if host := backendHost(entry.Key, prefix); host != "" && len(entry.Value) > 0 {
+				mappings[host] = strings.TrimSpace(string(entry.Value))
+			}
+		}
+		apply(mappings)
+	}
+}
+
+// Read the prefix from etcd's JSON gateway, then follow its watch stream,
+// re-reading on every change. Returns on the first error.
+func watchEtcd(ctx context.Context, b *MappingBackend, apply func(map[string]string)) error {
+	base := strings.TrimSuffix(b.Address, "/")
+	if base == "" {
+		base = "http://127.0.0.1:2379"
+	}
+	key := base64.StdEncoding.EncodeToString([]byte(b.Prefix))
+	rangeEnd := base64.StdEncoding.EncodeToString(prefixEnd([]byte(b.Prefix)))
+
+	post := func(ctx context.Context, path string, body any) (*http.Response, error) {
+		data, _ := json.Marshal(body)
+		req, err := http.NewRequestWithContext(ctx, http.MethodPost, base+path, bytes.NewReader(data))
+		if err != nil {
+			return nil, err
+		}
+		req.Header.Set("Content-Type", "application/json")
+		if b.Token != "" {
+			req.Header.Set("Authorization", b.Token)
+		}
+		resp, err := backendClient.Do(req)
+		if err == nil && resp.StatusCode != http.StatusOK {
+			resp.Body.Close()
+			err = fmt.Errorf("etcd returned %s", resp.Status)
+		}
+		return resp, err
+	}
+
+	read := func() (int64, error) {
+		resp, err := post(ctx, "/v3/kv/range", map[string]string{"key": key, "range_end": rangeEnd})
+		if err != nil {
+			return 0, err
+		}
+		defer resp.Body.Close()
+		var result struct {
+			Header struct {
+				Revision string `json:"revision"`
+			} `json:"header"`
+			Kvs []struct {
+				Key   []byte `json:"key"`
+				Value []byte `json:"value"`
+			} `json:"kvs"`
+		}
+		if err := json.NewDecoder(resp.Body).Decode(&result); err != nil {
+			return 0, err
+		}
+		mappings := make(map[string]string)
+		for _, kv := range result.Kvs {
+			if host := backendHost(string(kv.Key), b.Prefix); host != "" && len(kv.Value) > 0 {
+				mappings[host] = strings.TrimSpace(string(kv.Value))
+			}
+		}
+		apply(mappings)
+		revision, _ := strconv.ParseInt(result.Header.Revision, 10, 64)
+		return revision, nil
+	}
+
+	revision, err := read()
+	if err != nil {
+		return err
+	}
+	resp, err := post(ctx, "/v3/watch", map[string]any{"create_request": map[string]any{
+		"key": key, "range_end": rangeEnd, "start_revision": strconv.FormatInt(revision+1, 10),
+	}})
+	if err != nil {
+		return err
+	}
+	defer resp.Body.Close()
+	scanner := bufio.NewScanner(resp.Body)
+	scanner.Buffer(nil, nativemsg.MaxMessageSize)
+	for scanner.Scan() {
+		var msg struct {
+			Result struct {
+				Events []json.RawMessage `json:"events"`
+			} `json:"result"`
+		}
+		if json.Unmarshal(scanner.Bytes(), &msg) == nil && len(msg.Result.Events) > 0 {
+			if _, err := read(); err != nil {
+				return err
+			}
+		}
+	}
+	if err := scanner.Err(); err != nil {
+		return err
+	}
+	return fmt.Errorf("etcd closed the watch")
+}
+
+// The key just past every key starting with prefix, for etcd range ends
+func prefixEnd(prefix []byte) []byte {
+	end := append([]byte(nil), prefix...)
+	for i := len(end) - 1; i >= 0; i-- {
+		if end[i] < 0xff {
+			end[i]++
+			return end[:i+1]
+		}
+	}
+	return []byte{0} // Every key
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"math/rand"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Balancing modes for mappings with several targets. Without one, targets
+// are tried strictly in order.
+const (
+	balanceRoundRobin = "roundRobin"
+	balanceWeighted   = "weighted"
+)
+
+// How long balancing skips a target after a connection to it fails. Targets
+// failing their proxy's health check are skipped until it passes.
+const targetDownFor = 10 * time.Second
+
+var (
+	targetsDown = make(map[string]time.Time) // Dial address -> skipped until
+	roundRobin  = make(map[string]int)       // Requested host -> next target
+	targetsMu   sync.Mutex
+)
+
+// Note the outcome of dialing a mapped target
+func markTarget(rt route, err error) {
+	if !rt.mapped {
+		return
+	}
+	if err != nil && strings.HasPrefix(rt.dynamic, dockerScheme) {
+		forgetDockerAddr(strings.TrimPrefix(rt.dynamic, dockerScheme), rt.requestedPort)
+	}
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	if err != nil {
+		targetsDown[rt.addr] = time.Now().Add(targetDownFor)
+	} else {
+		delete(targetsDown, rt.addr)
+	}
+}
+
+// Whether a target recently failed a connection. Callers must hold
+// targetsMu.
+func targetDown(addr string) bool {
+	until, ok := targetsDown[addr]
+	if ok && time.Now().After(until) {
+		delete(targetsDown, addr)
+		return false
+	}
+	return ok
+}
+
+// Dial addresses of targets currently skipped by balancing on a proxy
+// with health
+func downTargets(health *healthState) []string {
+	addrs := health.downAddrs()
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	for addr := range targetsDown {
+		if targetDown(addr) && !health.down(addr) {
+			addrs = append(addrs, addr)
+		}
+	}
+	sort.Strings(addrs)
+	return addrs
+}
+
+// Order a mapping's targets for one request under the route's balancing
+// mode: the picked target first, then the other healthy ones to fail over
+// to, then the ones that recently failed
+func balanceTargets(rt route, targets []string) []string {
+	mode := rt.options.Balance
+	if len(targets) < 2 || (mode != balanceRoundRobin && mode != balanceWeighted) {
+		return targets
+	}
+
+	targetsMu.Lock()
+	defer targetsMu.Unlock()
+	var healthy, down []int
+	for i, target := range targets {
+		if addr := rt.withTarget(target).addr; targetDown(addr) || rt.settings.health.down(addr) {
+			down = append(down, i)
+		} else {
+			healthy = append(healthy, i)
+		}
+	}
+	if len(healthy) == 0 {
+		return targets
+	}
+
+	pick := 0
+	if mode == balanceRoundRobin {
+		pick = roundRobin[rt.host] % len(healthy)
+		roundRobin[rt.host] = pick + 1
+	} else {
+		pick = pickWeighted(healthy, rt.options.Weights)
+	}
+
+	ordered := make([]string, 0, len(targets))
+	for i := range healthy {
+		ordered = append(ordered, targets[healthy[(pick+i)%len(healthy)]])
+	}
+	for _, i := range down {
+		ordered = append(ordered, targets[i])
+	}
+	return ordered
+}
+
+// Pick one of the candidate target indexes at random in proportion to its
+// weight. Missing weights count as 1; candidates weighted 0 are only failed
+// over to.
+func pickWeighted(candidates []int, weights []int) int {
+	weight := func(i int) int {
+		if i < len(weights) {
+			return max(weights[i], 0)
+		}
+		return 1
+	}
+	total := 0
+	for _, i := range candidates {
+		total += weight(i)
+	}
+	if total == 0 {
+		return 0
+	}
+	n := rand.Intn(total)
+	for pos, i := range candidates {
+		if n -= weight(i); n < 0 {
+			return pos
+		}
+	}
+	return 0
+}
@@ -0,0 +1,47 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+
+	"fhosts-proxy/mapping"
+)
+
+// The proxy listens on loopback unless the start message's bindAddress
+// names another address, such as a VM bridge IP or 0.0.0.0, so browsers in
+// local VMs and containers can use the host's mappings. Anything beyond
+// loopback exposes the proxy to the network, so it also needs allowRemote
+// as confirmation and proxyAuth so strangers can't use it. The admin API
+// stays on loopback.
+const loopbackHost = "127.0.0.1"
+
+var errBindRefused = errors.New("bind address refused")
+
+// Host to listen on for msg
+func bindHost(msg *Message) (string, error) {
+	if msg.BindAddress == "" {
+		return loopbackHost, nil
+	}
+	ip := net.ParseIP(mapping.Unbracket(msg.BindAddress))
+	if ip == nil {
+		return "", fmt.Errorf("%w: %q is not an IP address", errBindRefused, msg.BindAddress)
+	}
+	if !ip.IsLoopback() {
+		if !msg.AllowRemote {
+			return "", fmt.Errorf("%w: %s is reachable from the network, set allowRemote to confirm", errBindRefused, ip)
+		}
+		if !msg.ProxyAuth {
+			return "", fmt.Errorf("%w: %s is reachable from the network and needs proxyAuth", errBindRefused, ip)
+		}
+	}
+	return ip.String(), nil
+}
+
+// Host the running proxy listens on, loopback when stopped
+func (p *Proxy) bindHost() string {
+	if p.bind == "" {
+		return loopbackHost
+	}
+	return p.bind
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+)
+
+// How requests to a blocked host are answered. Status defaults to 403;
+// Reset drops the connection with a TCP reset instead.
+type BlockRule struct {
+	Status int  `json:"status,omitempty"`
+	Reset  bool `json:"reset,omitempty"`
+}
+
+// Answer a refused request. Returns false if err is nil and the request
+// should be forwarded.
+func refuse(w http.ResponseWriter, err error) bool {
+	if err == nil {
+		return false
+	}
+	refusal := refusalFor(err)
+	if refusal.Reset {
+		if hijacker, ok := w.(http.Hijacker); ok {
+			if conn, _, err := hijacker.Hijack(); err == nil {
+				resetConn(conn)
+				return true
+			}
+		}
+	}
+
+	status := refusal.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	http.Error(w, http.StatusText(status), status)
+	return true
+}
+
+// Refuses blocked hosts with their block rule
+type blockMiddleware struct{}
+
+func (blockMiddleware) OnConnect(f *Flow) error {
+	return blockMiddleware{}.check(f)
+}
+
+func (blockMiddleware) OnRequest(f *Flow, req *http.Request) (*http.Response, error) {
+	return nil, blockMiddleware{}.check(f)
+}
+
+func (blockMiddleware) OnResponse(f *Flow, req *http.Request, resp *http.Response) {}
+
+func (blockMiddleware) check(f *Flow) error {
+	if f.route.blocked == nil {
+		return nil
+	}
+	logInfo("Blocked %s", f.Host)
+	refusal := Refusal(*f.route.blocked)
+	return &refusal
+}
+
+// Close a connection with a TCP reset rather than a graceful FIN
+func resetConn(conn net.Conn) {
+	if tcp, ok := conn.(*net.TCPConn); ok {
+		tcp.SetLinger(0)
+	}
+	conn.Close()
+}
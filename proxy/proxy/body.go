@@ -0,0 +1,142 @@
+package proxy
+
+import (
+	"bytes"
+	"compress/gzip"
+	"compress/zlib"
+	"fmt"
+	"io"
+	"mime"
+	"net/http"
+	"regexp"
+	"strconv"
+	"strings"
+
+	"fhosts-proxy/mapping"
+)
+
+// A find/replace edit on a host's response bodies, e.g. turning absolute
+// production URLs back into the mapped hostname. A host's rules apply in
+// order to text, JSON, JavaScript and XML bodies.
+type BodyRule struct {
+	Find    string `json:"find"`
+	Replace string `json:"replace"`
+	Regex   bool   `json:"regex,omitempty"` // Find is a Go regular expression; Replace may use $1
+
+	re *regexp.Regexp
+}
+
+// Larger bodies are passed through unedited
+const maxRewriteBodySize = 10 << 20
+
+// Normalize and compile a table of body rules
+func compileBodyRules(table map[string][]BodyRule) (map[string][]BodyRule, error) {
+	compiled := make(map[string][]BodyRule, len(table))
+	for key, rules := range table {
+		rules = append([]BodyRule(nil), rules...)
+		for i, rule := range rules {
+			if rule.Find == "" {
+				return nil, fmt.Errorf("body rule for %s has nothing to find", key)
+			}
+			if rule.Regex {
+				re, err := regexp.Compile(rule.Find)
+				if err != nil {
+					return nil, fmt.Errorf("body rule for %s: %w", key, err)
+				}
+				rules[i].re = re
+			}
+		}
+		compiled[mapping.NormalizeHost(key)] = rules
+	}
+	return compiled, nil
+}
+
+func (rule BodyRule) apply(body []byte) []byte {
+	if rule.re != nil {
+		return rule.re.ReplaceAll(body, []byte(rule.Replace))
+	}
+	return bytes.ReplaceAll(body, []byte(rule.Find), []byte(rule.Replace))
+}
+
+// Whether bodies of this content type are text that rules can edit. Event
+// streams are left alone since they don't end.
+func rewritable(contentType string) bool {
+	mediaType, _, err := mime.ParseMediaType(contentType)
+	if err != nil || mediaType == "text/event-stream" {
+		return false
+	}
+	return strings.HasPrefix(mediaType, "text/") || strings.HasSuffix(mediaType, "json") ||
+		strings.HasSuffix(mediaType, "javascript") || strings.HasSuffix(mediaType, "xml")
+}
+
+// Applies the host's body rules to responses. Compressed bodies are
+// decoded and sent on uncompressed, with Content-Length fixed up; with the
+// noCompression option the target is asked not to compress them at all.
+type rewriteMiddleware struct{}
+
+func (rewriteMiddleware) OnConnect(f *Flow) error { return nil }
+
+func (rewriteMiddleware) OnRequest(f *Flow, req *http.Request) (*http.Response, error) {
+	if f.route.options.NoCompression {
+		req.Header.Set("Accept-Encoding", "identity")
+	}
+	return nil, nil
+}
+
+func (rewriteMiddleware) OnResponse(f *Flow, req *http.Request, resp *http.Response) {
+	rules := f.route.bodyRules
+	// Partial content is passed on as is, since edits would shift the
+	// byte offsets of its Content-Range
+	if len(rules) == 0 || req.Method == http.MethodHead || resp.StatusCode == http.StatusNoContent ||
+		resp.StatusCode == http.StatusNotModified || resp.StatusCode == http.StatusPartialContent ||
+		!rewritable(resp.Header.Get("Content-Type")) {
+		return
+	}
+	encoding := strings.ToLower(resp.Header.Get("Content-Encoding"))
+	if encoding != "" && encoding != "identity" && encoding != "gzip" && encoding != "deflate" {
+		logDebug("Not rewriting %s body of %s", encoding, f.Host)
+		return
+	}
+
+	raw, err := io.ReadAll(io.LimitReader(resp.Body, maxRewriteBodySize+1))
+	if err != nil || len(raw) > maxRewriteBodySize {
+		// Pass on what was read and the rest as they are
+		resp.Body = readCloser(io.MultiReader(bytes.NewReader(raw), resp.Body), resp.Body)
+		return
+	}
+	body, err := decodeBody(raw, encoding)
+	if err != nil || len(body) > maxRewriteBodySize {
+		if err != nil {
+			logWarn("Not rewriting body of %s: %v", f.Host, err)
+		}
+		resp.Body = readCloser(bytes.NewReader(raw), resp.Body)
+		return
+	}
+
+	for _, rule := range rules {
+		body = rule.apply(body)
+	}
+	resp.Body = readCloser(bytes.NewReader(body), resp.Body)
+	resp.ContentLength = int64(len(body))
+	resp.Header.Del("Content-Encoding")
+	resp.Header.Set("Content-Length", strconv.Itoa(len(body)))
+}
+
+// Decode a body sent with the given Content-Encoding
+func decodeBody(raw []byte, encoding string) ([]byte, error) {
+	var r io.ReadCloser
+	var err error
+	switch encoding {
+	case "gzip":
+		r, err = gzip.NewReader(bytes.NewReader(raw))
+	case "deflate":
+		r, err = zlib.NewReader(bytes.NewReader(raw))
+	default:
+		return raw, nil
+	}
+	if err != nil {
+		return nil, err
+	}
+	defer r.Close()
+	return io.ReadAll(io.LimitReader(r, maxRewriteBodySize+1))
+}
@@ -0,0 +1,204 @@
+package proxy
+
+import (
+	"crypto/ecdsa"
+	"crypto/elliptic"
+	"crypto/rand"
+	"crypto/tls"
+	"crypto/x509"
+	"crypto/x509/pkix"
+	"encoding/pem"
+	"errors"
+	"math/big"
+	"net"
+	"os"
+	"path/filepath"
+	"sync"
+	"time"
+)
+
+const (
+	caCertFile = "ca.pem"
+	caKeyFile  = "ca-key.pem"
+)
+
+// The local CA used to mint certificates for MITM-terminated hosts, and a
+// cache of leaf certificates already minted from it
+var (
+	caMu        sync.Mutex
+	caCert      *x509.Certificate
+	caKey       *ecdsa.PrivateKey
+	caPEM       []byte
+	leafCerts   = make(map[string]*tls.Certificate)
+	leafCertsMu sync.Mutex
+)
+
+// Load the CA from disk, generating and saving one on first use
+func loadCA() error {
+	caMu.Lock()
+	defer caMu.Unlock()
+
+	if caCert != nil {
+		return nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+
+	certPEM, certErr := os.ReadFile(filepath.Join(dir, caCertFile))
+	keyPEM, keyErr := os.ReadFile(filepath.Join(dir, caKeyFile))
+	if errors.Is(certErr, os.ErrNotExist) || errors.Is(keyErr, os.ErrNotExist) {
+		return generateCALocked(dir)
+	}
+	if certErr != nil {
+		return certErr
+	}
+	if keyErr != nil {
+		return keyErr
+	}
+	return parseCALocked(certPEM, keyPEM)
+}
+
+// Replace the CA with a freshly generated one. Previously trusted copies of
+// the old CA stop working, so the extension should prompt the user again.
+func regenerateCA() error {
+	caMu.Lock()
+	defer caMu.Unlock()
+
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	return generateCALocked(dir)
+}
+
+// Return the CA certificate in PEM form
+func exportCA() (string, error) {
+	if err := loadCA(); err != nil {
+		return "", err
+	}
+	caMu.Lock()
+	defer caMu.Unlock()
+	return string(caPEM), nil
+}
+
+// Generate a CA and write it to dir. Callers must hold caMu.
+func generateCALocked(dir string) error {
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return err
+	}
+	template := &x509.Certificate{
+		SerialNumber:          serial,
+		Subject:               pkix.Name{CommonName: "fhosts local CA", Organization: []string{"fhosts"}},
+		NotBefore:             time.Now().Add(-time.Hour),
+		NotAfter:              time.Now().AddDate(10, 0, 0),
+		KeyUsage:              x509.KeyUsageCertSign | x509.KeyUsageCRLSign | x509.KeyUsageDigitalSignature,
+		BasicConstraintsValid: true,
+		IsCA:                  true,
+		MaxPathLenZero:        true,
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, template, &key.PublicKey, key)
+	if err != nil {
+		return err
+	}
+	keyDER, err := x509.MarshalECPrivateKey(key)
+	if err != nil {
+		return err
+	}
+
+	certPEM := pem.EncodeToMemory(&pem.Block{Type: "CERTIFICATE", Bytes: der})
+	keyPEM := pem.EncodeToMemory(&pem.Block{Type: "EC PRIVATE KEY", Bytes: keyDER})
+	if err := os.WriteFile(filepath.Join(dir, caKeyFile), keyPEM, 0600); err != nil {
+		return err
+	}
+	if err := os.WriteFile(filepath.Join(dir, caCertFile), certPEM, 0644); err != nil {
+		return err
+	}
+	return parseCALocked(certPEM, keyPEM)
+}
+
+// Parse a PEM CA certificate and key. Callers must hold caMu.
+func parseCALocked(certPEM, keyPEM []byte) error {
+	certBlock, _ := pem.Decode(certPEM)
+	keyBlock, _ := pem.Decode(keyPEM)
+	if certBlock == nil || keyBlock == nil {
+		return errors.New("invalid CA files")
+	}
+	cert, err := x509.ParseCertificate(certBlock.Bytes)
+	if err != nil {
+		return err
+	}
+	key, err := x509.ParseECPrivateKey(keyBlock.Bytes)
+	if err != nil {
+		return err
+	}
+
+	caCert, caKey, caPEM = cert, key, certPEM
+	leafCertsMu.Lock()
+	leafCerts = make(map[string]*tls.Certificate)
+	leafCertsMu.Unlock()
+	return nil
+}
+
+// Get a leaf certificate for hostname signed by the local CA, minting and
+// caching it on first use
+func leafCertificate(hostname string) (*tls.Certificate, error) {
+	if err := loadCA(); err != nil {
+		return nil, err
+	}
+
+	leafCertsMu.Lock()
+	defer leafCertsMu.Unlock()
+	if cert, ok := leafCerts[hostname]; ok && time.Now().Before(cert.Leaf.NotAfter) {
+		return cert, nil
+	}
+
+	caMu.Lock()
+	signer, signerKey := caCert, caKey
+	caMu.Unlock()
+
+	key, err := ecdsa.GenerateKey(elliptic.P256(), rand.Reader)
+	if err != nil {
+		return nil, err
+	}
+	serial, err := randomSerial()
+	if err != nil {
+		return nil, err
+	}
+	template := &x509.Certificate{
+		SerialNumber: serial,
+		Subject:      pkix.Name{CommonName: hostname},
+		NotBefore:    time.Now().Add(-time.Hour),
+		NotAfter:     time.Now().AddDate(1, 0, 0),
+		KeyUsage:     x509.KeyUsageDigitalSignature,
+		ExtKeyUsage:  []x509.ExtKeyUsage{x509.ExtKeyUsageServerAuth},
+	}
+	if ip := net.ParseIP(hostname); ip != nil {
+		template.IPAddresses = []net.IP{ip}
+	} else {
+		template.DNSNames = []string{hostname}
+	}
+	der, err := x509.CreateCertificate(rand.Reader, template, signer, &key.PublicKey, signerKey)
+	if err != nil {
+		return nil, err
+	}
+	leaf, err := x509.ParseCertificate(der)
+	if err != nil {
+		return nil, err
+	}
+
+	cert := &tls.Certificate{Certificate: [][]byte{der, signer.Raw}, PrivateKey: key, Leaf: leaf}
+	leafCerts[hostname] = cert
+	return cert, nil
+}
+
+// Random 128-bit certificate serial number
+func randomSerial() (*big.Int, error) {
+	return rand.Int(rand.Reader, new(big.Int).Lsh(big.NewInt(1), 128))
+}
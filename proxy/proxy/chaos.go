@@ -0,0 +1,155 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"math/rand"
+	"net"
+	"net/http"
+	"strings"
+	"sync/atomic"
+)
+
+// Fault injection for a mapping, for resilience testing without a separate
+// fault proxy. Percentages are of connections or requests, 0 to 100.
+type Chaos struct {
+	DropPercent     int   `json:"dropPercent,omitempty"`     // Reset tunnels and requests before they reach the target
+	ErrorPercent    int   `json:"errorPercent,omitempty"`    // Answer requests with ErrorStatus instead of forwarding them
+	ErrorStatus     int   `json:"errorStatus,omitempty"`     // Defaults to 500
+	TruncatePercent int   `json:"truncatePercent,omitempty"` // Cut responses off partway through the body
+	ResetAfterBytes int64 `json:"resetAfterBytes,omitempty"` // Reset tunnels once this many bytes have passed either way
+}
+
+// Whether a fault with this percentage happens this time
+func chance(percent int) bool {
+	return percent > 0 && rand.Intn(100) < percent
+}
+
+// Injects the mapping's chaos faults
+type chaosMiddleware struct{}
+
+func (chaosMiddleware) OnConnect(f *Flow) error {
+	if c := f.route.options.Chaos; c != nil && chance(c.DropPercent) {
+		logDebug("Chaos: dropped %s", f.Host)
+		return &Refusal{Reset: true}
+	}
+	return nil
+}
+
+func (chaosMiddleware) OnRequest(f *Flow, req *http.Request) (*http.Response, error) {
+	c := f.route.options.Chaos
+	if c == nil {
+		return nil, nil
+	}
+	if chance(c.DropPercent) {
+		logDebug("Chaos: dropped %s %s%s", req.Method, f.Host, req.URL.Path)
+		return nil, &Refusal{Reset: true}
+	}
+	if chance(c.ErrorPercent) {
+		status := c.ErrorStatus
+		if status == 0 {
+			status = http.StatusInternalServerError
+		}
+		logDebug("Chaos: answered %s %s%s with %d", req.Method, f.Host, req.URL.Path, status)
+		body := http.StatusText(status) + "\n"
+		header := http.Header{"Content-Type": {"text/plain; charset=utf-8"}}
+		return &http.Response{StatusCode: status, Header: header, ContentLength: int64(len(body)), Body: io.NopCloser(strings.NewReader(body))}, nil
+	}
+	return nil, nil
+}
+
+func (chaosMiddleware) OnResponse(f *Flow, req *http.Request, resp *http.Response) {
+	c := f.route.options.Chaos
+	if c == nil || !chance(c.TruncatePercent) {
+		return
+	}
+	// Somewhere inside the body, or its first 16KB when the length isn't known
+	limit := int64(16 << 10)
+	if resp.ContentLength > 0 {
+		limit = resp.ContentLength
+	}
+	logDebug("Chaos: truncating %s %s%s", req.Method, f.Host, req.URL.Path)
+	resp.Body = &truncatedBody{ReadCloser: resp.Body, left: rand.Int63n(limit)}
+}
+
+// Ends a truncated body, so ReverseProxy aborts the response
+var errChaosTruncated = errors.New("response truncated by chaos")
+
+// A body that fails with errChaosTruncated after left bytes
+type truncatedBody struct {
+	io.ReadCloser
+	left int64
+}
+
+func (b *truncatedBody) Read(p []byte) (int, error) {
+	if b.left <= 0 {
+		return 0, errChaosTruncated
+	}
+	if int64(len(p)) > b.left {
+		p = p[:b.left]
+	}
+	n, err := b.ReadCloser.Read(p)
+	b.left -= int64(n)
+	return n, err
+}
+
+// Flush what has been written to w before a truncated body fails, so
+// ReverseProxy's abort leaves the client with a body cut off partway
+// rather than none at all
+func flushOnTruncation(body io.ReadCloser, w http.ResponseWriter) io.ReadCloser {
+	return &truncationFlusher{ReadCloser: body, w: w}
+}
+
+type truncationFlusher struct {
+	io.ReadCloser
+	w http.ResponseWriter
+}
+
+func (f *truncationFlusher) Read(p []byte) (int, error) {
+	n, err := f.ReadCloser.Read(p)
+	if errors.Is(err, errChaosTruncated) {
+		http.NewResponseController(f.w).Flush()
+	}
+	return n, err
+}
+
+// Resets a tunnel once its bytes in both directions reach the mapping's
+// resetAfterBytes. newTunnelBudget returns nil when there is no budget,
+// and wrap ignores nil.
+type tunnelBudget struct {
+	left  atomic.Int64
+	conns []net.Conn
+}
+
+func newTunnelBudget(rt route, conns ...net.Conn) *tunnelBudget {
+	c := rt.options.Chaos
+	if c == nil || c.ResetAfterBytes <= 0 {
+		return nil
+	}
+	b := &tunnelBudget{conns: conns}
+	b.left.Store(c.ResetAfterBytes)
+	return b
+}
+
+func (b *tunnelBudget) wrap(r io.Reader) io.Reader {
+	if b == nil {
+		return r
+	}
+	return &budgetReader{Reader: r, budget: b}
+}
+
+type budgetReader struct {
+	io.Reader
+	budget *tunnelBudget
+}
+
+func (r *budgetReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if r.budget.left.Add(-int64(n)) <= 0 {
+		logDebug("Chaos: resetting tunnel after its byte budget")
+		for _, conn := range r.budget.conns {
+			resetConn(conn)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"errors"
+	"os"
+	"sync"
+	"time"
+
+	"software.sslmate.com/src/go-pkcs12"
+)
+
+// A client certificate presented when the proxy opens TLS to a mapping's
+// target (MITM mode), for backends that require mutual TLS. Either
+// CertFile and KeyFile (PEM) or a PKCS#12 bundle with its password.
+type ClientCert struct {
+	CertFile string `json:"certFile,omitempty"`
+	KeyFile  string `json:"keyFile,omitempty"`
+	PKCS12   string `json:"pkcs12,omitempty"`
+	Password string `json:"password,omitempty"`
+}
+
+type loadedCert struct {
+	cert    *tls.Certificate
+	modTime time.Time // Of the newest file it was loaded from
+}
+
+var (
+	clientCerts   = make(map[ClientCert]loadedCert)
+	clientCertsMu sync.Mutex
+)
+
+// GetClientCertificate callback for c. Files are re-read when they change,
+// so rotated certificates are picked up without a restart.
+func (c ClientCert) provider() func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+	return func(*tls.CertificateRequestInfo) (*tls.Certificate, error) {
+		cert, err := c.load()
+		if err != nil {
+			logWarn("Failed to load client certificate: %v", err)
+			return nil, err
+		}
+		return cert, nil
+	}
+}
+
+func (c ClientCert) load() (*tls.Certificate, error) {
+	files := []string{c.CertFile, c.KeyFile}
+	if c.PKCS12 != "" {
+		files = []string{c.PKCS12}
+	}
+	var newest time.Time
+	for _, name := range files {
+		if name == "" {
+			return nil, errors.New("clientCert needs certFile and keyFile, or pkcs12")
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			return nil, err
+		}
+		if info.ModTime().After(newest) {
+			newest = info.ModTime()
+		}
+	}
+
+	clientCertsMu.Lock()
+	defer clientCertsMu.Unlock()
+	if loaded, ok := clientCerts[c]; ok && loaded.modTime.Equal(newest) {
+		return loaded.cert, nil
+	}
+
+	var cert tls.Certificate
+	var err error
+	if c.PKCS12 != "" {
+		cert, err = loadPKCS12(c.PKCS12, c.Password)
+	} else {
+		cert, err = tls.LoadX509KeyPair(c.CertFile, c.KeyFile)
+	}
+	if err != nil {
+		return nil, err
+	}
+	clientCerts[c] = loadedCert{cert: &cert, modTime: newest}
+	return &cert, nil
+}
+
+// Read the key and certificate chain of a PKCS#12 bundle
+func loadPKCS12(path, password string) (tls.Certificate, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	key, leaf, chain, err := pkcs12.DecodeChain(data, password)
+	if err != nil {
+		return tls.Certificate{}, err
+	}
+	cert := tls.Certificate{PrivateKey: key, Leaf: leaf, Certificate: [][]byte{leaf.Raw}}
+	for _, ca := range chain {
+		cert.Certificate = append(cert.Certificate, ca.Raw)
+	}
+	return cert, nil
+}
@@ -0,0 +1,243 @@
+package proxy
+
+import (
+	"encoding/json"
+	"maps"
+	"os"
+	"path/filepath"
+	"strings"
+
+	"sigs.k8s.io/yaml"
+
+	"fhosts-proxy/mapping"
+)
+
+// The full mapping set as one document, for backing up and sharing setups.
+// Field names match the start message so an export can also be sent as one.
+type ProxyConfig struct {
+	Version     string                    `json:"version,omitempty"` // Host version that exported it
+	Mappings    mapping.Set               `json:"mappings,omitempty"`
+	Disabled    mapping.Set               `json:"disabled,omitempty"` // Host mappings switched off
+	Regex       []mapping.RegexMapping    `json:"regexMappings,omitempty"`
+	Options     map[string]MappingOptions `json:"options,omitempty"`
+	Blocked     map[string]BlockRule      `json:"blocked,omitempty"`
+	HeaderRules map[string]HeaderRules    `json:"headerRules,omitempty"`
+	Mocks       map[string][]MockRule     `json:"mocks,omitempty"`
+	BodyRules   map[string][]BodyRule     `json:"bodyRules,omitempty"`
+}
+
+// Snapshot the active mapping tables
+func (p *Proxy) exportConfig() *ProxyConfig {
+	p.mappingsMu.RLock()
+	defer p.mappingsMu.RUnlock()
+
+	cfg := &ProxyConfig{
+		Version:     version,
+		Mappings:    maps.Clone(p.hostMappings),
+		Disabled:    maps.Clone(p.disabledMappings),
+		Options:     maps.Clone(p.mappingOptions),
+		Blocked:     maps.Clone(p.blockedHosts),
+		HeaderRules: maps.Clone(p.headerRules),
+		Mocks:       maps.Clone(p.mockRules),
+		BodyRules:   maps.Clone(p.bodyRules),
+	}
+	for _, rule := range p.regexMappings {
+		cfg.Regex = append(cfg.Regex, mapping.RegexMapping{Pattern: rule.Pattern(), Target: rule.Target})
+	}
+	return cfg
+}
+
+// Replace the active mapping tables with an exported document
+func (p *Proxy) importConfig(cfg *ProxyConfig) error {
+	return p.setMappings(&Message{
+		Mappings:    cfg.Mappings,
+		Disabled:    cfg.Disabled,
+		Regex:       cfg.Regex,
+		Options:     cfg.Options,
+		Blocked:     cfg.Blocked,
+		HeaderRules: cfg.HeaderRules,
+		Mocks:       cfg.Mocks,
+		BodyRules:   cfg.BodyRules,
+	})
+}
+
+// Decode a config or rule file, as YAML for .yaml and .yml names and JSON
+// otherwise. Both use the JSON field names.
+func decodeConfig(name string, data []byte, v any) error {
+	if isYAML(name) {
+		return yaml.Unmarshal(data, v)
+	}
+	return json.Unmarshal(data, v)
+}
+
+func isYAML(name string) bool {
+	ext := strings.ToLower(filepath.Ext(name))
+	return ext == ".yaml" || ext == ".yml"
+}
+
+// Optional defaults loaded from config.json (or config.yaml) in the config
+// directory (or FHOSTS_CONFIG) at startup. Values in the extension's
+// messages override them, and its mappings are layered over the static
+// ones here.
+type FileConfig struct {
+	ProxyConfig
+	Port             *int            `json:"port,omitempty"`
+	IPv6             bool            `json:"ipv6,omitempty"`
+	Timeouts         *Timeouts       `json:"timeouts,omitempty"`
+	MaxConnections   int             `json:"maxConnections,omitempty"`
+	LogLevel         string          `json:"logLevel,omitempty"`
+	WatchFile        string          `json:"watchFile,omitempty"`
+	AccessLog        string          `json:"accessLog,omitempty"`
+	AdminPort        int             `json:"adminPort,omitempty"`
+	GRPC             string          `json:"grpc,omitempty"`
+	OTLPEndpoint     string          `json:"otlpEndpoint,omitempty"`
+	LogRotation      LogRotation     `json:"logRotation,omitempty"`
+	SystemHosts      bool            `json:"systemHosts,omitempty"`
+	Backend          *MappingBackend `json:"backend,omitempty"`
+	ProxyAuth        bool            `json:"proxyAuth,omitempty"`
+	ConnectPorts     []int           `json:"connectPorts,omitempty"`
+	BlockPrivate     bool            `json:"blockPrivate,omitempty"`
+	CABundle         string          `json:"caBundle,omitempty"`
+	ParentProxy      *ParentProxy    `json:"parentProxy,omitempty"`
+	Middleware       []string        `json:"middleware,omitempty"`
+	Listeners        []Listener      `json:"listeners,omitempty"`
+	BindAddress      string          `json:"bindAddress,omitempty"`
+	AllowRemote      bool            `json:"allowRemote,omitempty"`
+	Tape             *Tape           `json:"tape,omitempty"`
+	Hooks            []Hook          `json:"hooks,omitempty"`
+	ForwardedHeaders string          `json:"forwardedHeaders,omitempty"`
+}
+
+// Config file names looked up in the config directory, in order
+var configFiles = []string{"config.json", "config.yaml", "config.yml"}
+
+var fileConfig FileConfig
+
+// Read the config file if present and apply its log level. Settings it
+// omits keep the values applyEnv put in fileConfig.
+func loadConfigFile() {
+	path, err := configFilePath()
+	if err != nil {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return // No config file
+	}
+
+	cfg := fileConfig
+	if err := decodeConfig(path, data, &cfg); err != nil {
+		logWarn("Ignoring invalid %s: %v", filepath.Base(path), err)
+		return
+	}
+	if cfg.LogLevel != "" {
+		if err := setLogLevel(cfg.LogLevel); err != nil {
+			logWarn("Ignoring %s log level: %v", filepath.Base(path), err)
+		}
+	}
+	fileConfig = cfg
+	configureLogRotation(cfg.LogRotation)
+}
+
+// Fill settings a start or restart message omits from the config file
+func applyFileDefaults(msg *Message) {
+	if msg.Port == nil {
+		msg.Port = fileConfig.Port
+	}
+	if !msg.IPv6 {
+		msg.IPv6 = fileConfig.IPv6
+	}
+	if msg.MaxConnections == 0 {
+		msg.MaxConnections = fileConfig.MaxConnections
+	}
+	if msg.WatchFile == "" {
+		msg.WatchFile = fileConfig.WatchFile
+	}
+	if msg.AccessLog == "" {
+		msg.AccessLog = fileConfig.AccessLog
+	}
+	if msg.AdminPort == 0 {
+		msg.AdminPort = fileConfig.AdminPort
+	}
+	if msg.GRPC == "" {
+		msg.GRPC = fileConfig.GRPC
+	}
+	if msg.OTLPEndpoint == "" {
+		msg.OTLPEndpoint = fileConfig.OTLPEndpoint
+	}
+	if !msg.SystemHosts {
+		msg.SystemHosts = fileConfig.SystemHosts
+	}
+	if msg.Backend == nil {
+		msg.Backend = fileConfig.Backend
+	}
+	if !msg.ProxyAuth {
+		msg.ProxyAuth = fileConfig.ProxyAuth
+	}
+	if msg.ConnectPorts == nil {
+		msg.ConnectPorts = fileConfig.ConnectPorts
+	}
+	if !msg.BlockPrivate {
+		msg.BlockPrivate = fileConfig.BlockPrivate
+	}
+	if msg.CABundle == "" {
+		msg.CABundle = fileConfig.CABundle
+	}
+	if msg.ParentProxy == nil {
+		msg.ParentProxy = fileConfig.ParentProxy
+	}
+	if msg.Tape == nil {
+		msg.Tape = fileConfig.Tape
+	}
+	if msg.Hooks == nil {
+		msg.Hooks = fileConfig.Hooks
+	}
+	if msg.Middleware == nil {
+		msg.Middleware = fileConfig.Middleware
+	}
+	if msg.Listeners == nil {
+		msg.Listeners = fileConfig.Listeners
+	}
+	if msg.BindAddress == "" {
+		msg.BindAddress = fileConfig.BindAddress
+	}
+	if !msg.AllowRemote {
+		msg.AllowRemote = fileConfig.AllowRemote
+	}
+	if msg.ForwardedHeaders == "" {
+		msg.ForwardedHeaders = fileConfig.ForwardedHeaders
+	}
+	if fileConfig.Timeouts != nil {
+		var t Timeouts
+		if msg.Timeouts != nil {
+			t = *msg.Timeouts
+		}
+		t = t.withDefaults(*fileConfig.Timeouts)
+		msg.Timeouts = &t
+	}
+}
+
+// Layer a full mapping set over the config file's static mappings, the
+// watched file's and the mapping backend's. Entries in msg win; its regex
+// rules are tried before the static ones.
+func (p *Proxy) withStaticMappings(msg *Message) *Message {
+	static, watched := fileConfig.ProxyConfig, p.watch.config
+	layered := *msg
+	layered.Mappings = layerMap(layerMap(layerMap(static.Mappings, watched.Mappings), p.backend.mappings), msg.Mappings)
+	layered.Options = layerMap(layerMap(static.Options, watched.Options), msg.Options)
+	layered.Blocked = layerMap(layerMap(static.Blocked, watched.Blocked), msg.Blocked)
+	layered.HeaderRules = layerMap(layerMap(static.HeaderRules, watched.HeaderRules), msg.HeaderRules)
+	layered.Mocks = layerMap(layerMap(static.Mocks, watched.Mocks), msg.Mocks)
+	layered.BodyRules = layerMap(layerMap(static.BodyRules, watched.BodyRules), msg.BodyRules)
+	layered.Regex = append(append([]mapping.RegexMapping(nil), msg.Regex...), static.Regex...)
+	return &layered
+}
+
+func layerMap[V any](base, over map[string]V) map[string]V {
+	if len(base) == 0 {
+		return over
+	}
+	merged := maps.Clone(base)
+	maps.Copy(merged, over)
+	return merged
+}
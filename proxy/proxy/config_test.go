@@ -0,0 +1,53 @@
+package proxy
+
+import (
+	"encoding/json"
+	"reflect"
+	"testing"
+
+	"sigs.k8s.io/yaml"
+
+	"fhosts-proxy/mapping"
+)
+
+func TestProxyConfigRoundTrip(t *testing.T) {
+	cfg := &ProxyConfig{
+		Mappings:    mapping.Set{"app.test": "127.0.0.1:3000"},
+		Regex:       []mapping.RegexMapping{{Pattern: `^api\d+\.test$`, Target: "127.0.0.1:4000"}},
+		HeaderRules: map[string]HeaderRules{"app.test": {Request: &HeaderOps{Set: map[string]string{"X-Env": "dev"}}}},
+		BodyRules:   map[string][]BodyRule{"app.test": {{Find: "prod", Replace: "dev"}}},
+	}
+	data, err := json.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+	yamlData, err := yaml.Marshal(cfg)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, tt := range []struct{ name, file string }{{"JSON", "config.json"}, {"YAML", "config.yaml"}} {
+		t.Run(tt.name, func(t *testing.T) {
+			encoded := data
+			if tt.file == "config.yaml" {
+				encoded = yamlData
+			}
+			var got ProxyConfig
+			if err := decodeConfig(tt.file, encoded, &got); err != nil {
+				t.Fatal(err)
+			}
+			if !reflect.DeepEqual(got.Regex, cfg.Regex) || !reflect.DeepEqual(got.HeaderRules, cfg.HeaderRules) || !reflect.DeepEqual(got.BodyRules, cfg.BodyRules) {
+				t.Errorf("decoded %+v from %s", got, encoded)
+			}
+		})
+	}
+
+	// An export is also a valid start message
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		t.Fatal(err)
+	}
+	if len(msg.Regex) != 1 || len(msg.HeaderRules) != 1 || len(msg.BodyRules) != 1 {
+		t.Errorf("start message decoded from an export lost fields: %s", data)
+	}
+}
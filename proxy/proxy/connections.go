@@ -0,0 +1,129 @@
+package proxy
+
+import (
+	"io"
+	"sort"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// An open tunnel or in-flight HTTP forward, as listed by listConnections
+type ConnectionInfo struct {
+	ID       int64  `json:"id"`
+	Kind     string `json:"kind"` // "connect", "socks", "upgrade", "mitm" or "http"
+	Client   string `json:"client"`
+	Host     string `json:"host"`
+	Target   string `json:"target"`
+	AgeMs    int64  `json:"ageMs"`
+	BytesIn  int64  `json:"bytesIn"`
+	BytesOut int64  `json:"bytesOut"`
+}
+
+// A registered connection. close tears it down from another goroutine.
+type trackedConn struct {
+	id     int64
+	kind   string
+	client string
+	rt     route
+	start  time.Time
+	in     atomic.Int64
+	out    atomic.Int64
+	close  func()
+}
+
+var (
+	connections   = make(map[int64]*trackedConn)
+	connectionsMu sync.Mutex
+	nextConnID    atomic.Int64
+)
+
+// Register a connection until untrack is called. A connection of a
+// stopped proxy's route is closed at once.
+func trackConnection(kind, client string, rt route, close func()) *trackedConn {
+	c := &trackedConn{
+		id:     nextConnID.Add(1),
+		kind:   kind,
+		client: client,
+		rt:     rt,
+		start:  time.Now(),
+		close:  close,
+	}
+	connectionsMu.Lock()
+	connections[c.id] = c
+	stopped := rt.settings != nil && rt.settings.stopped
+	connectionsMu.Unlock()
+	if stopped {
+		close()
+	}
+	return c
+}
+
+func (c *trackedConn) untrack() {
+	connectionsMu.Lock()
+	delete(connections, c.id)
+	connectionsMu.Unlock()
+}
+
+// Wrap a request body so its bytes count as BytesOut
+func (c *trackedConn) countBodyOut(body io.ReadCloser) io.ReadCloser {
+	if body == nil {
+		return nil
+	}
+	return readCloser(&countingReader{Reader: body, n: &c.out}, body)
+}
+
+// Wrap a response body so its bytes count as BytesIn
+func (c *trackedConn) countBodyIn(body io.ReadCloser) io.ReadCloser {
+	return readCloser(&countingReader{Reader: body, n: &c.in}, body)
+}
+
+// Snapshot the open connections, oldest first
+func listConnections() []ConnectionInfo {
+	connectionsMu.Lock()
+	defer connectionsMu.Unlock()
+
+	list := make([]ConnectionInfo, 0, len(connections))
+	for _, c := range connections {
+		list = append(list, ConnectionInfo{
+			ID:       c.id,
+			Kind:     c.kind,
+			Client:   c.client,
+			Host:     c.rt.host,
+			Target:   c.rt.addr,
+			AgeMs:    time.Since(c.start).Milliseconds(),
+			BytesIn:  c.in.Load(),
+			BytesOut: c.out.Load(),
+		})
+	}
+	sort.Slice(list, func(i, j int) bool { return list[i].ID < list[j].ID })
+	return list
+}
+
+// Tear down a connection by ID. Reports whether it was open.
+func closeConnection(id int64) bool {
+	connectionsMu.Lock()
+	c, ok := connections[id]
+	connectionsMu.Unlock()
+	if ok {
+		c.close()
+	}
+	return ok
+}
+
+// Tear down every connection of the routes carrying settings, those of a
+// proxy that has been stopped: the hijacked tunnels outlive its server.
+func closeConnections(settings *proxySettings) {
+	connectionsMu.Lock()
+	settings.stopped = true
+	var closing []*trackedConn
+	for _, c := range connections {
+		if c.rt.settings == settings {
+			closing = append(closing, c)
+		}
+	}
+	connectionsMu.Unlock()
+	for _, c := range closing {
+		c.close()
+	}
+}
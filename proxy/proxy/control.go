@@ -0,0 +1,172 @@
+package proxy
+
+import (
+	"bufio"
+	"encoding/json"
+	"fmt"
+	"net"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+
+	"fhosts-proxy/nativemsg"
+)
+
+// Local control channel, so scripts (fhosts-proxy ctl ...) can send the
+// same actions as the extension to a running host. Requests and replies are
+// newline-delimited JSON messages. It is a Unix socket, or a named pipe on
+// Windows, that only the user can open.
+var controlListener net.Listener
+
+// Control clients that sent attach and receive events as well as replies
+var (
+	attachedMu sync.Mutex
+	attached   = make(map[*controlClient]bool)
+)
+
+type controlClient struct {
+	mu  sync.Mutex
+	enc *json.Encoder
+}
+
+func (c *controlClient) send(msg Message) {
+	c.mu.Lock()
+	defer c.mu.Unlock()
+	c.enc.Encode(msg)
+}
+
+// Pass an event to every attached client
+func broadcast(msg Message) {
+	attachedMu.Lock()
+	defer attachedMu.Unlock()
+	for c := range attached {
+		c.send(msg)
+	}
+}
+
+// Listen on the control channel unless another live instance owns it
+func startControl() error {
+	l := takeActivatedControl()
+	if l == nil {
+		var err error
+		if l, err = listenControl(); err != nil {
+			return err
+		}
+	}
+	controlListener = l
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return // Listener closed
+			}
+			go serveControl(conn)
+		}
+	}()
+	return nil
+}
+
+func stopControl() {
+	if controlListener != nil {
+		controlListener.Close()
+		controlListener = nil
+	}
+}
+
+// Handle requests from one control client until it disconnects
+func serveControl(conn net.Conn) {
+	defer conn.Close()
+	client := &controlClient{enc: json.NewEncoder(conn)}
+	send := client.send
+	source := sourceCtl
+	defer func() {
+		attachedMu.Lock()
+		delete(attached, client)
+		attachedMu.Unlock()
+	}()
+
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), nativemsg.MaxMessageSize)
+	for scanner.Scan() {
+		var msg Message
+		if err := json.Unmarshal(scanner.Bytes(), &msg); err != nil {
+			send(Message{Type: "error", ErrorCode: ErrCodeBadMessage, Message: fmt.Sprintf("Invalid message: %v", err)})
+			continue
+		}
+		if msg.Action == "attach" {
+			attachedMu.Lock()
+			attached[client] = true
+			attachedMu.Unlock()
+			source = sourceExtension // A host relaying for its browser
+			send(Message{Type: "attached", ID: msg.ID, Daemon: daemon})
+			continue
+		}
+		engine.handleMessage(&msg, source, send)
+	}
+}
+
+// Run "fhosts-proxy ctl <command> [args]" against the running instance
+func RunCtl(args []string) error {
+	if len(args) == 0 {
+		return fmt.Errorf("usage: ctl add host=target... | rm host... | status | audit [count]")
+	}
+
+	var msg Message
+	switch args[0] {
+	case "add":
+		msg.Action = "addMappings"
+		msg.Mappings = make(map[string]string)
+		for _, arg := range args[1:] {
+			host, target, ok := strings.Cut(arg, "=")
+			if !ok || host == "" || target == "" {
+				return fmt.Errorf("invalid mapping %q, want host=target", arg)
+			}
+			msg.Mappings[host] = target
+		}
+		if len(msg.Mappings) == 0 {
+			return fmt.Errorf("usage: ctl add host=target...")
+		}
+	case "rm":
+		if len(args) < 2 {
+			return fmt.Errorf("usage: ctl rm host...")
+		}
+		msg.Action = "removeMappings"
+		msg.Hosts = args[1:]
+	case "status":
+		msg.Action = "status"
+	case "audit":
+		msg.Action = "getAuditLog"
+		if len(args) > 1 {
+			n, err := strconv.Atoi(args[1])
+			if err != nil || n < 0 {
+				return fmt.Errorf("usage: ctl audit [count]")
+			}
+			msg.Count = n
+		}
+	default:
+		return fmt.Errorf("unknown ctl command %q", args[0])
+	}
+
+	conn, err := dialControl(5 * time.Second)
+	if err != nil {
+		return fmt.Errorf("no running fhosts-proxy: %v", err)
+	}
+	defer conn.Close()
+
+	if err := json.NewEncoder(conn).Encode(msg); err != nil {
+		return err
+	}
+	var resp Message
+	if err := json.NewDecoder(conn).Decode(&resp); err != nil {
+		return err
+	}
+	if resp.Type == "error" {
+		return fmt.Errorf("%s", resp.Message)
+	}
+
+	out, _ := json.MarshalIndent(resp, "", "  ")
+	fmt.Println(string(out))
+	return nil
+}
@@ -0,0 +1,52 @@
+//go:build !windows
+
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+// The control socket lives in $XDG_RUNTIME_DIR when that is set, or else
+// the config directory; both are private to the user, which keeps other
+// users off the socket.
+const (
+	controlSocket = "control.sock"
+	runtimeSocket = "fhosts.sock" // Name in $XDG_RUNTIME_DIR
+)
+
+func controlSocketPath() (string, error) {
+	// Relative paths are invalid per the XDG spec and must be ignored
+	if dir := os.Getenv("XDG_RUNTIME_DIR"); filepath.IsAbs(dir) {
+		return filepath.Join(dir, runtimeSocket), nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	return filepath.Join(dir, controlSocket), nil
+}
+
+func listenControl() (net.Listener, error) {
+	path, err := controlSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	if conn, err := net.DialTimeout("unix", path, time.Second); err == nil {
+		conn.Close()
+		return nil, fmt.Errorf("control socket %s is in use by another instance", path)
+	}
+	os.Remove(path) // Stale socket from a crashed instance
+	return net.Listen("unix", path)
+}
+
+func dialControl(timeout time.Duration) (net.Conn, error) {
+	path, err := controlSocketPath()
+	if err != nil {
+		return nil, err
+	}
+	return net.DialTimeout("unix", path, timeout)
+}
@@ -0,0 +1,53 @@
+//go:build windows
+
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"time"
+
+	"github.com/Microsoft/go-winio"
+	"golang.org/x/sys/windows"
+)
+
+// On Windows the control channel is a named pipe per user, which only that
+// user and SYSTEM, for the service, may open
+const controlPipePrefix = `\\.\pipe\fhosts-`
+
+// SID of the user the control pipe belongs to: the current user, or the
+// one a service was installed for
+func controlUser() (string, error) {
+	if options.ServiceUser != "" {
+		return options.ServiceUser, nil
+	}
+	user, err := windows.GetCurrentProcessToken().GetTokenUser()
+	if err != nil {
+		return "", err
+	}
+	return user.User.Sid.String(), nil
+}
+
+func listenControl() (net.Listener, error) {
+	sid, err := controlUser()
+	if err != nil {
+		return nil, err
+	}
+	pipe := controlPipePrefix + sid
+	l, err := winio.ListenPipe(pipe, &winio.PipeConfig{
+		SecurityDescriptor: "D:P(A;;GA;;;SY)(A;;GA;;;" + sid + ")",
+	})
+	if errors.Is(err, windows.ERROR_ACCESS_DENIED) || errors.Is(err, windows.ERROR_PIPE_BUSY) {
+		return nil, fmt.Errorf("control pipe %s is in use by another instance", pipe)
+	}
+	return l, err
+}
+
+func dialControl(timeout time.Duration) (net.Conn, error) {
+	sid, err := controlUser()
+	if err != nil {
+		return nil, err
+	}
+	return winio.DialPipe(controlPipePrefix+sid, &timeout)
+}
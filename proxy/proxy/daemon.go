@@ -0,0 +1,158 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"os/signal"
+	"path/filepath"
+	"strconv"
+	"syscall"
+	"time"
+
+	"fhosts-proxy/nativemsg"
+)
+
+// Daemon mode: a start message with daemon set hands the proxy to a
+// detached "fhosts-proxy -daemon" process, and the native messaging host
+// becomes a relay between the extension and the daemon's control channel.
+// Later hosts find the daemon and re-attach, so browser restarts don't
+// drop the proxy or its open tunnels.
+var daemon bool
+
+const pidFile = "fhosts.pid"
+
+// Run as the detached daemon until stopped or signalled
+func RunDaemon() error {
+	if err := startDaemon(); err != nil {
+		return err
+	}
+	if options.AutoStart || len(activated.proxy) > 0 {
+		// Launched by systemd or launchd rather than by a native host
+		if err := engine.Start(context.Background(), Message{}); err != nil {
+			logWarn("Failed to start proxy: %v", err)
+		}
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	engine.Stop()
+	exit(0)
+	return nil
+}
+
+// Restore the saved mappings and take over the control channel
+func startDaemon() error {
+	daemon = true
+	setOutput(broadcast)
+	engine.restoreState()
+	if err := startControl(); err != nil {
+		return err // Another daemon is already running
+	}
+	if err := writePIDFile(); err != nil {
+		stopControl()
+		return err
+	}
+	return nil
+}
+
+func writePIDFile() error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(filepath.Join(dir, pidFile), []byte(strconv.Itoa(os.Getpid())+"\n"))
+}
+
+func removePIDFile() {
+	if !daemon {
+		return
+	}
+	if dir, err := configDir(); err == nil {
+		os.Remove(filepath.Join(dir, pidFile))
+	}
+}
+
+// Launch the daemon and wait for its control channel. It gets the host's
+// config directory, and inherits FHOSTS_CONFIG with the environment, so
+// both use the same state and control socket.
+func spawnDaemon() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	cmd := exec.Command(exe, daemonArgs()...)
+	cmd.SysProcAttr = detachedProcAttr()
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	cmd.Process.Release()
+
+	for deadline := time.Now().Add(5 * time.Second); time.Now().Before(deadline); time.Sleep(50 * time.Millisecond) {
+		if conn, err := dialControl(time.Second); err == nil {
+			conn.Close()
+			return nil
+		}
+	}
+	return fmt.Errorf("daemon did not start")
+}
+
+// Command line for the daemon process
+func daemonArgs() []string {
+	args := []string{"-daemon"}
+	if options.ConfigDir != "" {
+		args = append(args, "-config-dir", options.ConfigDir)
+	}
+	return args
+}
+
+// A native messaging host's connection to the daemon
+type relay struct {
+	conn net.Conn
+	enc  *json.Encoder
+}
+
+// Attach to a running daemon, or return nil if there is none. Replies and
+// events from the daemon are passed straight to the extension.
+func attachDaemon() *relay {
+	conn, err := dialControl(time.Second)
+	if err != nil {
+		return nil
+	}
+	enc := json.NewEncoder(conn)
+	scanner := bufio.NewScanner(conn)
+	scanner.Buffer(make([]byte, 64*1024), nativemsg.MaxMessageSize)
+
+	var resp Message
+	if enc.Encode(Message{Action: "attach"}) != nil || !scanner.Scan() ||
+		json.Unmarshal(scanner.Bytes(), &resp) != nil || !resp.Daemon {
+		conn.Close() // Not a daemon, just another browser's host
+		return nil
+	}
+
+	go func() {
+		stopped := false
+		for scanner.Scan() {
+			var msg Message
+			if json.Unmarshal(scanner.Bytes(), &msg) == nil {
+				sendMessage(msg)
+				stopped = msg.Type == "stopped"
+			}
+		}
+		// Daemon went away
+		if !stopped {
+			sendMessage(Message{Type: "stopped"})
+		}
+		exit(0)
+	}()
+	return &relay{conn: conn, enc: enc}
+}
+
+func (r *relay) forward(msg *Message) {
+	r.enc.Encode(msg)
+}
@@ -0,0 +1,20 @@
+package proxy
+
+import (
+	"reflect"
+	"testing"
+)
+
+func TestDaemonArgsKeepConfigDir(t *testing.T) {
+	saved := options
+	t.Cleanup(func() { options = saved })
+
+	options = Options{}
+	if got, want := daemonArgs(), []string{"-daemon"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("daemon args %q, want %q", got, want)
+	}
+	options = Options{ConfigDir: "/tmp/fhosts-test"}
+	if got, want := daemonArgs(), []string{"-daemon", "-config-dir", "/tmp/fhosts-test"}; !reflect.DeepEqual(got, want) {
+		t.Errorf("daemon args %q, want %q", got, want)
+	}
+}
@@ -0,0 +1,10 @@
+//go:build !windows
+
+package proxy
+
+import "syscall"
+
+// Run the daemon in its own session so it outlives the browser
+func detachedProcAttr() *syscall.SysProcAttr {
+	return &syscall.SysProcAttr{Setsid: true}
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	_ "embed"
+	"net/http"
+	"sync"
+	"sync/atomic"
+)
+
+// Web dashboard served from the admin port at /. The page itself is
+// public; it reads the admin token from its URL fragment (#token=...) and
+// calls the admin API with it.
+//
+//go:embed dashboard.html
+var dashboardHTML []byte
+
+// Requests kept for the dashboard's recent list
+const maxRecentRequests = 200
+
+var (
+	keepRecent     atomic.Bool // Set while the admin API runs
+	recentRequests []AccessLogEntry
+	recentMu       sync.Mutex
+)
+
+// Remember a finished request for the dashboard
+func recordRecent(entry AccessLogEntry) {
+	if !keepRecent.Load() {
+		return
+	}
+	recentMu.Lock()
+	defer recentMu.Unlock()
+	if len(recentRequests) >= maxRecentRequests {
+		recentRequests = recentRequests[1:]
+	}
+	recentRequests = append(recentRequests, entry)
+}
+
+func handleDashboard(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Header().Set("Cache-Control", "no-cache")
+	w.Header().Set("Content-Security-Policy", "default-src 'self'; script-src 'unsafe-inline'; style-src 'unsafe-inline'")
+	w.Write(dashboardHTML)
+}
+
+// GET /requests: recently finished requests, oldest first
+func adminRequests(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodGet {
+		methodNotAllowed(w)
+		return
+	}
+	recentMu.Lock()
+	entries := append([]AccessLogEntry{}, recentRequests...)
+	recentMu.Unlock()
+	writeAdminJSON(w, http.StatusOK, entries)
+}
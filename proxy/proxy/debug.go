@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"expvar"
+	"fmt"
+	"net"
+	"net/http"
+
+	_ "net/http/pprof" // Registers /debug/pprof/ on http.DefaultServeMux
+
+	"fhosts-proxy/mapping"
+)
+
+// Serve pprof and expvar (/debug/vars) on addr for investigating leaks in
+// long-lived host processes. Only loopback addresses are accepted since the
+// profiles expose memory contents.
+func startDebugServer(addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	if ip := net.ParseIP(mapping.Unbracket(host)); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+		return fmt.Errorf("debug address %s is not a loopback address", addr)
+	}
+	l, err := net.Listen("tcp", addr)
+	if err != nil {
+		return err
+	}
+
+	expvar.Publish("activeTunnels", expvar.Func(func() any { return activeTunnels.Load() }))
+	expvar.Publish("totalRequests", expvar.Func(func() any { return totalRequests.Load() }))
+	expvar.Publish("mappings", expvar.Func(func() any {
+		count, revision := engine.mappingsState()
+		return map[string]int64{"count": int64(count), "revision": revision}
+	}))
+
+	logInfo("Debug server listening on %s", l.Addr())
+	go http.Serve(l, http.DefaultServeMux)
+	return nil
+}
@@ -0,0 +1,371 @@
+package proxy
+
+import (
+	"context"
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"math/rand"
+	"net"
+	"net/http/httptrace"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/dns/dnsmessage"
+
+	"fhosts-proxy/mapping"
+)
+
+// Resolutions of mapping targets that are hostnames are cached so
+// forwarded requests don't each hit DNS. Answers from a mapping's own DNS
+// server keep their TTL; the system resolver doesn't report one, so its
+// answers get systemDNSTTL.
+const (
+	systemDNSTTL     = 30 * time.Second
+	maxDNSTTL        = time.Hour
+	maxDNSCacheHosts = 10000
+)
+
+type dnsCacheKey struct {
+	server string // "" for the system resolver
+	host   string
+}
+
+type dnsCacheEntry struct {
+	ips     []net.IP
+	expires time.Time
+}
+
+var (
+	dnsCache   = make(map[dnsCacheKey]dnsCacheEntry)
+	dnsCacheMu sync.Mutex
+	dnsHits    atomic.Int64
+	dnsMisses  atomic.Int64
+)
+
+// DNS cache counters, reported in the status
+type DNSCacheStats struct {
+	Entries int   `json:"entries"`
+	Hits    int64 `json:"hits"`
+	Misses  int64 `json:"misses"`
+}
+
+func dnsCacheStats() *DNSCacheStats {
+	dnsCacheMu.Lock()
+	defer dnsCacheMu.Unlock()
+	return &DNSCacheStats{Entries: len(dnsCache), Hits: dnsHits.Load(), Misses: dnsMisses.Load()}
+}
+
+// Drop every cached resolution. Returns how many there were.
+func flushDNSCache() int {
+	dnsCacheMu.Lock()
+	defer dnsCacheMu.Unlock()
+	n := len(dnsCache)
+	dnsCache = make(map[dnsCacheKey]dnsCacheEntry)
+	return n
+}
+
+// Dial a mapping target's addr, resolving a hostname through the cache
+// (and dnsServer, if given). Hosts that aren't mapped are dialed by the
+// dialer itself, which resolves them fresh every time.
+func dialContext(ctx context.Context, network, addr, dnsServer string) (net.Conn, error) {
+	host, port, err := net.SplitHostPort(addr)
+	if err != nil || network == "unix" || net.ParseIP(host) != nil {
+		return shared().dialer.DialContext(ctx, network, addr)
+	}
+	ips, err := resolveCached(ctx, host, dnsServer)
+	if err != nil {
+		return nil, &net.OpError{Op: "dial", Net: network, Err: err}
+	}
+	return dialResolved(ctx, network, ips, port)
+}
+
+// Wait before racing the other address family against the first, as
+// net.Dialer does
+const fallbackDelay = 300 * time.Millisecond
+
+// Dial port on one of ips with dual-stack fallback: the IPv4 addresses
+// are tried in turn, IPv4 first since broken IPv6 routes are the common
+// failure on dev machines, and the IPv6 ones race them once fallbackDelay
+// passes or they fail. All attempts share one dial timeout.
+func dialResolved(ctx context.Context, network string, ips []net.IP, port string) (net.Conn, error) {
+	d := shared().dialer
+	if d.Timeout > 0 {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, d.Timeout)
+		defer cancel()
+	}
+	var primary, fallback []net.IP
+	for _, ip := range ips {
+		if ip.To4() != nil {
+			primary = append(primary, ip)
+		} else {
+			fallback = append(fallback, ip)
+		}
+	}
+	if len(primary) == 0 || len(fallback) == 0 {
+		return dialSerial(ctx, d, network, ips, port)
+	}
+
+	type attempt struct {
+		conn    net.Conn
+		err     error
+		primary bool
+	}
+	results := make(chan attempt, 2)
+	ctx, cancel := context.WithCancel(ctx)
+	defer cancel()
+	start := func(ips []net.IP, isPrimary bool) {
+		go func() {
+			conn, err := dialSerial(ctx, d, network, ips, port)
+			results <- attempt{conn, err, isPrimary}
+		}()
+	}
+	start(primary, true)
+	timer := time.NewTimer(fallbackDelay)
+	defer timer.Stop()
+
+	var firstErr error
+	pending, fellBack := 1, false
+	for {
+		select {
+		case <-timer.C:
+			if !fellBack {
+				start(fallback, false)
+				pending, fellBack = pending+1, true
+			}
+		case res := <-results:
+			pending--
+			if res.err == nil {
+				if pending > 0 {
+					// Close the loser should it connect before it sees cancel
+					go func() {
+						if res := <-results; res.conn != nil {
+							res.conn.Close()
+						}
+					}()
+				}
+				return res.conn, nil
+			}
+			if firstErr == nil || res.primary {
+				firstErr = res.err
+			}
+			if !fellBack {
+				start(fallback, false)
+				pending, fellBack = pending+1, true
+			} else if pending == 0 {
+				return nil, firstErr
+			}
+		}
+	}
+}
+
+// Shortest share of the remaining timeout one address gets
+const minDialShare = 2 * time.Second
+
+// Dial ips in order, giving each an equal share of the time left so one
+// unreachable address can't use up the whole timeout
+func dialSerial(ctx context.Context, d *net.Dialer, network string, ips []net.IP, port string) (net.Conn, error) {
+	var firstErr error
+	for i, ip := range ips {
+		attemptCtx, cancel := ctx, context.CancelFunc(func() {})
+		if deadline, ok := ctx.Deadline(); ok && i < len(ips)-1 {
+			share := max(time.Until(deadline)/time.Duration(len(ips)-i), minDialShare)
+			attemptCtx, cancel = context.WithTimeout(ctx, share)
+		}
+		conn, err := d.DialContext(attemptCtx, network, net.JoinHostPort(ip.String(), port))
+		cancel()
+		if err == nil {
+			return conn, nil
+		}
+		if firstErr == nil {
+			firstErr = err
+		}
+		if ctx.Err() != nil {
+			break
+		}
+	}
+	return nil, firstErr
+}
+
+// Look a hostname up in the cache, resolving it on a miss
+func resolveCached(ctx context.Context, host, dnsServer string) ([]net.IP, error) {
+	key := dnsCacheKey{server: dnsServer, host: mapping.NormalizeHost(host)}
+	dnsCacheMu.Lock()
+	entry, ok := dnsCache[key]
+	dnsCacheMu.Unlock()
+	if ok && time.Now().Before(entry.expires) {
+		dnsHits.Add(1)
+		return entry.ips, nil
+	}
+	dnsMisses.Add(1)
+
+	trace := httptrace.ContextClientTrace(ctx)
+	if trace != nil && trace.DNSStart != nil && dnsServer != "" {
+		trace.DNSStart(httptrace.DNSStartInfo{Host: host})
+	}
+	var ips []net.IP
+	var ttl time.Duration
+	var err error
+	if dnsServer == "" {
+		ips, err = lookupSystem(ctx, host) // The net package reports its own trace events
+		ttl = systemDNSTTL
+	} else {
+		ips, ttl, err = lookupServer(ctx, dnsServer, host)
+		if trace != nil && trace.DNSDone != nil {
+			trace.DNSDone(httptrace.DNSDoneInfo{Err: err})
+		}
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	if ttl > 0 {
+		dnsCacheMu.Lock()
+		if len(dnsCache) >= maxDNSCacheHosts {
+			dnsCache = make(map[dnsCacheKey]dnsCacheEntry)
+		}
+		dnsCache[key] = dnsCacheEntry{ips: ips, expires: time.Now().Add(min(ttl, maxDNSTTL))}
+		dnsCacheMu.Unlock()
+	}
+	return ips, nil
+}
+
+func lookupSystem(ctx context.Context, host string) ([]net.IP, error) {
+	addrs, err := net.DefaultResolver.LookupIPAddr(ctx, host)
+	if err != nil {
+		return nil, err
+	}
+	ips := make([]net.IP, len(addrs))
+	for i, addr := range addrs {
+		ips[i] = addr.IP
+	}
+	return ips, nil
+}
+
+// Resolve host's A and AAAA records with one DNS server, returning the
+// lowest TTL of the answers
+func lookupServer(ctx context.Context, server, host string) ([]net.IP, time.Duration, error) {
+	name, err := dnsmessage.NewName(strings.TrimSuffix(host, ".") + ".")
+	if err != nil {
+		return nil, 0, err
+	}
+	if _, ok := ctx.Deadline(); !ok {
+		var cancel context.CancelFunc
+		ctx, cancel = context.WithTimeout(ctx, millis(shared().timeouts.Dial))
+		defer cancel()
+	}
+
+	var ips []net.IP
+	ttl := maxDNSTTL
+	var lastErr error
+	for _, qtype := range []dnsmessage.Type{dnsmessage.TypeA, dnsmessage.TypeAAAA} {
+		answers, answerTTL, err := queryDNS(ctx, server, name, qtype)
+		if err != nil {
+			lastErr = err
+			continue
+		}
+		ips = append(ips, answers...)
+		if len(answers) > 0 {
+			ttl = min(ttl, answerTTL)
+		}
+	}
+	if len(ips) == 0 {
+		if lastErr == nil {
+			lastErr = fmt.Errorf("no addresses for %s from %s", host, server)
+		}
+		return nil, 0, &net.DNSError{Err: lastErr.Error(), Name: host, Server: server}
+	}
+	return ips, ttl, nil
+}
+
+var errTruncated = errors.New("truncated DNS response")
+
+// Send one query over UDP, retrying over TCP when the answer is truncated
+func queryDNS(ctx context.Context, server string, name dnsmessage.Name, qtype dnsmessage.Type) ([]net.IP, time.Duration, error) {
+	id := uint16(rand.Uint32())
+	query, err := (&dnsmessage.Message{
+		Header:    dnsmessage.Header{ID: id, RecursionDesired: true},
+		Questions: []dnsmessage.Question{{Name: name, Type: qtype, Class: dnsmessage.ClassINET}},
+	}).Pack()
+	if err != nil {
+		return nil, 0, err
+	}
+
+	ips, ttl, err := exchangeDNS(ctx, "udp", server, id, query)
+	if err == errTruncated {
+		ips, ttl, err = exchangeDNS(ctx, "tcp", server, id, query)
+	}
+	return ips, ttl, err
+}
+
+func exchangeDNS(ctx context.Context, network, server string, id uint16, query []byte) ([]net.IP, time.Duration, error) {
+	var d net.Dialer
+	conn, err := d.DialContext(ctx, network, server)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer conn.Close()
+	if deadline, ok := ctx.Deadline(); ok {
+		conn.SetDeadline(deadline)
+	}
+
+	var resp []byte
+	if network == "tcp" {
+		// Messages over TCP carry a two-byte length prefix
+		framed := binary.BigEndian.AppendUint16(nil, uint16(len(query)))
+		if _, err := conn.Write(append(framed, query...)); err != nil {
+			return nil, 0, err
+		}
+		var length [2]byte
+		if _, err := io.ReadFull(conn, length[:]); err != nil {
+			return nil, 0, err
+		}
+		resp = make([]byte, binary.BigEndian.Uint16(length[:]))
+		if _, err := io.ReadFull(conn, resp); err != nil {
+			return nil, 0, err
+		}
+	} else {
+		if _, err := conn.Write(query); err != nil {
+			return nil, 0, err
+		}
+		resp = make([]byte, 1232)
+		n, err := conn.Read(resp)
+		if err != nil {
+			return nil, 0, err
+		}
+		resp = resp[:n]
+	}
+
+	var msg dnsmessage.Message
+	if err := msg.Unpack(resp); err != nil {
+		return nil, 0, err
+	}
+	if msg.ID != id {
+		return nil, 0, errors.New("mismatched DNS response ID")
+	}
+	if msg.Truncated {
+		return nil, 0, errTruncated
+	}
+	if msg.RCode != dnsmessage.RCodeSuccess {
+		return nil, 0, fmt.Errorf("DNS server returned %v", msg.RCode)
+	}
+
+	var ips []net.IP
+	ttl := maxDNSTTL
+	for _, answer := range msg.Answers {
+		switch body := answer.Body.(type) {
+		case *dnsmessage.AResource:
+			ips = append(ips, net.IP(body.A[:]))
+		case *dnsmessage.AAAAResource:
+			ips = append(ips, net.IP(body.AAAA[:]))
+		default:
+			continue // CNAMEs are followed by the server
+		}
+		ttl = min(ttl, time.Duration(answer.Header.TTL)*time.Second)
+	}
+	return ips, ttl, nil
+}
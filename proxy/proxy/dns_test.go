@@ -0,0 +1,96 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+	"testing"
+	"time"
+)
+
+// Listen on loopback for the given network, skipping the test when the
+// machine has no such address
+func listenLoopback(t *testing.T, network string) net.Listener {
+	t.Helper()
+	addr := "127.0.0.1:0"
+	if network == "tcp6" {
+		addr = "[::1]:0"
+	}
+	ln, err := net.Listen(network, addr)
+	if err != nil {
+		t.Skipf("no %s loopback: %v", network, err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+	return ln
+}
+
+// A port on 127.0.0.1 with nothing listening
+func closedPort(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp4", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	port := ln.Addr().(*net.TCPAddr).Port
+	ln.Close()
+	return strconv.Itoa(port)
+}
+
+func TestDialResolvedFallsBackToIPv6(t *testing.T) {
+	ln := listenLoopback(t, "tcp6")
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+	// Nothing listens on the IPv4 side of the port, so the IPv6 attempt
+	// must start as soon as it's refused rather than after fallbackDelay
+	if l4, err := net.Listen("tcp4", "127.0.0.1:"+port); err == nil {
+		l4.Close()
+	} else {
+		t.Skipf("IPv4 side of port %s in use", port)
+	}
+
+	start := time.Now()
+	conn, err := dialResolved(context.Background(), "tcp", []net.IP{net.ParseIP("127.0.0.1"), net.ParseIP("::1")}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(net.IPv6loopback) {
+		t.Errorf("connected to %s, want ::1", got)
+	}
+	if elapsed := time.Since(start); elapsed >= fallbackDelay {
+		t.Errorf("fallback took %s, want under %s", elapsed, fallbackDelay)
+	}
+}
+
+func TestDialResolvedPrefersIPv4(t *testing.T) {
+	ln := listenLoopback(t, "tcp4")
+	port := strconv.Itoa(ln.Addr().(*net.TCPAddr).Port)
+
+	conn, err := dialResolved(context.Background(), "tcp", []net.IP{net.ParseIP("::1"), net.ParseIP("127.0.0.1")}, port)
+	if err != nil {
+		t.Fatal(err)
+	}
+	conn.Close()
+	if got := conn.RemoteAddr().(*net.TCPAddr).IP; !got.Equal(net.ParseIP("127.0.0.1")) {
+		t.Errorf("connected to %s, want 127.0.0.1", got)
+	}
+}
+
+func TestDialResolvedClosedPort(t *testing.T) {
+	port := closedPort(t)
+	_, err := dialResolved(context.Background(), "tcp", []net.IP{net.ParseIP("127.0.0.1")}, port)
+	if err == nil {
+		t.Fatal("dial of a closed port succeeded")
+	}
+	if opErr, ok := err.(*net.OpError); !ok || opErr.Op != "dial" {
+		t.Errorf("got %v, want a dial error", err)
+	}
+}
@@ -0,0 +1,177 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"net/url"
+	"os"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mapping targets naming a Docker container ("docker://my-api:8080") are
+// resolved through the Docker Engine API to the container's published port
+// on the host, or its bridge network address when the port isn't
+// published. Resolutions are cached briefly and dropped when a dial fails,
+// so a restarted container's new address is picked up.
+const (
+	dockerScheme   = "docker://"
+	dockerCacheTTL = 5 * time.Second
+
+	// Used unless DOCKER_HOST is set. Docker Desktop on Windows only
+	// listens on a named pipe, so there DOCKER_HOST must name its TCP
+	// endpoint (tcp://localhost:2375).
+	defaultDockerHost = "unix:///var/run/docker.sock"
+)
+
+type dockerCacheEntry struct {
+	addr    string
+	err     error
+	expires time.Time
+}
+
+var (
+	dockerCache   = make(map[string]dockerCacheEntry) // "container:port" -> address
+	dockerCacheMu sync.Mutex
+
+	dockerClient     *http.Client
+	dockerClientOnce sync.Once
+	dockerBaseURL    string
+)
+
+// Client for the Docker Engine API at DOCKER_HOST (unix:// or tcp://), or
+// the local socket
+func dockerAPI() (*http.Client, string) {
+	dockerClientOnce.Do(func() {
+		host := os.Getenv("DOCKER_HOST")
+		if host == "" {
+			host = defaultDockerHost
+		}
+		transport := &http.Transport{Proxy: nil}
+		dockerBaseURL = "http://docker"
+		switch {
+		case strings.HasPrefix(host, "unix://"):
+			path := strings.TrimPrefix(host, "unix://")
+			transport.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+				return shared().dialer.DialContext(ctx, "unix", path)
+			}
+		default:
+			dockerBaseURL = "http://" + strings.TrimPrefix(host, "tcp://")
+		}
+		dockerClient = &http.Client{Transport: transport, Timeout: 5 * time.Second}
+	})
+	return dockerClient, dockerBaseURL
+}
+
+// Address to dial for a docker:// or k8s:// target
+func resolveDynamic(target, port string) string {
+	if ref, ok := strings.CutPrefix(target, k8sScheme); ok {
+		return k8sAddr(ref, port)
+	}
+	return dockerAddr(strings.TrimPrefix(target, dockerScheme), port)
+}
+
+// Address to dial for a docker:// target. Without a port in the target the
+// requested port is used. On failure the container name is returned, which
+// fails to dial with a lookup error.
+func dockerAddr(ref, port string) string {
+	name, containerPort, err := net.SplitHostPort(ref)
+	if err != nil {
+		name, containerPort = ref, port
+	}
+	key := name + ":" + containerPort
+
+	dockerCacheMu.Lock()
+	entry, ok := dockerCache[key]
+	dockerCacheMu.Unlock()
+	if !ok || time.Now().After(entry.expires) {
+		entry.addr, entry.err = inspectContainer(name, containerPort)
+		entry.expires = time.Now().Add(dockerCacheTTL)
+		dockerCacheMu.Lock()
+		dockerCache[key] = entry
+		dockerCacheMu.Unlock()
+		if entry.err != nil {
+			logWarn("Failed to resolve Docker container %s: %v", name, entry.err)
+		}
+	}
+	if entry.err != nil {
+		return net.JoinHostPort(name, containerPort)
+	}
+	return entry.addr
+}
+
+// Forget the resolution of a docker:// target after its dial failed
+func forgetDockerAddr(ref, port string) {
+	name, containerPort, err := net.SplitHostPort(ref)
+	if err != nil {
+		name, containerPort = ref, port
+	}
+	dockerCacheMu.Lock()
+	delete(dockerCache, name+":"+containerPort)
+	dockerCacheMu.Unlock()
+}
+
+// The parts of GET /containers/{name}/json used here
+type dockerContainer struct {
+	State struct {
+		Running bool `json:"Running"`
+	} `json:"State"`
+	NetworkSettings struct {
+		Ports    map[string][]dockerPortBinding `json:"Ports"`
+		Networks map[string]struct {
+			IPAddress string `json:"IPAddress"`
+		} `json:"Networks"`
+	} `json:"NetworkSettings"`
+}
+
+type dockerPortBinding struct {
+	HostIP   string `json:"HostIp"`
+	HostPort string `json:"HostPort"`
+}
+
+// Look up where a container's port can be reached from the host
+func inspectContainer(name, port string) (string, error) {
+	client, base := dockerAPI()
+	resp, err := client.Get(base + "/containers/" + url.PathEscape(name) + "/json")
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	if resp.StatusCode == http.StatusNotFound {
+		return "", fmt.Errorf("no such container")
+	}
+	if resp.StatusCode != http.StatusOK {
+		return "", fmt.Errorf("Docker API returned %s", resp.Status)
+	}
+	var container dockerContainer
+	if err := json.NewDecoder(resp.Body).Decode(&container); err != nil {
+		return "", err
+	}
+	if !container.State.Running {
+		return "", fmt.Errorf("container is not running")
+	}
+
+	for _, binding := range container.NetworkSettings.Ports[port+"/tcp"] {
+		if binding.HostPort == "" {
+			continue
+		}
+		switch binding.HostIP {
+		case "", "0.0.0.0":
+			return net.JoinHostPort("127.0.0.1", binding.HostPort), nil
+		case "::":
+			return net.JoinHostPort("::1", binding.HostPort), nil
+		default:
+			return net.JoinHostPort(binding.HostIP, binding.HostPort), nil
+		}
+	}
+	for _, network := range container.NetworkSettings.Networks {
+		if network.IPAddress != "" {
+			return net.JoinHostPort(network.IPAddress, port), nil
+		}
+	}
+	return "", fmt.Errorf("port %s is not published and the container has no network address", port)
+}
@@ -0,0 +1,58 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+)
+
+// Environment overrides for wrapper scripts that launch the host. They
+// have the lowest precedence: config.json overrides them, and the
+// extension's messages override both.
+//
+//	FHOSTS_PORT      default listen port
+//	FHOSTS_LOG_FILE  also append log lines to this file
+//	FHOSTS_CONFIG    config file to read instead of config.json in the
+//	                 config directory
+//	FHOSTS_KUBECTL   kubectl binary for k8s:// targets
+//
+// The standard OTEL_EXPORTER_OTLP_TRACES_ENDPOINT and
+// OTEL_EXPORTER_OTLP_ENDPOINT variables set the span collector.
+func applyEnv() {
+	if v := os.Getenv("FHOSTS_PORT"); v != "" {
+		if port, err := strconv.Atoi(v); err == nil && port >= 0 && port <= 65535 {
+			fileConfig.Port = &port
+		} else {
+			logWarn("Ignoring FHOSTS_PORT=%q: not a port number", v)
+		}
+	}
+	if path := os.Getenv("FHOSTS_LOG_FILE"); path != "" {
+		if err := openLogFile(path); err != nil {
+			logWarn("Failed to open FHOSTS_LOG_FILE: %v", err)
+		}
+	}
+	if url := os.Getenv("OTEL_EXPORTER_OTLP_TRACES_ENDPOINT"); url != "" {
+		fileConfig.OTLPEndpoint = url
+	} else if url := os.Getenv("OTEL_EXPORTER_OTLP_ENDPOINT"); url != "" {
+		fileConfig.OTLPEndpoint = strings.TrimSuffix(url, "/") + "/v1/traces"
+	}
+}
+
+// Path of the config file, honoring FHOSTS_CONFIG
+func configFilePath() (string, error) {
+	if path := os.Getenv("FHOSTS_CONFIG"); path != "" {
+		return path, nil
+	}
+	dir, err := configDir()
+	if err != nil {
+		return "", err
+	}
+	for _, name := range configFiles {
+		path := filepath.Join(dir, name)
+		if _, err := os.Stat(path); err == nil {
+			return path, nil
+		}
+	}
+	return filepath.Join(dir, configFiles[0]), nil
+}
@@ -0,0 +1,90 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"syscall"
+)
+
+// Error codes sent with error messages so the extension can react to
+// failures without parsing the human-readable text
+const (
+	ErrCodeBadMessage     = "BAD_MESSAGE"      // Frame or JSON could not be decoded
+	ErrCodeFrameTooLarge  = "FRAME_TOO_LARGE"  // Frame length over the 1MB limit
+	ErrCodeUnknownAction  = "UNKNOWN_ACTION"   // Action not supported by this host
+	ErrCodePortInUse      = "PORT_IN_USE"      // Listen port already taken
+	ErrCodeInvalidPort    = "INVALID_PORT"     // Requested port out of range
+	ErrCodeListenFailed   = "LISTEN_FAILED"    // Listener could not be created for another reason
+	ErrCodeStartFailed    = "START_FAILED"     // Daemon process could not be launched
+	ErrCodeInvalidMapping = "INVALID_MAPPING"  // Mapping set rejected (e.g. bad regex)
+	ErrCodeDialFailed     = "DIAL_FAILED"      // Could not connect to a target
+	ErrCodeUpstreamError  = "UPSTREAM_ERROR"   // Target connected but the exchange failed
+	ErrCodeCAError        = "CA_ERROR"         // Local CA could not be loaded or generated
+	ErrCodeProfileError   = "PROFILE_ERROR"    // Profile missing or profile store unreadable
+	ErrCodeServerError    = "SERVER_ERROR"     // Proxy listener stopped unexpectedly
+	ErrCodeFileError      = "FILE_ERROR"       // Requested output file could not be written
+	ErrCodeNotFound       = "NOT_FOUND"        // Named connection (or other item) does not exist
+	ErrCodePortNotAllowed = "PORT_NOT_ALLOWED" // CONNECT or SOCKS connection to a port outside connectPorts
+	ErrCodePrivateTarget  = "PRIVATE_TARGET"   // Unmapped host on a private address while blockPrivate is on
+	ErrCodeBindRefused    = "BIND_REFUSED"     // bindAddress invalid, or beyond loopback without allowRemote and proxyAuth
+)
+
+var errInvalidPort = errors.New("port must be between 0 and 65535")
+
+// Send an asynchronous error event to the extension and run the error
+// hooks of the proxy with settings, if any
+func sendError(settings *proxySettings, code, format string, args ...interface{}) {
+	msg := Message{Type: "error", ErrorCode: code, Message: fmt.Sprintf(format, args...)}
+	sendMessage(msg)
+	if settings != nil {
+		settings.hooks.run(msg, "")
+	}
+}
+
+// Classify a listen error
+func listenErrorCode(err error) string {
+	var errno syscall.Errno
+	// 10048 is WSAEADDRINUSE on Windows
+	if errors.As(err, &errno) && (errno == syscall.EADDRINUSE || errno == 10048) {
+		return ErrCodePortInUse
+	}
+	return ErrCodeListenFailed
+}
+
+// Classify an error from forwarding a request to a target
+func forwardErrorCode(err error) string {
+	if errors.Is(err, errPrivateTarget) {
+		return ErrCodePrivateTarget
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "dial" {
+		return ErrCodeDialFailed
+	}
+	return ErrCodeUpstreamError
+}
+
+// HTTP status to answer a failed forward with
+func forwardErrorStatus(err error) int {
+	if errors.Is(err, errPrivateTarget) {
+		return http.StatusForbidden
+	}
+	return http.StatusBadGateway
+}
+
+// Classify an error from starting the proxy: bad port, listener failures or
+// rejected mappings
+func startErrorCode(err error) string {
+	if errors.Is(err, errInvalidPort) {
+		return ErrCodeInvalidPort
+	}
+	if errors.Is(err, errBindRefused) {
+		return ErrCodeBindRefused
+	}
+	var opErr *net.OpError
+	if errors.As(err, &opErr) && opErr.Op == "listen" {
+		return listenErrorCode(err)
+	}
+	return ErrCodeInvalidMapping
+}
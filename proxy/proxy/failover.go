@@ -0,0 +1,35 @@
+package proxy
+
+import "net/http"
+
+// Send a forwarded request along rt, failing over to the route's next
+// targets while the dial fails. Requests with a body are sent only once,
+// since the first attempt consumes it. origHost is the request's own host,
+// kept in the URL of Unix-socket targets. Returns the route of the target
+// that answered.
+func roundTripFailover(req *http.Request, rt route, origHost string, withBody bool, transport func(route) http.RoundTripper) (*http.Response, route, error) {
+	if rt.offline {
+		return nil, rt, offlineError()
+	}
+	for {
+		resp, err := transport(rt).RoundTrip(req)
+		if err == nil || forwardErrorCode(err) == ErrCodeDialFailed {
+			markTarget(rt, err)
+		}
+		if err == nil || withBody || forwardErrorCode(err) != ErrCodeDialFailed {
+			return resp, rt, err
+		}
+		next, ok := rt.reresolved()
+		if !ok {
+			if next, ok = rt.next(); !ok {
+				return nil, rt, err
+			}
+			logWarn("Failed to connect to %s for %s, failing over to %s: %v", rt.addr, rt.host, next.addr, err)
+		}
+		req = req.Clone(req.Context())
+		req.URL.Host = next.urlHost(origHost)
+		req.Host = next.hostHeader(origHost)
+		req.Body = http.NoBody
+		rt = next
+	}
+}
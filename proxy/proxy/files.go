@@ -0,0 +1,63 @@
+package proxy
+
+import (
+	"errors"
+	"net/http"
+	"os"
+	"path"
+	"path/filepath"
+	"runtime"
+	"strings"
+)
+
+// Mapping a host to "file:///home/me/dist" serves that directory instead of
+// forwarding: files get their MIME type from the extension, directories
+// their index.html, and anything else 404, with no directory listings.
+// With the spa option, extensionless paths that match no file get the root
+// index.html, so client-side routes load the app.
+const fileScheme = "file://"
+
+// Tunnels can't reach a directory
+var errFileTarget = errors.New("file mappings only serve HTTP requests")
+
+// Directory named by a file:// mapping value
+func fileRoot(target string) string {
+	dir := strings.TrimPrefix(target, fileScheme)
+	// file:///C:/site names C:/site
+	if runtime.GOOS == "windows" && len(dir) > 2 && dir[0] == '/' && dir[2] == ':' {
+		dir = dir[1:]
+	}
+	return filepath.FromSlash(dir)
+}
+
+// Transport answering requests from the route's directory
+func fileTransport(rt route) http.RoundTripper {
+	return http.NewFileTransport(staticDir{root: http.Dir(rt.addr), spa: rt.options.SPA})
+}
+
+// The served directory, wrapped so http.FileServer lists nothing and falls
+// back to index.html for SPAs
+type staticDir struct {
+	root http.Dir
+	spa  bool
+}
+
+func (d staticDir) Open(name string) (http.File, error) {
+	f, err := d.root.Open(name)
+	if errors.Is(err, os.ErrNotExist) && d.spa && path.Ext(name) == "" {
+		return d.root.Open("/index.html")
+	}
+	if err != nil {
+		return nil, err
+	}
+	if info, err := f.Stat(); err == nil && info.IsDir() {
+		// Serve the directory only when it has an index page
+		index, err := d.root.Open(path.Join(name, "index.html"))
+		if err != nil {
+			f.Close()
+			return nil, os.ErrNotExist
+		}
+		index.Close()
+	}
+	return f, nil
+}
@@ -0,0 +1,91 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+)
+
+// What forwarded requests tell the target about the proxy. "preserve", the
+// default, passes X-Forwarded-*, X-Real-IP, Via and Forwarded on as the
+// browser sent them; "append" adds the client and the proxy to them the way
+// a reverse proxy would; "strip" removes them, for backends that behave
+// differently once they detect a proxy.
+const (
+	forwardedPreserve = "preserve"
+	forwardedAppend   = "append"
+	forwardedStrip    = "strip"
+)
+
+var forwardedHeaders = []string{"X-Forwarded-For", "X-Forwarded-Host", "X-Forwarded-Proto", "X-Real-IP", "Via", "Forwarded"}
+
+var errForwardedPolicy = errors.New(`forwardedHeaders must be "preserve", "append" or "strip"`)
+
+// Check a start message's policy, preserve when empty
+func forwardedPolicy(policy string) (string, error) {
+	switch policy {
+	case "":
+		return forwardedPreserve, nil
+	case forwardedPreserve, forwardedAppend, forwardedStrip:
+		return policy, nil
+	default:
+		return "", errForwardedPolicy
+	}
+}
+
+// Apply the route's policy to out, a request forwarded for in. proto is
+// the scheme the browser used.
+func applyForwardedHeaders(out, in *http.Request, rt route, proto string) {
+	policy := rt.settings.forwarded
+	if policy != forwardedStrip {
+		// Start from what the browser sent, which ReverseProxy drops
+		for _, key := range forwardedHeaders {
+			if values := in.Header.Values(key); len(values) > 0 {
+				out.Header[http.CanonicalHeaderKey(key)] = append([]string(nil), values...)
+			}
+		}
+	}
+	switch policy {
+	case forwardedStrip:
+		for _, key := range forwardedHeaders {
+			out.Header.Del(key)
+		}
+
+	case forwardedAppend:
+		client, _, err := net.SplitHostPort(in.RemoteAddr)
+		if err != nil {
+			client = in.RemoteAddr
+		}
+		if prior := out.Header.Get("X-Forwarded-For"); prior != "" {
+			out.Header.Set("X-Forwarded-For", prior+", "+client)
+		} else {
+			out.Header.Set("X-Forwarded-For", client)
+		}
+		setIfAbsent(out.Header, "X-Forwarded-Host", in.Host)
+		setIfAbsent(out.Header, "X-Forwarded-Proto", proto)
+		setIfAbsent(out.Header, "X-Real-IP", client)
+		appendHeader(out.Header, "Via", fmt.Sprintf("%d.%d fhosts", in.ProtoMajor, in.ProtoMinor))
+
+		node := client
+		if strings.Contains(client, ":") {
+			node = `"[` + client + `]"` // IPv6 addresses are quoted
+		}
+		appendHeader(out.Header, "Forwarded", fmt.Sprintf("for=%s;host=%q;proto=%s", node, in.Host, proto))
+	}
+}
+
+func setIfAbsent(h http.Header, key, value string) {
+	if h.Get(key) == "" {
+		h.Set(key, value)
+	}
+}
+
+// Add value to a comma-separated list header
+func appendHeader(h http.Header, key, value string) {
+	if prior := strings.Join(h.Values(key), ", "); prior != "" {
+		value = prior + ", " + value
+	}
+	h.Set(key, value)
+}
@@ -0,0 +1,361 @@
+package proxy
+
+import (
+	"context"
+	"crypto/rand"
+	"crypto/subtle"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"google.golang.org/grpc"
+	"google.golang.org/grpc/codes"
+	"google.golang.org/grpc/metadata"
+	"google.golang.org/grpc/status"
+
+	"fhosts-proxy/controlpb"
+)
+
+// gRPC control API (controlpb/control.proto) for tools that want typed
+// calls instead of native messaging. With grpc set to "unix" it listens on
+// grpc.sock in the config directory, which is private to the user; on a
+// loopback host:port every call must carry the token written to grpc.json
+// as "authorization: Bearer <token>" metadata. Like the admin API it lives
+// until the process exits.
+const (
+	grpcSocket = "grpc.sock"
+	grpcFile   = "grpc.json"
+)
+
+var grpcServer *grpc.Server
+
+// Where local tools find the gRPC API
+type grpcInfo struct {
+	Address string `json:"address"` // gRPC target, unix:///path or host:port
+	Token   string `json:"token,omitempty"`
+}
+
+// Start the gRPC API on listen, "unix" or a loopback host:port. Empty
+// leaves it off.
+func startGRPC(listen string) error {
+	if listen == "" || grpcServer != nil {
+		return nil
+	}
+
+	var (
+		l    net.Listener
+		info grpcInfo
+		opts []grpc.ServerOption
+	)
+	if listen == "unix" {
+		dir, err := configDir()
+		if err != nil {
+			return err
+		}
+		path := filepath.Join(dir, grpcSocket)
+		os.Remove(path) // Stale socket from a crashed instance
+		if l, err = net.Listen("unix", path); err != nil {
+			return err
+		}
+		info.Address = "unix://" + path
+	} else {
+		host, _, err := net.SplitHostPort(listen)
+		if err != nil {
+			return err
+		}
+		if ip := net.ParseIP(host); host != "localhost" && (ip == nil || !ip.IsLoopback()) {
+			return fmt.Errorf("gRPC address %s is not on loopback", listen)
+		}
+		secret := make([]byte, 32)
+		if _, err := rand.Read(secret); err != nil {
+			return err
+		}
+		token := hex.EncodeToString(secret)
+		if l, err = net.Listen("tcp", listen); err != nil {
+			return err
+		}
+		info = grpcInfo{Address: l.Addr().String(), Token: token}
+		opts = requireGRPCToken(token)
+	}
+	if err := writeGRPCInfo(info); err != nil {
+		l.Close()
+		return err
+	}
+
+	grpcServer = grpc.NewServer(opts...)
+	controlpb.RegisterControlServer(grpcServer, controlService{})
+	logInfo("gRPC control API listening on %s", info.Address)
+	go grpcServer.Serve(l)
+	return nil
+}
+
+func stopGRPC() {
+	if grpcServer != nil {
+		grpcServer.Stop()
+		grpcServer = nil
+		if dir, err := configDir(); err == nil {
+			os.Remove(filepath.Join(dir, grpcFile))
+		}
+	}
+}
+
+func writeGRPCInfo(info grpcInfo) error {
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	data, _ := json.MarshalIndent(info, "", "  ")
+	return writeFileAtomic(filepath.Join(dir, grpcFile), data)
+}
+
+// Interceptors rejecting calls without the bearer token
+func requireGRPCToken(token string) []grpc.ServerOption {
+	check := func(ctx context.Context) error {
+		md, _ := metadata.FromIncomingContext(ctx)
+		for _, value := range md.Get("authorization") {
+			got, _ := strings.CutPrefix(value, "Bearer ")
+			if subtle.ConstantTimeCompare([]byte(got), []byte(token)) == 1 {
+				return nil
+			}
+		}
+		return status.Error(codes.Unauthenticated, "missing or invalid gRPC token")
+	}
+	return []grpc.ServerOption{
+		grpc.UnaryInterceptor(func(ctx context.Context, req any, _ *grpc.UnaryServerInfo, handler grpc.UnaryHandler) (any, error) {
+			if err := check(ctx); err != nil {
+				return nil, err
+			}
+			return handler(ctx, req)
+		}),
+		grpc.StreamInterceptor(func(srv any, ss grpc.ServerStream, _ *grpc.StreamServerInfo, handler grpc.StreamHandler) error {
+			if err := check(ss.Context()); err != nil {
+				return err
+			}
+			return handler(srv, ss)
+		}),
+	}
+}
+
+// Run an action through handleMessage and return its first reply, or the
+// error it replied with as a gRPC status
+func grpcAction(msg *Message) (Message, error) {
+	var first Message
+	engine.handleMessage(msg, sourceGRPC, func(reply Message) {
+		if first.Type == "" {
+			first = reply
+		}
+	})
+	if first.Type == "error" {
+		return first, status.Error(grpcCode(first.ErrorCode), first.Message)
+	}
+	return first, nil
+}
+
+// gRPC code for an error reply
+func grpcCode(errorCode string) codes.Code {
+	switch errorCode {
+	case ErrCodeUnknownAction:
+		return codes.Unimplemented
+	case ErrCodeNotFound:
+		return codes.NotFound
+	case ErrCodePortInUse:
+		return codes.FailedPrecondition
+	case ErrCodeServerError, ErrCodeFileError, ErrCodeCAError:
+		return codes.Internal
+	}
+	return codes.InvalidArgument
+}
+
+// Event streams, and how many of them asked for traffic events
+var (
+	eventStreamsMu sync.Mutex
+	eventStreams   = make(map[chan Message]bool)
+	trafficStreams atomic.Int32
+)
+
+// Pass a message to every event stream. Streams that fall behind miss
+// messages rather than holding up the proxy.
+func publishEvent(msg Message) {
+	eventStreamsMu.Lock()
+	defer eventStreamsMu.Unlock()
+	for ch := range eventStreams {
+		select {
+		case ch <- msg:
+		default:
+		}
+	}
+}
+
+type controlService struct {
+	controlpb.UnimplementedControlServer
+}
+
+func (controlService) Start(ctx context.Context, req *controlpb.StartRequest) (*controlpb.StartReply, error) {
+	msg := &Message{Action: "start", Mappings: req.Mappings, IPv6: req.Ipv6}
+	if req.Port != nil {
+		port := int(*req.Port)
+		msg.Port = &port
+	}
+	reply, err := grpcAction(msg)
+	if err != nil {
+		return nil, err
+	}
+	port := 0
+	if reply.Port != nil {
+		port = *reply.Port
+	}
+	return &controlpb.StartReply{Port: int32(port), ProxyToken: reply.ProxyToken}, nil
+}
+
+func (controlService) Stop(ctx context.Context, req *controlpb.StopRequest) (*controlpb.StopReply, error) {
+	engine.Stop()
+	return &controlpb.StopReply{}, nil
+}
+
+func (controlService) Status(ctx context.Context, req *controlpb.StatusRequest) (*controlpb.StatusReply, error) {
+	reply, err := grpcAction(&Message{Action: "status"})
+	if err != nil {
+		return nil, err
+	}
+	s := reply.Status
+	return &controlpb.StatusReply{
+		Running:       s.Running,
+		Paused:        s.Paused,
+		Daemon:        s.Daemon,
+		Port:          int32(s.Port),
+		UptimeSeconds: s.UptimeSeconds,
+		ActiveTunnels: s.ActiveTunnels,
+		TotalRequests: s.TotalRequests,
+		Pid:           int32(s.PID),
+		Version:       s.Version,
+		DownTargets:   s.DownTargets,
+	}, nil
+}
+
+func (controlService) UpdateMappings(ctx context.Context, req *controlpb.MappingsRequest) (*controlpb.MappingsReply, error) {
+	return mappingsReply(grpcAction(&Message{Action: "updateMappings", Mappings: req.Mappings}))
+}
+
+func (controlService) AddMappings(ctx context.Context, req *controlpb.MappingsRequest) (*controlpb.MappingsReply, error) {
+	return mappingsReply(grpcAction(&Message{Action: "addMappings", Mappings: req.Mappings}))
+}
+
+func (controlService) RemoveMappings(ctx context.Context, req *controlpb.RemoveMappingsRequest) (*controlpb.MappingsReply, error) {
+	return mappingsReply(grpcAction(&Message{Action: "removeMappings", Hosts: req.Hosts}))
+}
+
+func mappingsReply(reply Message, err error) (*controlpb.MappingsReply, error) {
+	if err != nil {
+		return nil, err
+	}
+	return &controlpb.MappingsReply{Count: int32(reply.Count), Revision: reply.Revision}, nil
+}
+
+func (controlService) GetStats(ctx context.Context, req *controlpb.StatsRequest) (*controlpb.Stats, error) {
+	return grpcStats(), nil
+}
+
+func (controlService) WatchStats(req *controlpb.WatchStatsRequest, stream grpc.ServerStreamingServer[controlpb.Stats]) error {
+	interval := time.Second
+	if req.IntervalMs > 0 {
+		interval = time.Duration(req.IntervalMs) * time.Millisecond
+	}
+	ticker := time.NewTicker(interval)
+	defer ticker.Stop()
+	for {
+		if err := stream.Send(grpcStats()); err != nil {
+			return err
+		}
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case <-ticker.C:
+		}
+	}
+}
+
+func grpcStats() *controlpb.Stats {
+	hosts := make(map[string]*controlpb.HostStats)
+	for host, s := range snapshotStats() {
+		hosts[host] = &controlpb.HostStats{Requests: s.Requests, BytesIn: s.BytesIn, BytesOut: s.BytesOut, Errors: s.Errors}
+	}
+	return &controlpb.Stats{Hosts: hosts}
+}
+
+func (controlService) Events(req *controlpb.EventsRequest, stream grpc.ServerStreamingServer[controlpb.Event]) error {
+	ch := make(chan Message, 256)
+	eventStreamsMu.Lock()
+	eventStreams[ch] = true
+	eventStreamsMu.Unlock()
+	defer func() {
+		eventStreamsMu.Lock()
+		delete(eventStreams, ch)
+		eventStreamsMu.Unlock()
+	}()
+	if req.Traffic {
+		trafficStreams.Add(1)
+		defer trafficStreams.Add(-1)
+	}
+
+	for {
+		select {
+		case <-stream.Context().Done():
+			return nil
+		case msg := <-ch:
+			if msg.Type == "traffic" && !req.Traffic {
+				continue
+			}
+			if err := stream.Send(grpcEvent(msg)); err != nil {
+				return err
+			}
+		}
+	}
+}
+
+func grpcEvent(msg Message) *controlpb.Event {
+	event := &controlpb.Event{Type: msg.Type}
+	switch {
+	case msg.Type == "traffic" && msg.Traffic != nil:
+		t := msg.Traffic
+		event.Payload = &controlpb.Event_Traffic{Traffic: &controlpb.Traffic{
+			Method:     t.Method,
+			Host:       t.Host,
+			Target:     t.Target,
+			Mapped:     t.Mapped,
+			Status:     int32(t.Status),
+			DurationMs: t.DurationMs,
+			BytesIn:    t.BytesIn,
+			BytesOut:   t.BytesOut,
+		}}
+	case msg.Type == "log":
+		logs := &controlpb.Logs{}
+		for _, entry := range msg.Logs {
+			logs.Entries = append(logs.Entries, &controlpb.LogEntry{Level: entry.Level, Message: entry.Message, Time: entry.Time})
+		}
+		event.Payload = &controlpb.Event_Logs{Logs: logs}
+	default:
+		data, _ := json.Marshal(msg)
+		event.Payload = &controlpb.Event_Json{Json: string(data)}
+	}
+	return event
+}
+
+func (controlService) Do(ctx context.Context, req *controlpb.ActionRequest) (*controlpb.ActionReply, error) {
+	var msg Message
+	if err := json.Unmarshal([]byte(req.Json), &msg); err != nil {
+		return nil, status.Errorf(codes.InvalidArgument, "invalid message: %v", err)
+	}
+	reply := &controlpb.ActionReply{}
+	engine.handleMessage(&msg, sourceGRPC, func(resp Message) {
+		data, _ := json.Marshal(resp)
+		reply.Json = append(reply.Json, string(data))
+	})
+	return reply, nil
+}
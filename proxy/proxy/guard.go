@@ -0,0 +1,81 @@
+package proxy
+
+import (
+	"context"
+	"errors"
+	"net"
+	"net/http"
+	"strconv"
+	"syscall"
+)
+
+// CONNECT is only allowed to these ports, so local processes can't use the
+// proxy as a relay to arbitrary TCP services. Port 0 in the list allows
+// every port. SOCKS clients send plain HTTP through their connections
+// too, so they may also reach port 80 unless connectPorts is set.
+var (
+	defaultConnectPorts = []int{443}
+	defaultSocksPorts   = []int{80, 443}
+)
+
+// The ports in a connectPorts list, defaults when it is empty
+func connectPortSet(ports, defaults []int) map[int]bool {
+	if len(ports) == 0 {
+		ports = defaults
+	}
+	set := make(map[int]bool, len(ports))
+	for _, port := range ports {
+		set[port] = true
+	}
+	return set
+}
+
+func connectPortAllowed(rt route, port string) bool {
+	return portAllowed(rt.settings.connectPorts, port)
+}
+
+func socksPortAllowed(rt route, port string) bool {
+	return portAllowed(rt.settings.socksPorts, port)
+}
+
+func portAllowed(allowed map[int]bool, port string) bool {
+	n, err := strconv.Atoi(port)
+	return err == nil && (allowed[0] || allowed[n])
+}
+
+// Refuse a CONNECT to a port outside the allowlist with 403 and an error
+// event. Returns whether it was refused.
+func rejectConnectPort(w http.ResponseWriter, rt route, host, port string) bool {
+	if connectPortAllowed(rt, port) {
+		return false
+	}
+	sendError(rt.settings, ErrCodePortNotAllowed, "Refused CONNECT to %s: port %s is not in connectPorts", host, port)
+	http.Error(w, "CONNECT to this port is not allowed", http.StatusForbidden)
+	return true
+}
+
+// With blockPrivate on, requests for hosts without a mapping may not reach
+// loopback, private (RFC 1918, IPv6 ULA) or link-local addresses, so web
+// pages can't use the proxy to probe the user's network. Mapped targets
+// are always allowed; the check applies to the addresses actually dialed,
+// so hostnames resolving to private addresses are refused too.
+var errPrivateTarget = errors.New("unmapped host resolves to a private address")
+
+func checkPublic(ip net.IP) error {
+	if ip.IsLoopback() || ip.IsPrivate() || ip.IsLinkLocalUnicast() || ip.IsLinkLocalMulticast() || ip.IsUnspecified() {
+		return errPrivateTarget
+	}
+	return nil
+}
+
+// Dial a guarded route's address, refusing private ones. The check runs
+// on each address the dialer tries, so hostnames resolving to private
+// addresses are caught too.
+func dialPublic(ctx context.Context, network, addr string) (net.Conn, error) {
+	d := *shared().dialer
+	d.ControlContext = func(_ context.Context, _, address string, _ syscall.RawConn) error {
+		host, _, _ := net.SplitHostPort(address)
+		return checkPublic(net.ParseIP(host))
+	}
+	return d.DialContext(ctx, network, addr)
+}
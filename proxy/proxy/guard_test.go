@@ -0,0 +1,186 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/binary"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Collects the error codes of error events
+type errorEvents struct {
+	mu    sync.Mutex
+	codes []string
+}
+
+func (e *errorEvents) record(msg Message) {
+	if msg.Type == "error" {
+		e.mu.Lock()
+		e.codes = append(e.codes, msg.ErrorCode)
+		e.mu.Unlock()
+	}
+}
+
+func (e *errorEvents) has(code string) bool {
+	e.mu.Lock()
+	defer e.mu.Unlock()
+	for _, c := range e.codes {
+		if c == code {
+			return true
+		}
+	}
+	return false
+}
+
+// Start a proxy routing ssh.test and raw.test (a tcp mapping) to a TCP
+// listener that accepts and closes, returning the proxy and its events
+func startGuardedProxy(t *testing.T) (*Proxy, *errorEvents) {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	target, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { target.Close() })
+	go func() {
+		for {
+			conn, err := target.Accept()
+			if err != nil {
+				return
+			}
+			conn.Close()
+		}
+	}()
+
+	events := &errorEvents{}
+	p := New(events.record)
+	t.Cleanup(func() { setOutput(nil) })
+	port := 0
+	err = p.Start(context.Background(), Message{
+		Port:     &port,
+		Mappings: map[string]string{"ssh.test": target.Addr().String(), "raw.test": target.Addr().String()},
+		Options:  map[string]MappingOptions{"raw.test": {TCP: true}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Stop)
+	return p, events
+}
+
+// Send a CONNECT for hostport and return the response status
+func connectStatus(t *testing.T, proxyPort int, hostport string) int {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", proxyPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", hostport, hostport)
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	resp.Body.Close()
+	return resp.StatusCode
+}
+
+func TestConnectPorts(t *testing.T) {
+	p, events := startGuardedProxy(t)
+
+	if got := connectStatus(t, p.Port(), "ssh.test:22"); got != http.StatusForbidden {
+		t.Errorf("CONNECT to port 22: status %d, want 403", got)
+	}
+	if !events.has(ErrCodePortNotAllowed) {
+		t.Errorf("no %s event, got %v", ErrCodePortNotAllowed, events.codes)
+	}
+	if got := connectStatus(t, p.Port(), "ssh.test:443"); got != http.StatusOK {
+		t.Errorf("CONNECT to port 443: status %d, want 200", got)
+	}
+	if got := connectStatus(t, p.Port(), "raw.test:22"); got != http.StatusOK {
+		t.Errorf("CONNECT to a tcp mapping on port 22: status %d, want 200", got)
+	}
+}
+
+// Send a SOCKS5 CONNECT for host:port and return the reply code
+func socksStatus(t *testing.T, socksPort int, host string, port int) byte {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", socksPort))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.Write([]byte{socksVersion, 1, socksNoAuth})
+	greeting := make([]byte, 2)
+	if _, err := io.ReadFull(conn, greeting); err != nil || greeting[1] != socksNoAuth {
+		t.Fatalf("greeting %v, %v", greeting, err)
+	}
+	req := []byte{socksVersion, socksCmdConnect, 0, socksAtypDomain, byte(len(host))}
+	req = append(req, host...)
+	req = binary.BigEndian.AppendUint16(req, uint16(port))
+	conn.Write(req)
+	reply := make([]byte, 2)
+	if _, err := io.ReadFull(conn, reply); err != nil {
+		t.Fatal(err)
+	}
+	return reply[1]
+}
+
+func TestSocksConnectPorts(t *testing.T) {
+	p, events := startGuardedProxy(t)
+	zero := 0
+	started := p.Do(Message{Action: "startSocks", Port: &zero})
+	if started.Port == nil {
+		t.Fatalf("startSocks replied %+v", started)
+	}
+	socksPort := *started.Port
+
+	if got := socksStatus(t, socksPort, "ssh.test", 22); got != socksReplyNotAllowed {
+		t.Errorf("SOCKS to port 22: reply %d, want %d", got, socksReplyNotAllowed)
+	}
+	if !events.has(ErrCodePortNotAllowed) {
+		t.Errorf("no %s event, got %v", ErrCodePortNotAllowed, events.codes)
+	}
+	if got := socksStatus(t, socksPort, "ssh.test", 443); got != socksReplySuccess {
+		t.Errorf("SOCKS to port 443: reply %d, want success", got)
+	}
+	if got := socksStatus(t, socksPort, "ssh.test", 80); got != socksReplySuccess {
+		t.Errorf("SOCKS to port 80: reply %d, want success", got)
+	}
+	if got := socksStatus(t, socksPort, "raw.test", 22); got != socksReplySuccess {
+		t.Errorf("SOCKS to a tcp mapping on port 22: reply %d, want success", got)
+	}
+}
+
+func TestSocksHandshakeTimeout(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	t.Cleanup(func() { configureTimeouts(nil) })
+	p := New(nil)
+	port := 0
+	err := p.Start(context.Background(), Message{
+		Port:      &port,
+		Timeouts:  &Timeouts{TLSHandshake: 100},
+		Listeners: []Listener{{Type: "socks"}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Stop)
+
+	// A client that connects and never greets is dropped
+	conn, err := net.Dial("tcp", p.socksListeners[0].Addr().String())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+	conn.SetDeadline(time.Now().Add(5 * time.Second))
+	if _, err := conn.Read(make([]byte, 1)); err != io.EOF {
+		t.Errorf("stalled handshake: read %v, want EOF once the proxy gives up", err)
+	}
+}
@@ -0,0 +1,261 @@
+package proxy
+
+import (
+	"bytes"
+	"encoding/base64"
+	"encoding/json"
+	"io"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+	"unicode/utf8"
+)
+
+// Recording keeps the most recent entries and the first part of each body,
+// so a forgotten recording can't grow without bound
+const (
+	maxHAREntries  = 1000
+	maxHARBodySize = 1 << 20
+)
+
+var (
+	recording  atomic.Bool
+	harEntries []harEntry
+	harMu      sync.Mutex
+)
+
+// HTTP Archive 1.2 document (http://www.softwareishard.com/blog/har-12-spec/)
+type harDocument struct {
+	Log harLog `json:"log"`
+}
+
+type harLog struct {
+	Version string     `json:"version"`
+	Creator harCreator `json:"creator"`
+	Entries []harEntry `json:"entries"`
+}
+
+type harCreator struct {
+	Name    string `json:"name"`
+	Version string `json:"version"`
+}
+
+type harEntry struct {
+	StartedDateTime string      `json:"startedDateTime"`
+	Time            int64       `json:"time"`
+	Request         harRequest  `json:"request"`
+	Response        harResponse `json:"response"`
+	Cache           struct{}    `json:"cache"`
+	Timings         harTimings  `json:"timings"`
+	ServerIPAddress string      `json:"serverIPAddress,omitempty"`
+}
+
+type harRequest struct {
+	Method      string      `json:"method"`
+	URL         string      `json:"url"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harRecord `json:"cookies"`
+	Headers     []harRecord `json:"headers"`
+	QueryString []harRecord `json:"queryString"`
+	PostData    *harContent `json:"postData,omitempty"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+type harResponse struct {
+	Status      int         `json:"status"`
+	StatusText  string      `json:"statusText"`
+	HTTPVersion string      `json:"httpVersion"`
+	Cookies     []harRecord `json:"cookies"`
+	Headers     []harRecord `json:"headers"`
+	Content     harContent  `json:"content"`
+	RedirectURL string      `json:"redirectURL"`
+	HeadersSize int         `json:"headersSize"`
+	BodySize    int64       `json:"bodySize"`
+}
+
+// A name/value pair (header, cookie or query parameter)
+type harRecord struct {
+	Name  string `json:"name"`
+	Value string `json:"value"`
+}
+
+// A request or response body. Non-UTF-8 bodies are base64 encoded.
+type harContent struct {
+	Size     int64  `json:"size"`
+	MimeType string `json:"mimeType"`
+	Text     string `json:"text,omitempty"`
+	Encoding string `json:"encoding,omitempty"`
+}
+
+type harTimings struct {
+	Send    int64 `json:"send"`
+	Wait    int64 `json:"wait"`
+	Receive int64 `json:"receive"`
+}
+
+// One request being recorded. startCapture returns nil when not recording,
+// and every method ignores nil.
+type harCapture struct {
+	start    time.Time
+	req      *http.Request
+	url      string
+	reqBody  cappedBuffer
+	respBody cappedBuffer
+	waited   time.Duration // Until response headers arrived
+}
+
+func startCapture(r *http.Request, url string) *harCapture {
+	if !recording.Load() {
+		return nil
+	}
+	return &harCapture{start: time.Now(), req: r, url: url}
+}
+
+// Wrap a request body so it is recorded as it is forwarded
+func (c *harCapture) requestBody(body io.ReadCloser) io.ReadCloser {
+	if c == nil || body == nil {
+		return body
+	}
+	return readCloser(io.TeeReader(body, &c.reqBody), body)
+}
+
+// Wrap a response body so it is recorded as it is copied to the client
+func (c *harCapture) responseBody(body io.ReadCloser) io.ReadCloser {
+	if c == nil {
+		return body
+	}
+	c.waited = time.Since(c.start)
+	return readCloser(io.TeeReader(body, &c.respBody), body)
+}
+
+// Record the finished exchange. resp is nil when the target failed, which
+// HAR represents as status 0.
+func (c *harCapture) finish(resp *http.Response, rt route) {
+	if c == nil || !recording.Load() {
+		return
+	}
+	total := time.Since(c.start)
+	entry := harEntry{
+		StartedDateTime: c.start.Format(time.RFC3339Nano),
+		Time:            total.Milliseconds(),
+		Request: harRequest{
+			Method:      c.req.Method,
+			URL:         c.url,
+			HTTPVersion: c.req.Proto,
+			Cookies:     harCookies(c.req.Cookies()),
+			Headers:     harHeaders(c.req.Header),
+			QueryString: harQuery(c.req),
+			HeadersSize: -1,
+			BodySize:    c.reqBody.total,
+		},
+		Response: harResponse{
+			Cookies:     []harRecord{},
+			Headers:     []harRecord{},
+			HeadersSize: -1,
+			BodySize:    -1,
+		},
+		Timings:         harTimings{Wait: c.waited.Milliseconds(), Receive: (total - c.waited).Milliseconds()},
+		ServerIPAddress: rt.addr,
+	}
+	if c.reqBody.total > 0 {
+		content := c.reqBody.content(c.req.Header.Get("Content-Type"))
+		entry.Request.PostData = &content
+	}
+	if resp != nil {
+		entry.Response.Status = resp.StatusCode
+		entry.Response.StatusText = http.StatusText(resp.StatusCode)
+		entry.Response.HTTPVersion = resp.Proto
+		entry.Response.Cookies = harCookies(resp.Cookies())
+		entry.Response.Headers = harHeaders(resp.Header)
+		entry.Response.Content = c.respBody.content(resp.Header.Get("Content-Type"))
+		entry.Response.RedirectURL = resp.Header.Get("Location")
+		entry.Response.BodySize = c.respBody.total
+	} else {
+		entry.Timings = harTimings{Wait: total.Milliseconds()}
+	}
+
+	harMu.Lock()
+	if len(harEntries) >= maxHAREntries {
+		harEntries = harEntries[1:]
+	}
+	harEntries = append(harEntries, entry)
+	harMu.Unlock()
+}
+
+// Start recording, discarding any previous capture
+func startRecording() {
+	harMu.Lock()
+	harEntries = nil
+	harMu.Unlock()
+	recording.Store(true)
+}
+
+// Render the captured entries as a HAR document
+func exportHAR() ([]byte, int) {
+	harMu.Lock()
+	entries := append([]harEntry{}, harEntries...)
+	harMu.Unlock()
+
+	doc := harDocument{Log: harLog{
+		Version: "1.2",
+		Creator: harCreator{Name: "fhosts-proxy", Version: version},
+		Entries: entries,
+	}}
+	data, _ := json.MarshalIndent(doc, "", "  ")
+	return data, len(entries)
+}
+
+func harHeaders(h http.Header) []harRecord {
+	records := []harRecord{}
+	for name, values := range h {
+		for _, value := range values {
+			records = append(records, harRecord{Name: name, Value: value})
+		}
+	}
+	return records
+}
+
+func harCookies(cookies []*http.Cookie) []harRecord {
+	records := []harRecord{}
+	for _, cookie := range cookies {
+		records = append(records, harRecord{Name: cookie.Name, Value: cookie.Value})
+	}
+	return records
+}
+
+func harQuery(r *http.Request) []harRecord {
+	records := []harRecord{}
+	for name, values := range r.URL.Query() {
+		for _, value := range values {
+			records = append(records, harRecord{Name: name, Value: value})
+		}
+	}
+	return records
+}
+
+// A writer keeping the first maxHARBodySize bytes and counting the rest
+type cappedBuffer struct {
+	buf   bytes.Buffer
+	total int64
+}
+
+func (b *cappedBuffer) Write(p []byte) (int, error) {
+	b.total += int64(len(p))
+	if room := maxHARBodySize - b.buf.Len(); room > 0 {
+		b.buf.Write(p[:min(room, len(p))])
+	}
+	return len(p), nil
+}
+
+func (b *cappedBuffer) content(mimeType string) harContent {
+	content := harContent{Size: b.total, MimeType: mimeType}
+	if data := b.buf.Bytes(); utf8.Valid(data) {
+		content.Text = string(data)
+	} else {
+		content.Text = base64.StdEncoding.EncodeToString(data)
+		content.Encoding = "base64"
+	}
+	return content
+}
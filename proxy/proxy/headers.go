@@ -0,0 +1,52 @@
+package proxy
+
+import "net/http"
+
+// Header rewrite rules for one host, keyed like mappings
+type HeaderRules struct {
+	Request  *HeaderOps `json:"request,omitempty"`  // Applied to requests before they are forwarded
+	Response *HeaderOps `json:"response,omitempty"` // Applied to responses before they reach the browser
+}
+
+// Header edits, applied in order: remove, then set (replacing existing
+// values), then add
+type HeaderOps struct {
+	Remove []string          `json:"remove,omitempty"`
+	Set    map[string]string `json:"set,omitempty"`
+	Add    map[string]string `json:"add,omitempty"`
+}
+
+// Apply the edits to h. A nil HeaderOps leaves h untouched.
+func (ops *HeaderOps) apply(h http.Header) {
+	if ops == nil {
+		return
+	}
+	for _, key := range ops.Remove {
+		if http.CanonicalHeaderKey(key) == "User-Agent" {
+			// An empty value stops the transport adding its default
+			h["User-Agent"] = []string{""}
+			continue
+		}
+		h.Del(key)
+	}
+	for key, value := range ops.Set {
+		h.Set(key, value)
+	}
+	for key, value := range ops.Add {
+		h.Add(key, value)
+	}
+}
+
+// Applies the host's header rules
+type headerMiddleware struct{}
+
+func (headerMiddleware) OnConnect(f *Flow) error { return nil }
+
+func (headerMiddleware) OnRequest(f *Flow, req *http.Request) (*http.Response, error) {
+	f.route.headers.Request.apply(req.Header)
+	return nil, nil
+}
+
+func (headerMiddleware) OnResponse(f *Flow, req *http.Request, resp *http.Response) {
+	f.route.headers.Response.apply(resp.Header)
+}
@@ -0,0 +1,249 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Active health checking of a mapping's targets
+type HealthCheck struct {
+	Path       string `json:"path,omitempty"`       // GET this path and expect a non-5xx status, instead of only connecting
+	IntervalMs int    `json:"intervalMs,omitempty"` // Between probes of each target, 5s by default
+	Port       int    `json:"port,omitempty"`       // For targets that don't name one, 80 by default
+
+	// Send requests to the real host while every target is down, and skip
+	// down targets otherwise
+	FallbackToOrigin bool `json:"fallbackToOrigin,omitempty"`
+}
+
+const (
+	defaultHealthInterval = 5 * time.Second
+	healthCheckTimeout    = 5 * time.Second
+	healthTick            = time.Second // How often due probes are started
+	defaultHealthPort     = "80"
+)
+
+// A probed target, keyed by mapping host and dial address
+type probeKey struct {
+	host string
+	addr string
+}
+
+type probeState struct {
+	next    time.Time
+	running bool
+}
+
+// A running proxy's health checks
+type healthState struct {
+	mu        sync.Mutex
+	probes    map[probeKey]*probeState
+	unhealthy map[string]bool // Dial addresses whose last probe failed
+	stop      chan struct{}
+}
+
+func newHealthState() *healthState {
+	return &healthState{probes: make(map[probeKey]*probeState), unhealthy: make(map[string]bool)}
+}
+
+// Whether the last probe of addr failed
+func (h *healthState) down(addr string) bool {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	return h.unhealthy[addr]
+}
+
+// Dial addresses whose last probe failed
+func (h *healthState) downAddrs() []string {
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	addrs := make([]string, 0, len(h.unhealthy))
+	for addr := range h.unhealthy {
+		addrs = append(addrs, addr)
+	}
+	return addrs
+}
+
+// Probe the targets of mappings with a healthCheck option, recording the
+// results in settings, until stopHealthChecks
+func (p *Proxy) startHealthChecks(settings *proxySettings) {
+	h := settings.health
+	stop := make(chan struct{})
+	h.mu.Lock()
+	h.stop = stop
+	h.mu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(healthTick)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				p.runHealthChecks(settings)
+			}
+		}
+	}()
+}
+
+func stopHealthChecks(settings *proxySettings) {
+	h := settings.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	if h.stop != nil {
+		close(h.stop)
+		h.stop = nil
+	}
+}
+
+// Start the probes that are due, forgetting targets no longer mapped
+func (p *Proxy) runHealthChecks(settings *proxySettings) {
+	type target struct {
+		rt    route
+		check HealthCheck
+	}
+	var targets []target
+	p.mappingsMu.RLock()
+	for host, options := range p.mappingOptions {
+		mapped, ok := p.hostMappings[host]
+		if options.HealthCheck == nil || !ok {
+			continue
+		}
+		port := defaultHealthPort
+		if options.HealthCheck.Port > 0 {
+			port = strconv.Itoa(options.HealthCheck.Port)
+		}
+		base := route{host: host, network: "tcp", mapped: true, options: options, requestedHost: host, requestedPort: port, settings: settings}
+		for _, t := range strings.Split(mapped, ",") {
+			if t = strings.TrimSpace(t); t != originTarget {
+				targets = append(targets, target{base.withTarget(t), *options.HealthCheck})
+			}
+		}
+	}
+	p.mappingsMu.RUnlock()
+
+	h := settings.health
+	h.mu.Lock()
+	defer h.mu.Unlock()
+	current := make(map[probeKey]bool)
+	for _, t := range targets {
+		key := probeKey{t.rt.host, t.rt.addr}
+		current[key] = true
+		state := h.probes[key]
+		if state == nil {
+			state = &probeState{}
+			h.probes[key] = state
+		}
+		if state.running || time.Now().Before(state.next) {
+			continue
+		}
+		interval := defaultHealthInterval
+		if t.check.IntervalMs > 0 {
+			interval = millis(t.check.IntervalMs)
+		}
+		state.running, state.next = true, time.Now().Add(interval)
+		go func(t target, state *probeState) {
+			err := probeTarget(t.rt, t.check)
+			h.mu.Lock()
+			state.running = false
+			h.mu.Unlock()
+			setTargetHealth(t.rt, err)
+		}(t, state)
+	}
+	for key := range h.probes {
+		if !current[key] {
+			delete(h.probes, key)
+		}
+	}
+}
+
+// Connect to the target, and GET the check's path if it has one
+func probeTarget(rt route, check HealthCheck) error {
+	ctx, cancel := context.WithTimeout(context.Background(), healthCheckTimeout)
+	defer cancel()
+	conn, err := dialContext(ctx, rt.network, rt.addr, rt.dnsServer)
+	if err != nil || check.Path == "" {
+		if conn != nil {
+			conn.Close()
+		}
+		return err
+	}
+	defer conn.Close()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	path := check.Path
+	if !strings.HasPrefix(path, "/") {
+		path = "/" + path
+	}
+	req, err := http.NewRequestWithContext(ctx, http.MethodGet, "http://"+rt.urlHost(rt.host)+path, nil)
+	if err != nil {
+		return err
+	}
+	if !strings.HasPrefix(rt.host, "*.") {
+		req.Host = rt.host
+	}
+	req.Header.Set("User-Agent", "fhosts-proxy/"+version+" health check")
+	req.Close = true
+	if err := req.Write(conn); err != nil {
+		return err
+	}
+	resp, err := http.ReadResponse(bufio.NewReader(conn), req)
+	if err != nil {
+		return err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return fmt.Errorf("health check returned %s", resp.Status)
+	}
+	return nil
+}
+
+// Record a probe result, telling the extension when a target goes down or
+// comes back
+func setTargetHealth(rt route, err error) {
+	h := rt.settings.health
+	h.mu.Lock()
+	wasDown := h.unhealthy[rt.addr]
+	if err != nil {
+		h.unhealthy[rt.addr] = true
+	} else {
+		delete(h.unhealthy, rt.addr)
+	}
+	h.mu.Unlock()
+
+	switch {
+	case err != nil && !wasDown:
+		logWarn("Target %s for %s is down: %v", rt.addr, rt.host, err)
+		msg := Message{Type: "targetDown", Host: rt.host, Target: rt.addr, Message: err.Error()}
+		sendMessage(msg)
+		rt.settings.hooks.run(msg, rt.host)
+	case err == nil && wasDown:
+		logInfo("Target %s for %s is back up", rt.addr, rt.host)
+		msg := Message{Type: "targetUp", Host: rt.host, Target: rt.addr}
+		sendMessage(msg)
+		rt.settings.hooks.run(msg, rt.host)
+	}
+}
+
+// Drop targets whose last health check failed, or fall back to the real
+// host when none are left
+func healthyTargets(rt route, targets []string) []string {
+	var healthy []string
+	for _, target := range targets {
+		if !rt.settings.health.down(rt.withTarget(target).addr) {
+			healthy = append(healthy, target)
+		}
+	}
+	if len(healthy) == 0 {
+		return []string{originTarget}
+	}
+	return healthy
+}
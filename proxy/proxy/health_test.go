@@ -0,0 +1,30 @@
+package proxy
+
+import "testing"
+
+func TestHealthCheckPort(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	p := New(nil)
+	reply := p.Do(Message{
+		Action:   "updateMappings",
+		Mappings: map[string]string{"default.test": "127.0.0.1", "port.test": "127.0.0.1", "named.test": "127.0.0.1:9000"},
+		Options: map[string]MappingOptions{
+			"default.test": {HealthCheck: &HealthCheck{}},
+			"port.test":    {HealthCheck: &HealthCheck{Port: 8080}},
+			"named.test":   {HealthCheck: &HealthCheck{Port: 8080}},
+		},
+	})
+	if reply.Type != "mappingsUpdated" {
+		t.Fatalf("updateMappings replied %+v", reply)
+	}
+
+	settings := p.currentSettings()
+	p.runHealthChecks(settings)
+	settings.health.mu.Lock()
+	defer settings.health.mu.Unlock()
+	for _, want := range []probeKey{{"default.test", "127.0.0.1:80"}, {"port.test", "127.0.0.1:8080"}, {"named.test", "127.0.0.1:9000"}} {
+		if settings.health.probes[want] == nil {
+			t.Errorf("no probe of %s for %s", want.addr, want.host)
+		}
+	}
+}
@@ -0,0 +1,136 @@
+package proxy
+
+import (
+	"bytes"
+	"context"
+	"encoding/json"
+	"fmt"
+	"os/exec"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"fhosts-proxy/mapping"
+)
+
+// A command run on a proxy event, e.g. to show a desktop notification when
+// a mapped host gets traffic. It receives the event as a JSON message on
+// stdin; its stderr goes to the log.
+type Hook struct {
+	Event   string   `json:"event"`           // started, stopped, mappingHit, targetDown, targetUp or error
+	Hosts   []string `json:"hosts,omitempty"` // mappingHit, targetDown and targetUp: only these hosts, keyed like mappings
+	Command []string `json:"command"`         // Program and its arguments
+}
+
+var hookEvents = map[string]bool{"started": true, "stopped": true, "mappingHit": true, "targetDown": true, "targetUp": true, "error": true}
+
+// At most this many hook commands run at once; events past it are dropped
+// rather than queued, and each command gets hookTimeout to finish
+const (
+	maxRunningHooks = 8
+	hookTimeout     = 30 * time.Second
+)
+
+// A hook with its hosts as a set for mapping.Match
+type activeHook struct {
+	Hook
+	hosts map[string]bool
+}
+
+// The hooks from a proxy's start message
+type hookSet struct {
+	hooks []activeHook
+	hits  bool // Whether one is a mappingHit hook
+}
+
+var (
+	hookSlots = make(chan struct{}, maxRunningHooks)
+	hooksWG   sync.WaitGroup
+
+	// Running proxies with a mappingHit hook, so requests are traced
+	mappingHitHooks atomic.Int32
+)
+
+// Check and index hooks, nil when there are none
+func newHookSet(hooks []Hook) (*hookSet, error) {
+	if len(hooks) == 0 {
+		return nil, nil
+	}
+	set := &hookSet{hooks: make([]activeHook, 0, len(hooks))}
+	for _, hook := range hooks {
+		if !hookEvents[hook.Event] {
+			return nil, fmt.Errorf("unknown hook event %q", hook.Event)
+		}
+		if len(hook.Command) == 0 || hook.Command[0] == "" {
+			return nil, fmt.Errorf("%s hook has no command", hook.Event)
+		}
+		active := activeHook{Hook: hook, hosts: make(map[string]bool, len(hook.Hosts))}
+		for _, host := range hook.Hosts {
+			active.hosts[mapping.NormalizeHost(host)] = true
+		}
+		set.hooks = append(set.hooks, active)
+		set.hits = set.hits || hook.Event == "mappingHit"
+	}
+	return set, nil
+}
+
+// Whether the set has a mappingHit hook
+func (s *hookSet) hasHits() bool {
+	return s != nil && s.hits
+}
+
+// Run the hooks for event in the background. host, when set, is matched
+// against the hooks' hosts. A nil set runs nothing.
+func (s *hookSet) run(event Message, host string) {
+	if s == nil {
+		return
+	}
+	for _, hook := range s.hooks {
+		if hook.Event != event.Type {
+			continue
+		}
+		if host != "" && len(hook.hosts) > 0 {
+			if _, ok := mapping.Match(hook.hosts, host); !ok {
+				continue
+			}
+		}
+		select {
+		case hookSlots <- struct{}{}:
+			hooksWG.Add(1)
+			go runHook(hook.Command, event)
+		default:
+			logDebug("Too many hooks running, skipped %s hook %s", event.Type, hook.Command[0])
+		}
+	}
+}
+
+// Give running hooks up to timeout to finish, so a stopped hook still runs
+// when the process exits
+func waitHooks(timeout time.Duration) {
+	done := make(chan struct{})
+	go func() {
+		hooksWG.Wait()
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(timeout):
+	}
+}
+
+func runHook(command []string, event Message) {
+	defer func() {
+		<-hookSlots
+		hooksWG.Done()
+	}()
+	payload, _ := json.Marshal(event)
+
+	ctx, cancel := context.WithTimeout(context.Background(), hookTimeout)
+	defer cancel()
+	cmd := exec.CommandContext(ctx, command[0], command[1:]...)
+	cmd.Stdin = bytes.NewReader(payload)
+	cmd.Stderr = &logWriter{prefix: command[0] + ": "}
+	if err := cmd.Run(); err != nil {
+		logWarn("%s hook %s failed: %v", event.Type, command[0], err)
+	}
+}
@@ -0,0 +1,115 @@
+package proxy
+
+import (
+	"bufio"
+	"errors"
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"fhosts-proxy/nativemsg"
+)
+
+// Command-line settings of the fhosts-proxy binary
+type Options struct {
+	ImportHosts []string // Hosts-format files merged into the mappings at startup
+	DebugAddr   string   // Loopback address to serve pprof and expvar on
+	ConfigDir   string   // Used instead of fhosts in the user's config directory
+	ServiceUser string   // Windows service: SID of the user it serves
+	AutoStart   bool     // Daemon: start the proxy at launch, not on the first start message
+
+	// Standalone mode only
+	MappingsFile string   // Mappings and rules in the exportConfig format
+	Maps         []string // Extra host=target mappings
+	Port         int      // Listen port, negative for the default
+	IPv6         bool
+	BindAddress  string
+	AllowRemote  bool
+	SystemHosts  bool
+	ProxyAuth    bool
+	AdminPort    int
+}
+
+var options Options
+
+// Apply the command line, environment and config file. Call once, before
+// any of the Run functions.
+func Init(opts Options) {
+	options = opts
+	inheritListeners()
+	applyEnv()
+	loadConfigFile()
+	if opts.DebugAddr != "" {
+		if err := startDebugServer(opts.DebugAddr); err != nil {
+			logWarn("Debug server unavailable: %v", err)
+		}
+	}
+}
+
+// The saved mappings in hosts-file format
+func ExportHosts() string {
+	engine.restoreState()
+	return engine.renderHostsFile()
+}
+
+// Serve the extension over native messaging on stdin and stdout until it
+// disconnects, then exit the process. A running daemon is re-attached to
+// and relayed to instead.
+func RunNativeHost() {
+	setOutput(writeNative)
+	nativeHost = true
+
+	// Re-attach to a running daemon if there is one
+	relay := attachDaemon()
+	if relay == nil {
+		engine.restoreState()
+		if err := engine.importHostsFlags(); err != nil {
+			logWarn("%v", err)
+		}
+		if err := startControl(); err != nil {
+			logWarn("Control socket unavailable: %v", err)
+		}
+	}
+
+	// Send ready message
+	sendMessage(Message{Type: "ready", Protocol: protocolVersion, Version: version, Features: supportedFeatures})
+
+	// Read messages from stdin
+	reader := bufio.NewReader(os.Stdin)
+
+	for {
+		msg, err := readMessage(reader)
+		touchWatchdog()
+		if err != nil {
+			if err == io.EOF || strings.Contains(err.Error(), "file already closed") {
+				// Extension disconnected, clean up and exit. A daemon
+				// keeps running without us.
+				engine.Stop()
+				sendMessage(Message{Type: "stopped"})
+				exit(0)
+			}
+			code := ErrCodeBadMessage
+			if errors.Is(err, nativemsg.ErrFrameTooLarge) {
+				code = ErrCodeFrameTooLarge
+			}
+			sendError(nil, code, "Invalid message: %v", err)
+			continue
+		}
+
+		if relay == nil && msg.Action == "start" && msg.Daemon && !engine.running() {
+			stopControl() // The daemon takes over the socket
+			if err := spawnDaemon(); err != nil {
+				sendMessage(Message{Type: "error", ID: msg.ID, ErrorCode: ErrCodeStartFailed, Message: fmt.Sprintf("Failed to start daemon: %v", err)})
+				startControl()
+				continue
+			}
+			relay = attachDaemon()
+		}
+		if relay != nil {
+			relay.forward(msg)
+			continue
+		}
+		engine.handleMessage(msg, sourceExtension, sendMessage)
+	}
+}
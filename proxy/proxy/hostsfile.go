@@ -0,0 +1,52 @@
+package proxy
+
+import (
+	"fmt"
+	"io"
+	"os"
+	"strings"
+
+	"fhosts-proxy/mapping"
+)
+
+// Merge hosts-file entries from content, or from the file at path when
+// content is empty, into the active mappings. Returns how many were read.
+func (p *Proxy) importHostsFile(path, content string) (int, error) {
+	var r io.Reader = strings.NewReader(content)
+	if content == "" {
+		f, err := os.Open(path)
+		if err != nil {
+			return 0, err
+		}
+		defer f.Close()
+		r = f
+	}
+
+	mappings, err := mapping.ParseHostsFile(r)
+	if err != nil {
+		return 0, err
+	}
+	if err := p.mergeMappings(&Message{Mappings: mappings}); err != nil {
+		return 0, err
+	}
+	return len(mappings), nil
+}
+
+// Merge the files given with -import-hosts
+func (p *Proxy) importHostsFlags() error {
+	for _, path := range options.ImportHosts {
+		n, err := p.importHostsFile(path, "")
+		if err != nil {
+			return fmt.Errorf("failed to import %s: %v", path, err)
+		}
+		logInfo("Imported %d mappings from %s", n, path)
+	}
+	return nil
+}
+
+// Render the active mappings as a hosts-file snippet
+func (p *Proxy) renderHostsFile() string {
+	p.mappingsMu.RLock()
+	defer p.mappingsMu.RUnlock()
+	return mapping.RenderHostsFile(p.hostMappings, p.regexMappings)
+}
@@ -0,0 +1,162 @@
+package proxy
+
+import (
+	"bufio"
+	"fmt"
+	"net"
+	"os"
+	"os/exec"
+	"regexp"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Mapping targets naming a Kubernetes service ("k8s://namespace/service:443",
+// or "k8s://namespace/pod/name:8080" for other resources) are reached
+// through a kubectl port-forward started on first use and kept running.
+// kubectl brings the user's kubeconfig, contexts and auth plugins along;
+// FHOSTS_KUBECTL names the binary when it isn't on the browser's PATH.
+const (
+	k8sScheme        = "k8s://"
+	portForwardReady = 15 * time.Second
+)
+
+type portForward struct {
+	cmd   *exec.Cmd
+	ready chan struct{} // Closed once addr is known or the forward failed
+	addr  string
+	err   error
+}
+
+var (
+	portForwards   = make(map[string]*portForward) // "namespace/resource:port" -> forward
+	portForwardsMu sync.Mutex
+)
+
+var forwardingRe = regexp.MustCompile(`Forwarding from 127\.0\.0\.1:(\d+) ->`)
+
+// Local address of the port-forward for a k8s:// target, starting it if
+// needed. Without a port in the target the requested port is used.
+func k8sAddr(ref, port string) string {
+	namespace, resource, remotePort, err := parseK8sTarget(ref, port)
+	if err != nil {
+		logWarn("Invalid Kubernetes target %q: %v", ref, err)
+		return net.JoinHostPort(ref, port)
+	}
+	key := namespace + "/" + resource + ":" + remotePort
+
+	portForwardsMu.Lock()
+	pf := portForwards[key]
+	if pf == nil {
+		pf = startPortForward(namespace, resource, remotePort)
+		portForwards[key] = pf
+	}
+	portForwardsMu.Unlock()
+
+	select {
+	case <-pf.ready:
+	case <-time.After(portForwardReady):
+		return net.JoinHostPort(resource, remotePort)
+	}
+	if pf.err != nil {
+		portForwardsMu.Lock()
+		if portForwards[key] == pf {
+			delete(portForwards, key) // Try again on the next request
+		}
+		portForwardsMu.Unlock()
+		logWarn("Failed to port-forward %s: %v", key, pf.err)
+		return net.JoinHostPort(resource, remotePort)
+	}
+	return pf.addr
+}
+
+// Split "namespace/service:port" into kubectl's arguments
+func parseK8sTarget(ref, port string) (namespace, resource, remotePort string, err error) {
+	if i := strings.LastIndexByte(ref, ':'); i >= 0 {
+		ref, port = ref[:i], ref[i+1:]
+	}
+	namespace, resource, ok := strings.Cut(ref, "/")
+	if !ok || namespace == "" || resource == "" || port == "" {
+		return "", "", "", fmt.Errorf("expected namespace/service:port")
+	}
+	if !strings.Contains(resource, "/") {
+		resource = "service/" + resource
+	}
+	return namespace, resource, port, nil
+}
+
+// Run kubectl port-forward on a free local port. The forward is dropped
+// from portForwards when kubectl exits, e.g. because the pod went away,
+// so the next request starts a new one.
+func startPortForward(namespace, resource, port string) *portForward {
+	kubectl := os.Getenv("FHOSTS_KUBECTL")
+	if kubectl == "" {
+		kubectl = "kubectl"
+	}
+	pf := &portForward{ready: make(chan struct{})}
+	pf.cmd = exec.Command(kubectl, "port-forward", "--namespace", namespace, "--address", "127.0.0.1", resource, ":"+port)
+	stdout, err := pf.cmd.StdoutPipe()
+	if err == nil {
+		pf.cmd.Stderr = &logWriter{prefix: "kubectl: "}
+		err = pf.cmd.Start()
+	}
+	if err != nil {
+		pf.err = err
+		close(pf.ready)
+		return pf
+	}
+	logInfo("Started port-forward to %s/%s:%s", namespace, resource, port)
+
+	key := namespace + "/" + resource + ":" + port
+	go func() {
+		var once sync.Once
+		scanner := bufio.NewScanner(stdout)
+		for scanner.Scan() {
+			if m := forwardingRe.FindStringSubmatch(scanner.Text()); m != nil {
+				once.Do(func() {
+					pf.addr = net.JoinHostPort("127.0.0.1", m[1])
+					close(pf.ready)
+				})
+			}
+		}
+		err := pf.cmd.Wait()
+		once.Do(func() {
+			pf.err = fmt.Errorf("kubectl exited: %v", err)
+			close(pf.ready)
+		})
+		portForwardsMu.Lock()
+		if portForwards[key] == pf {
+			delete(portForwards, key)
+			logInfo("Port-forward to %s ended", key)
+		}
+		portForwardsMu.Unlock()
+	}()
+	return pf
+}
+
+// Stop every running port-forward
+func stopPortForwards() {
+	portForwardsMu.Lock()
+	defer portForwardsMu.Unlock()
+	for key, pf := range portForwards {
+		if pf.cmd.Process != nil {
+			pf.cmd.Process.Kill()
+		}
+		delete(portForwards, key)
+	}
+}
+
+// Passes a child process's output lines to the log
+type logWriter struct {
+	prefix string
+}
+
+func (w *logWriter) Write(p []byte) (int, error) {
+	for _, line := range strings.Split(strings.TrimRight(string(p), "\n"), "\n") {
+		if line != "" {
+			logDebug("%s%s", w.prefix, line)
+		}
+	}
+	return len(p), nil
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"encoding/xml"
+	"fmt"
+	"os"
+	"strings"
+)
+
+// launchd agent for macOS. "fhosts-proxy -launchd-plist" prints a plist
+// that runs the daemon at login with the proxy started, and relaunches it
+// if it crashes; a stop action from the extension or ctl ends it for the
+// session. Save it as ~/Library/LaunchAgents/com.fhosts.proxy.plist and
+// load it with launchctl.
+const launchdLabel = "com.fhosts.proxy"
+
+const plistTemplate = `<?xml version="1.0" encoding="UTF-8"?>
+<!DOCTYPE plist PUBLIC "-//Apple//DTD PLIST 1.0//EN" "http://www.apple.com/DTDs/PropertyList-1.0.dtd">
+<plist version="1.0">
+<dict>
+	<key>Label</key>
+	<string>%s</string>
+	<key>ProgramArguments</key>
+	<array>
+		<string>%s</string>
+		<string>-daemon</string>
+		<string>-start</string>
+	</array>
+	<key>RunAtLoad</key>
+	<true/>
+	<key>KeepAlive</key>
+	<dict>
+		<key>SuccessfulExit</key>
+		<false/>
+	</dict>
+</dict>
+</plist>
+`
+
+// The launchd agent plist for this executable
+func LaunchdPlist() (string, error) {
+	exe, err := os.Executable()
+	if err != nil {
+		return "", err
+	}
+	var path strings.Builder
+	xml.EscapeText(&path, []byte(exe))
+	return fmt.Sprintf(plistTemplate, launchdLabel, path.String()), nil
+}
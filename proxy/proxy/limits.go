@@ -0,0 +1,57 @@
+package proxy
+
+import (
+	"fmt"
+	"sync/atomic"
+	"time"
+)
+
+const defaultMaxConnections = 1000
+
+// Slots for concurrently proxied connections and tunnels, shared by the
+// process's proxies, plus when the extension was last told the cap was hit
+// (so a runaway page produces one event per second rather than one per
+// refused connection)
+var (
+	connectionSlots  atomic.Pointer[chan struct{}]
+	limitNotifiedAt  atomic.Int64
+	limitEventPeriod = time.Second
+)
+
+// Set the connection cap. Connections already holding a slot keep it.
+func configureConnectionLimit(max int) {
+	if max <= 0 {
+		max = defaultMaxConnections
+	}
+	slots := make(chan struct{}, max)
+	connectionSlots.Store(&slots)
+}
+
+// The active slots, defaultMaxConnections of them until a start sets the cap
+func currentSlots() chan struct{} {
+	if slots := connectionSlots.Load(); slots != nil {
+		return *slots
+	}
+	slots := make(chan struct{}, defaultMaxConnections)
+	connectionSlots.CompareAndSwap(nil, &slots)
+	return *connectionSlots.Load()
+}
+
+// Claim a connection slot, returning the function that releases it. When
+// the cap is reached it returns false and notifies the extension.
+func acquireConnection() (func(), bool) {
+	slots := currentSlots()
+	select {
+	case slots <- struct{}{}:
+		return func() { <-slots }, true
+	default:
+	}
+
+	now := time.Now().UnixNano()
+	last := limitNotifiedAt.Load()
+	if now-last >= int64(limitEventPeriod) && limitNotifiedAt.CompareAndSwap(last, now) {
+		limit := cap(slots)
+		sendMessage(Message{Type: "connectionLimit", Count: limit, Message: fmt.Sprintf("Connection limit of %d reached", limit)})
+	}
+	return nil, false
+}
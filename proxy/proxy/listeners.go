@@ -0,0 +1,95 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// An extra entry point requested by a start message's listeners, so
+// browsers or profiles on one machine can each use their own port into the
+// same mappings. In the started message every bound listener is listed,
+// the main proxy port included.
+type Listener struct {
+	Type    string `json:"type"`              // http (proxy and PAC), socks, tcp or admin
+	Port    int    `json:"port"`              // 0 lets the OS pick one; admin needs a port
+	Host    string `json:"host,omitempty"`    // tcp: host:port connections are forwarded to, through the mappings
+	Address string `json:"address,omitempty"` // Bound address, in the started message
+}
+
+// Bind the extra listeners of a start message on host. HTTP listeners
+// are returned for the proxy server to serve, SOCKS and TCP ones accept
+// right away and an admin one only sets msg.AdminPort. On failure nothing
+// stays bound.
+func (p *Proxy) bindListeners(msg *Message, host string) (extra []net.Listener, err error) {
+	var accepting []net.Listener
+	defer func() {
+		if err != nil {
+			for _, l := range append(extra, accepting...) {
+				l.Close()
+			}
+			extra = nil
+		}
+	}()
+
+	for _, spec := range msg.Listeners {
+		if spec.Port < 0 || spec.Port > 65535 {
+			return extra, fmt.Errorf("%w: %d", errInvalidPort, spec.Port)
+		}
+		switch spec.Type {
+		case "http":
+			l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(spec.Port)))
+			if err != nil {
+				return extra, err
+			}
+			extra = append(extra, l)
+		case "socks":
+			l, err := p.addSocksListener(host, spec.Port)
+			if err != nil {
+				return extra, err
+			}
+			accepting = append(accepting, l)
+		case "tcp":
+			l, err := p.addTCPForward(spec.Port, spec.Host)
+			if err != nil {
+				return extra, err
+			}
+			accepting = append(accepting, l)
+		case "admin":
+			if spec.Port == 0 {
+				return extra, fmt.Errorf("admin listener needs a port")
+			}
+			if msg.AdminPort != 0 && msg.AdminPort != spec.Port {
+				return extra, fmt.Errorf("only one admin listener can run")
+			}
+			msg.AdminPort = spec.Port
+		default:
+			return extra, fmt.Errorf("unknown listener type %q", spec.Type)
+		}
+	}
+	return extra, nil
+}
+
+// Every listener the running proxy accepts on, for the started message
+func (p *Proxy) boundListeners() []Listener {
+	var bound []Listener
+	add := func(kind string, addr *net.TCPAddr) {
+		bound = append(bound, Listener{Type: kind, Port: addr.Port, Address: addr.String()})
+	}
+	for _, l := range append(p.listeners[:len(p.listeners):len(p.listeners)], p.extra...) {
+		add("http", l.Addr().(*net.TCPAddr))
+	}
+	for _, l := range p.socksListeners {
+		add("socks", l.Addr().(*net.TCPAddr))
+	}
+	for _, f := range p.tcpForwards {
+		addr := f.Addr().(*net.TCPAddr)
+		bound = append(bound, Listener{Type: "tcp", Port: addr.Port, Host: f.target, Address: addr.String()})
+	}
+	adminInfoMu.Lock()
+	defer adminInfoMu.Unlock()
+	if adminAddr != nil {
+		add("admin", adminAddr)
+	}
+	return bound
+}
@@ -0,0 +1,124 @@
+package proxy
+
+import (
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Log levels, lowest first
+const (
+	levelDebug int32 = iota
+	levelInfo
+	levelWarn
+	levelError
+)
+
+var levelNames = []string{"debug", "info", "warn", "error"}
+
+// Log events are batched into one digest per logDigestPeriod, with at most
+// maxLogBatch lines each; anything beyond that is counted and dropped so a
+// busy page can't flood the extension.
+const (
+	logDigestPeriod = 500 * time.Millisecond
+	maxLogBatch     = 100
+)
+
+// One line in a log digest
+type LogEntry struct {
+	Level   string `json:"level"`
+	Message string `json:"message"`
+	Time    int64  `json:"time"` // Unix milliseconds
+}
+
+var (
+	logMu        sync.Mutex
+	logFile      *rotatingFile // Optional copy of every line sent, from FHOSTS_LOG_FILE
+	logLevel     = levelInfo   // Lowest level sent
+	pendingLogs  []LogEntry
+	droppedLogs  int
+	logFlushOnce sync.Once
+)
+
+// Parse a setLogLevel value
+func parseLogLevel(name string) (int32, error) {
+	for i, n := range levelNames {
+		if strings.EqualFold(name, n) {
+			return int32(i), nil
+		}
+	}
+	return 0, fmt.Errorf("unknown log level %q", name)
+}
+
+// Queue a log line for the next digest if level is enabled
+func logAt(level int32, format string, args ...interface{}) {
+	logMu.Lock()
+	defer logMu.Unlock()
+	if level < logLevel {
+		return
+	}
+	message := fmt.Sprintf(format, args...)
+	if logFile != nil {
+		fmt.Fprintf(logFile, "%s %-5s %s\n", time.Now().Format(time.RFC3339), levelNames[level], message)
+	}
+	logFlushOnce.Do(func() { go flushLogs() })
+	if len(pendingLogs) >= maxLogBatch {
+		droppedLogs++
+		return
+	}
+	pendingLogs = append(pendingLogs, LogEntry{
+		Level:   levelNames[level],
+		Message: message,
+		Time:    time.Now().UnixMilli(),
+	})
+}
+
+func logDebug(format string, args ...interface{}) { logAt(levelDebug, format, args...) }
+func logInfo(format string, args ...interface{})  { logAt(levelInfo, format, args...) }
+func logWarn(format string, args ...interface{})  { logAt(levelWarn, format, args...) }
+
+// Append log lines to a file as well as sending them to the extension
+func openLogFile(path string) error {
+	f, err := openRotatingFile(path)
+	if err != nil {
+		return err
+	}
+	logMu.Lock()
+	logFile = f
+	logMu.Unlock()
+	return nil
+}
+
+// Change the lowest level sent to the extension
+func setLogLevel(name string) error {
+	level, err := parseLogLevel(name)
+	if err != nil {
+		return err
+	}
+	logMu.Lock()
+	logLevel = level
+	logMu.Unlock()
+	return nil
+}
+
+// Send queued log lines as one digest message per period
+func flushLogs() {
+	ticker := time.NewTicker(logDigestPeriod)
+	defer ticker.Stop()
+	for range ticker.C {
+		logMu.Lock()
+		logs, dropped := pendingLogs, droppedLogs
+		pendingLogs, droppedLogs = nil, 0
+		logMu.Unlock()
+
+		if len(logs) == 0 && dropped == 0 {
+			continue
+		}
+		msg := Message{Type: "log", Logs: logs, Count: dropped}
+		if dropped > 0 {
+			msg.Message = fmt.Sprintf("%d log lines dropped", dropped)
+		}
+		sendMessage(msg)
+	}
+}
@@ -0,0 +1,461 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"maps"
+	"net"
+	"slices"
+	"strings"
+
+	"fhosts-proxy/mapping"
+)
+
+// Cap on host plus regex mappings, so lookups and PAC scripts stay small
+const maxMappings = 10000
+
+// Per-host options, keyed like mappings (exact or "*.example.com")
+type MappingOptions struct {
+	H2C  bool `json:"h2c,omitempty"`  // Speak cleartext HTTP/2 to the target
+	MITM bool `json:"mitm,omitempty"` // Terminate TLS with a cert from the local CA
+
+	// Throughput cap in kilobits per second for each direction, shared by
+	// all of the host's connections
+	MaxKbps int `json:"maxKbps,omitempty"`
+
+	// Artificial delay before dialing or forwarding, plus a random extra
+	// of up to JitterMs
+	LatencyMs int `json:"latencyMs,omitempty"`
+	JitterMs  int `json:"jitterMs,omitempty"`
+
+	// Rewrite redirects and cookie domains naming the target back to the
+	// original host
+	RewriteRedirects bool `json:"rewriteRedirects,omitempty"`
+
+	// Scheme to forward CONNECTed traffic with. "http" terminates TLS like
+	// MITM and sends plain HTTP to the target (e.g. a local dev server).
+	Scheme string `json:"scheme,omitempty"`
+
+	// Host header sent to the target: "original", the default, keeps the
+	// browser's for virtual-hosted backends; "target" sends the mapped
+	// address instead, for backends that only answer to their own name
+	HostHeader string `json:"hostHeader,omitempty"`
+
+	// Raw TCP service (database, SMTP, custom protocol): CONNECTs to the
+	// host may use any port, skipping connectPorts, and are always
+	// tunneled as they are
+	TCP bool `json:"tcp,omitempty"`
+
+	// Ask the target for uncompressed responses (Accept-Encoding:
+	// identity), so body rules can edit bodies in encodings the proxy
+	// doesn't decode, like brotli
+	NoCompression bool `json:"noCompression,omitempty"`
+
+	// Spread a multi-target mapping across its targets, "roundRobin" or
+	// "weighted" by Weights (one per target, in order), skipping targets
+	// that recently failed. By default targets are tried in order.
+	Balance string `json:"balance,omitempty"`
+	Weights []int  `json:"weights,omitempty"`
+
+	// Probe the targets periodically, reporting targetDown and targetUp
+	// events
+	HealthCheck *HealthCheck `json:"healthCheck,omitempty"`
+
+	// Certificate to present when the target asks for one (MITM mode)
+	ClientCert *ClientCert `json:"clientCert,omitempty"`
+
+	// Accept any certificate from the target (MITM mode), for self-signed
+	// staging servers. Logged loudly since it allows interception.
+	InsecureSkipVerify bool `json:"insecureSkipVerify,omitempty"`
+
+	// Inject faults: dropped connections, error responses, truncated bodies
+	// and reset tunnels
+	Chaos *Chaos `json:"chaos,omitempty"`
+
+	// file:// mappings: serve the root index.html for extensionless paths
+	// that match no file
+	SPA bool `json:"spa,omitempty"`
+}
+
+// The result of resolving a request's host through the mappings
+type route struct {
+	host    string // Requested hostname, normalized
+	network string // "tcp", "unix" for unix:// or "file" for file:// mapping values
+	addr    string // Address (or socket path or directory) to dial
+	mapped  bool   // Whether a mapping matched
+	options MappingOptions
+	blocked *BlockRule // Set when the host is blocked
+	headers HeaderRules
+	mocks   []MockRule
+	// Response body edits
+	bodyRules []BodyRule
+
+	// DNS server (host:port) to resolve addr's hostname with, from a
+	// "target@server" mapping value. Empty means the system resolver.
+	dnsServer string
+
+	// A docker:// or k8s:// target, re-resolved when a dial fails
+	dynamic string
+
+	// Unmapped while blockPrivate is on: only public addresses are dialed
+	guarded bool
+
+	// Parent proxy to dial through, nil to dial directly
+	parent *parentConfig
+
+	// Set offline with setHostOffline: dials fail as if refused
+	offline bool
+
+	// Settings of the proxy that resolved the route
+	settings *proxySettings
+
+	// Failover targets not tried yet, and the requested host and port
+	// they are resolved against
+	pending       []string
+	requestedHost string
+	requestedPort string
+}
+
+func (rt route) clientCert() ClientCert {
+	if rt.options.ClientCert == nil {
+		return ClientCert{}
+	}
+	return *rt.options.ClientCert
+}
+
+// Whether CONNECTs along this route are terminated here instead of tunneled
+func (rt route) terminatesTLS() bool {
+	if rt.options.TCP {
+		return false
+	}
+	return rt.options.MITM || rt.options.Scheme == "http" || rt.network == "file"
+}
+
+// Dial the route's target, failing over to the next targets in order.
+// Returns the route of the target that answered.
+func (rt route) dial() (net.Conn, route, error) {
+	if rt.offline {
+		return nil, rt, offlineError()
+	}
+	if rt.network == "file" {
+		return nil, rt, errFileTarget
+	}
+	for {
+		conn, err := rt.dialOnce(context.Background())
+		markTarget(rt, err)
+		if err == nil {
+			return conn, rt, nil
+		}
+		if fresh, ok := rt.reresolved(); ok {
+			rt = fresh
+			continue
+		}
+		next, ok := rt.next()
+		if !ok {
+			return nil, rt, err
+		}
+		logWarn("Failed to connect to %s for %s, failing over to %s: %v", rt.addr, rt.host, next.addr, err)
+		rt = next
+	}
+}
+
+// Dial the route's current target: through the parent proxy, or directly
+// with mapping targets resolved through the DNS cache
+func (rt route) dialOnce(ctx context.Context) (net.Conn, error) {
+	switch {
+	case rt.parent != nil:
+		return rt.parent.dial(ctx, rt.addr, rt.guarded)
+	case rt.guarded:
+		return dialPublic(ctx, rt.network, rt.addr)
+	case !rt.mapped:
+		return shared().dialer.DialContext(ctx, rt.network, rt.addr)
+	default:
+		return dialContext(ctx, rt.network, rt.addr, rt.dnsServer)
+	}
+}
+
+// The route re-resolved after its dial failed, if its target is a Docker
+// container or Kubernetes port-forward that has moved since
+func (rt route) reresolved() (route, bool) {
+	if rt.dynamic == "" {
+		return rt, false
+	}
+	addr := resolveDynamic(rt.dynamic, rt.requestedPort)
+	if addr == rt.addr {
+		return rt, false
+	}
+	rt.addr = addr
+	return rt, true
+}
+
+// The route to the next failover target, if there is one
+func (rt route) next() (route, bool) {
+	if len(rt.pending) == 0 {
+		return rt, false
+	}
+	next := rt.withTarget(rt.pending[0])
+	next.pending = rt.pending[1:]
+	return next, true
+}
+
+// Socket path for Unix socket routes, empty otherwise
+func (rt route) unixPath() string {
+	if rt.network == "unix" {
+		return rt.addr
+	}
+	return ""
+}
+
+// Host to put in a forwarded request URL. Unix socket and file routes keep
+// the original host since their path is not a URL authority.
+func (rt route) urlHost(original string) string {
+	if rt.network != "tcp" {
+		return original
+	}
+	return rt.addr
+}
+
+// Host header for a request forwarded along the route, given the one the
+// browser sent. Unix socket and file routes always keep the original.
+func (rt route) hostHeader(original string) string {
+	if rt.options.HostHeader == "target" && rt.network == "tcp" {
+		return rt.addr
+	}
+	return original
+}
+
+// Replace the active mapping set with the one in a start or
+// updateMappings message, over the config file's static mappings
+func (p *Proxy) setMappings(msg *Message) error {
+	msg = p.withStaticMappings(msg)
+	if n := len(msg.Mappings) + len(msg.Regex); n > maxMappings {
+		return fmt.Errorf("%d mappings exceeds the limit of %d", n, maxMappings)
+	}
+	compiled, err := mapping.CompileRegex(msg.Regex)
+	if err != nil {
+		return err
+	}
+	bodies, err := compileBodyRules(msg.BodyRules)
+	if err != nil {
+		return err
+	}
+
+	p.mappingsMu.Lock()
+	p.hostMappings = mapping.NormalizeKeys(msg.Mappings)
+	p.disabledMappings = mapping.NormalizeKeys(msg.Disabled)
+	p.regexMappings = compiled
+	p.mappingOptions = mapping.NormalizeKeys(msg.Options)
+	p.blockedHosts = mapping.NormalizeKeys(msg.Blocked)
+	p.headerRules = mapping.NormalizeKeys(msg.HeaderRules)
+	p.mockRules = mapping.NormalizeKeys(msg.Mocks)
+	p.bodyRules = bodies
+	p.mappingsRevision++
+	p.mappingsMu.Unlock()
+	return nil
+}
+
+// Whether a message carries a mapping set at all. A start message without
+// one keeps the set restored from the state file.
+func carriesMappings(msg *Message) bool {
+	return msg.Mappings != nil || msg.Regex != nil || msg.Options != nil ||
+		msg.Blocked != nil || msg.HeaderRules != nil || msg.Mocks != nil || msg.BodyRules != nil ||
+		msg.Disabled != nil
+}
+
+// Merge the entries of an addMappings message into the active set,
+// replacing host-keyed entries with the same key and regex rules with the
+// same pattern. New regex rules are tried after the existing ones.
+func (p *Proxy) mergeMappings(msg *Message) error {
+	compiled, err := mapping.CompileRegex(msg.Regex)
+	if err != nil {
+		return err
+	}
+	bodies, err := compileBodyRules(msg.BodyRules)
+	if err != nil {
+		return err
+	}
+	p.mappingsMu.Lock()
+	defer p.mappingsMu.Unlock()
+
+	regex := slices.Clone(p.regexMappings)
+	for _, rule := range compiled {
+		i := slices.IndexFunc(regex, func(r mapping.Regex) bool { return r.Pattern() == rule.Pattern() })
+		if i >= 0 {
+			regex[i] = rule
+		} else {
+			regex = append(regex, rule)
+		}
+	}
+	n := len(p.hostMappings) + len(regex)
+	for key := range msg.Mappings {
+		if _, ok := p.hostMappings[mapping.NormalizeHost(key)]; !ok {
+			n++
+		}
+	}
+	if n > maxMappings {
+		return fmt.Errorf("%d mappings exceeds the limit of %d", n, maxMappings)
+	}
+	p.regexMappings = regex
+
+	for key, target := range msg.Mappings {
+		p.hostMappings[mapping.NormalizeHost(key)] = target
+		delete(p.disabledMappings, mapping.NormalizeHost(key))
+	}
+	for key, options := range msg.Options {
+		p.mappingOptions[mapping.NormalizeHost(key)] = options
+	}
+	for key, block := range msg.Blocked {
+		p.blockedHosts[mapping.NormalizeHost(key)] = block
+	}
+	for key, rules := range msg.HeaderRules {
+		p.headerRules[mapping.NormalizeHost(key)] = rules
+	}
+	for key, rules := range msg.Mocks {
+		p.mockRules[mapping.NormalizeHost(key)] = rules
+	}
+	maps.Copy(p.bodyRules, bodies)
+	p.mappingsRevision++
+	return nil
+}
+
+// Delete hosts' entries from all host-keyed tables
+func (p *Proxy) deleteMappings(hosts []string) {
+	p.mappingsMu.Lock()
+	defer p.mappingsMu.Unlock()
+
+	for _, host := range hosts {
+		key := mapping.NormalizeHost(host)
+		delete(p.hostMappings, key)
+		delete(p.disabledMappings, key)
+		delete(p.mappingOptions, key)
+		delete(p.blockedHosts, key)
+		delete(p.headerRules, key)
+		delete(p.mockRules, key)
+		delete(p.bodyRules, key)
+	}
+	p.mappingsRevision++
+}
+
+// Switch host mappings off (or back on), moving them out of (or back into)
+// the routing table. Hosts with no such mapping are ignored.
+func (p *Proxy) setMappingsEnabled(hosts []string, enabled bool) {
+	p.mappingsMu.Lock()
+	defer p.mappingsMu.Unlock()
+
+	from, to := p.hostMappings, p.disabledMappings
+	if enabled {
+		from, to = p.disabledMappings, p.hostMappings
+	}
+	for _, host := range hosts {
+		key := mapping.NormalizeHost(host)
+		if target, ok := from[key]; ok {
+			to[key] = target
+			delete(from, key)
+		}
+	}
+	p.mappingsRevision++
+}
+
+// Number of active mapping rules and the current revision
+func (p *Proxy) mappingsState() (int, int64) {
+	p.mappingsMu.RLock()
+	defer p.mappingsMu.RUnlock()
+	return len(p.hostMappings) + len(p.regexMappings), p.mappingsRevision
+}
+
+// Find the mapping for a hostname: exact and wildcard keys first, then regex
+// rules in order. Callers must hold p.mappingsMu.
+func (p *Proxy) lookupMapping(hostname string) (string, bool) {
+	return mapping.Lookup(p.hostMappings, p.regexMappings, hostname)
+}
+
+// Resolve the route for hostname:port. A mapping value may carry its own
+// port ("127.0.0.1:8443", "[::1]:8443"), which replaces the client's port,
+// name a Unix socket ("unix:///var/run/app.sock"), a Docker container
+// ("docker://my-api:8080") or a Kubernetes service ("k8s://ns/api:443").
+// A hostname target may name the DNS server to resolve it with
+// ("internal.example.com@10.0.0.53", port 53 unless given).
+// A list of targets ("10.0.0.5,10.0.0.6,origin") is tried in order,
+// "origin" meaning the real host, unless the mapping balances across them.
+// IPv6 targets come back bracketed and ready for net.Dial.
+func (p *Proxy) resolveRoute(hostname, port string) route {
+	settings := p.currentSettings()
+	offline := p.isOffline(mapping.NormalizeHost(hostname))
+	if p.paused.Load() {
+		return route{host: mapping.NormalizeHost(hostname), network: "tcp", addr: net.JoinHostPort(mapping.Unbracket(hostname), port), guarded: settings.blockPrivate, parent: settings.parentFor(hostname), offline: offline, settings: settings}
+	}
+
+	p.mappingsMu.RLock()
+	mapped, ok := p.lookupMapping(hostname)
+	options, _ := mapping.Match(p.mappingOptions, mapping.NormalizeHost(hostname))
+	block, blocked := mapping.Match(p.blockedHosts, mapping.NormalizeHost(hostname))
+	headers, _ := mapping.Match(p.headerRules, mapping.NormalizeHost(hostname))
+	mocks, _ := mapping.Match(p.mockRules, mapping.NormalizeHost(hostname))
+	bodies, _ := mapping.Match(p.bodyRules, mapping.NormalizeHost(hostname))
+	p.mappingsMu.RUnlock()
+	if !ok && settings.systemHosts {
+		mapped, ok = lookupSystemHosts(hostname)
+	}
+
+	rt := route{
+		host:          mapping.NormalizeHost(hostname),
+		network:       "tcp",
+		mapped:        ok,
+		options:       options,
+		headers:       headers,
+		mocks:         mocks,
+		bodyRules:     bodies,
+		requestedHost: hostname,
+		requestedPort: port,
+		offline:       offline,
+		settings:      settings,
+	}
+	if blocked {
+		rt.blocked = &block
+	}
+	if !ok {
+		rt.guarded = settings.blockPrivate
+		return rt.withTarget(originTarget)
+	}
+	targets := strings.Split(mapped, ",")
+	for i := range targets {
+		targets[i] = strings.TrimSpace(targets[i])
+	}
+	if options.HealthCheck != nil && options.HealthCheck.FallbackToOrigin {
+		targets = healthyTargets(rt, targets)
+	}
+	targets = balanceTargets(rt, targets)
+	rt = rt.withTarget(targets[0])
+	rt.pending = targets[1:]
+	return rt
+}
+
+// Failover target naming the requested host itself
+const originTarget = "origin"
+
+// The route with its dial address set from one mapping target
+func (rt route) withTarget(target string) route {
+	rt.network, rt.dnsServer, rt.dynamic, rt.parent = "tcp", "", "", nil
+	if i := strings.LastIndexByte(target, '@'); i > 0 && i < len(target)-1 && !strings.Contains(target, "://") {
+		target, rt.dnsServer = target[:i], withDefaultPort(target[i+1:], "53")
+	}
+	switch host, mappedPort, err := net.SplitHostPort(target); {
+	case strings.HasPrefix(target, "unix://"):
+		rt.network = "unix"
+		rt.addr = strings.TrimPrefix(target, "unix://")
+	case strings.HasPrefix(target, fileScheme):
+		rt.network = "file"
+		rt.addr = fileRoot(target)
+	case strings.HasPrefix(target, dockerScheme), strings.HasPrefix(target, k8sScheme):
+		rt.dynamic = target
+		rt.addr = resolveDynamic(target, rt.requestedPort)
+	case target == originTarget:
+		rt.addr = net.JoinHostPort(mapping.Unbracket(rt.requestedHost), rt.requestedPort)
+		rt.parent = rt.settings.parentFor(rt.requestedHost)
+	case err == nil:
+		rt.addr = net.JoinHostPort(host, mappedPort)
+	default:
+		rt.addr = net.JoinHostPort(mapping.Unbracket(target), rt.requestedPort)
+	}
+	return rt
+}
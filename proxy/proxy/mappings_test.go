@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+
+	"fhosts-proxy/mapping"
+)
+
+func TestWithTargetIPv6(t *testing.T) {
+	tests := []struct {
+		name, host, port, target string
+		want                     string
+	}{
+		{"bare literal", "app.test", "443", "::1", "[::1]:443"},
+		{"bracketed literal", "app.test", "443", "[::1]", "[::1]:443"},
+		{"literal with port", "app.test", "443", "[::1]:8443", "[::1]:8443"},
+		{"literal with DNS server", "app.test", "80", "[::1]:8080@[::1]:5353", "[::1]:8080"},
+		{"origin of literal host", "[::1]", "8080", originTarget, "[::1]:8080"},
+		{"origin of bare host", "::1", "8080", originTarget, "[::1]:8080"},
+	}
+	for _, tt := range tests {
+		t.Run(tt.name, func(t *testing.T) {
+			rt := route{requestedHost: tt.host, requestedPort: tt.port}.withTarget(tt.target)
+			if rt.network != "tcp" || rt.addr != tt.want {
+				t.Errorf("withTarget(%q) = %s %s, want tcp %s", tt.target, rt.network, rt.addr, tt.want)
+			}
+		})
+	}
+}
+
+// Handler answering with the Host header it was sent
+var echoHost = http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+	io.WriteString(w, r.Host)
+})
+
+func TestHostHeaderHTTP(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	backend := httptest.NewServer(echoHost)
+	defer backend.Close()
+	target := strings.TrimPrefix(backend.URL, "http://")
+
+	for _, tt := range []struct{ mode, want string }{
+		{"", "app.test"},
+		{"original", "app.test"},
+		{"target", target},
+	} {
+		t.Run("mode "+tt.mode, func(t *testing.T) {
+			p := New(nil)
+			port := 0
+			err := p.Start(context.Background(), Message{
+				Port:     &port,
+				Mappings: map[string]string{"app.test": target},
+				Options:  map[string]MappingOptions{"app.test": {HostHeader: tt.mode}},
+			})
+			if err != nil {
+				t.Fatal(err)
+			}
+			defer p.Stop()
+			if got, err := getVia(p.Port(), "http://app.test/"); err != nil || got != tt.want {
+				t.Errorf("backend saw Host %q, %v; want %q", got, err, tt.want)
+			}
+		})
+	}
+}
+
+func TestHostHeaderMITM(t *testing.T) {
+	for _, mode := range []string{"original", "target"} {
+		t.Run("mode "+mode, func(t *testing.T) {
+			p := startMITMProxy(t, echoHost, MappingOptions{HostHeader: mode})
+			want := "secure.test"
+			if mode == "target" {
+				want = p.resolveRoute("secure.test", "443").addr
+			}
+
+			conn := dialMITM(t, p.Port(), "secure.test")
+			io.WriteString(conn, "GET / HTTP/1.1\r\nHost: secure.test\r\n\r\n")
+			resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+			if err != nil {
+				t.Fatal(err)
+			}
+			body, _ := io.ReadAll(resp.Body)
+			resp.Body.Close()
+			if string(body) != want {
+				t.Errorf("backend saw Host %q, want %q", body, want)
+			}
+		})
+	}
+}
+
+func TestMergeMappingsRegex(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	p := New(nil)
+	add := func(rules ...mapping.RegexMapping) {
+		t.Helper()
+		if reply := p.Do(Message{Action: "addMappings", Regex: rules}); reply.Type != "mappingsUpdated" {
+			t.Fatalf("addMappings replied %+v", reply)
+		}
+	}
+	add(mapping.RegexMapping{Pattern: `^api\d+\.test$`, Target: "127.0.0.1:4000"})
+	add(mapping.RegexMapping{Pattern: `^web\.test$`, Target: "127.0.0.1:5000"}, mapping.RegexMapping{Pattern: `^api\d+\.test$`, Target: "127.0.0.1:4001"})
+
+	for host, want := range map[string]string{"api1.test": "127.0.0.1:4001", "web.test": "127.0.0.1:5000"} {
+		if rt := p.resolveRoute(host, "80"); !rt.mapped || rt.addr != want {
+			t.Errorf("%s routes to %s (mapped %v), want %s", host, rt.addr, rt.mapped, want)
+		}
+	}
+	if n, _ := p.mappingsState(); n != 2 {
+		t.Errorf("%d mappings after replacing a regex rule, want 2", n)
+	}
+	if reply := p.Do(Message{Action: "addMappings", Regex: []mapping.RegexMapping{{Pattern: "("}}}); reply.Type != "error" {
+		t.Errorf("invalid regex: addMappings replied %+v", reply)
+	}
+}
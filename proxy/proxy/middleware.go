@@ -0,0 +1,179 @@
+package proxy
+
+import (
+	"errors"
+	"fmt"
+	"net/http"
+	"sync"
+)
+
+// A step in the chain every connection and request passes through, in the
+// order the start message's middleware list gives. Blocking, throttling
+// and latency, fault injection, header rewriting, mock responses, body
+// rewriting and record-and-replay are built in as "block", "throttle",
+// "chaos", "headers", "mock", "rewrite" and "tape"; programs embedding the
+// proxy add their own with RegisterMiddleware. Middleware are called from
+// many goroutines at once.
+type Middleware interface {
+	// Decide on a CONNECT tunnel or SOCKS connection before the target is
+	// dialed. A non-nil error refuses it.
+	OnConnect(f *Flow) error
+
+	// Edit a plain HTTP or MITM request before it is forwarded. A non-nil
+	// error refuses it; a non-nil response answers it, and the target is
+	// never contacted.
+	OnRequest(f *Flow, req *http.Request) (*http.Response, error)
+
+	// Edit a response before it reaches the client. Runs in reverse chain
+	// order, and only for middleware whose OnRequest ran.
+	OnResponse(f *Flow, req *http.Request, resp *http.Response)
+}
+
+// Returned by middleware to choose how a refused connection or request is
+// answered. Status defaults to 403; Reset drops the connection with a TCP
+// reset instead. Other errors are answered with 403.
+type Refusal struct {
+	Status int
+	Reset  bool
+}
+
+func (r *Refusal) Error() string {
+	status := r.Status
+	if status == 0 {
+		status = http.StatusForbidden
+	}
+	return fmt.Sprintf("refused with %d", status)
+}
+
+// What middleware see of a connection or request
+type Flow struct {
+	Kind   string // connect, socks, http or mitm
+	Client string // Client address
+	Host   string // Requested hostname, normalized
+	Target string // Address the request is routed to
+	Mapped bool   // Whether a mapping matched Host
+
+	route    route
+	chain    []Middleware // The proxy's, kept should a restart reorder it
+	tapePath string       // Recording the response goes to
+
+	// Limiters for the flow's tunnel, set by the throttle middleware
+	up, down *rateLimiter
+}
+
+func newFlow(kind, client string, rt route) *Flow {
+	return &Flow{Kind: kind, Client: client, Host: rt.host, Target: rt.addr, Mapped: rt.mapped, route: rt, chain: rt.settings.chain}
+}
+
+var errUnknownMiddleware = errors.New("unknown middleware")
+
+var (
+	middlewareMu sync.RWMutex
+	registered   = map[string]Middleware{"block": blockMiddleware{}, "throttle": throttleMiddleware{}, "chaos": chaosMiddleware{}, "headers": headerMiddleware{}, "mock": mockMiddleware{}, "rewrite": rewriteMiddleware{}, "tape": tapeMiddleware{}}
+	// Registration order, the chain's order when start names none. The
+	// tape comes last so it records responses before they are rewritten,
+	// and chaos early so its truncation sees the final body. Throttling
+	// follows blocking, so only refused requests skip the latency.
+	registeredNames = []string{"block", "throttle", "chaos", "headers", "mock", "rewrite", "tape"}
+)
+
+// Make m available to the chain under name. Without a middleware list in
+// the start message it runs after the built-ins, in registration order.
+// Call it before Start, typically from an init function; it panics if name
+// is taken.
+func RegisterMiddleware(name string, m Middleware) {
+	middlewareMu.Lock()
+	defer middlewareMu.Unlock()
+	if m == nil {
+		panic("proxy: RegisterMiddleware with nil middleware")
+	}
+	if _, taken := registered[name]; taken {
+		panic("proxy: RegisterMiddleware called twice for " + name)
+	}
+	registered[name] = m
+	registeredNames = append(registeredNames, name)
+}
+
+// Build the chain from registered middleware names. Empty names uses every
+// registered middleware; built-ins left out of a list are switched off.
+func buildChain(names []string) ([]Middleware, error) {
+	middlewareMu.RLock()
+	defer middlewareMu.RUnlock()
+	if len(names) == 0 {
+		names = registeredNames
+	}
+	chain := make([]Middleware, 0, len(names))
+	for _, name := range names {
+		m, ok := registered[name]
+		if !ok {
+			return nil, fmt.Errorf("%w %q", errUnknownMiddleware, name)
+		}
+		chain = append(chain, m)
+	}
+	return chain, nil
+}
+
+// Run the chain's OnConnect, stopping at the first refusal
+func connectChain(f *Flow) error {
+	for _, m := range f.chain {
+		if err := m.OnConnect(f); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// Run the chain's OnRequest, stopping at the first refusal or answer. An
+// answer has already passed back through OnResponse.
+func requestChain(f *Flow, req *http.Request) (*http.Response, error) {
+	for i, m := range f.chain {
+		resp, err := m.OnRequest(f, req)
+		if err != nil {
+			return nil, err
+		}
+		if resp != nil {
+			if resp.StatusCode == 0 {
+				resp.StatusCode = http.StatusOK
+			}
+			if resp.Header == nil {
+				resp.Header = make(http.Header)
+			}
+			if resp.Body == nil {
+				resp.Body = http.NoBody
+			}
+			unwind(f.chain[:i], f, req, resp)
+			return resp, nil
+		}
+	}
+	return nil, nil
+}
+
+// Run the chain's OnResponse on a target's response
+func responseChain(f *Flow, req *http.Request, resp *http.Response) {
+	unwind(f.chain, f, req, resp)
+}
+
+// Run OnResponse from the end of ms back
+func unwind(ms []Middleware, f *Flow, req *http.Request, resp *http.Response) {
+	for i := len(ms) - 1; i >= 0; i-- {
+		ms[i].OnResponse(f, req, resp)
+	}
+}
+
+// How a refusal asks for the client to be answered
+func refusalFor(err error) Refusal {
+	var refusal *Refusal
+	if errors.As(err, &refusal) {
+		return *refusal
+	}
+	return Refusal{}
+}
+
+// Send a middleware's answer to r in place of the target's response
+func writeAnswer(w http.ResponseWriter, r *http.Request, resp *http.Response, rt route, trace *trafficTrace, capture *harCapture) {
+	defer resp.Body.Close()
+	resp.Body = capture.responseBody(resp.Body)
+	n := writeResponse(w, resp, rt)
+	trace.finish(r.Method, rt, resp.StatusCode, n)
+	capture.finish(resp, rt)
+}
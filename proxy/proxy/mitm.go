@@ -0,0 +1,119 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"sync"
+
+	"fhosts-proxy/mapping"
+)
+
+// Terminate TLS on a hijacked CONNECT using a certificate minted for the
+// requested host, then forward each decrypted request to the mapped target
+func handleMITM(clientConn net.Conn, host string, rt route) {
+	activeTunnels.Add(1)
+	defer activeTunnels.Add(-1)
+	conn := trackConnection("mitm", clientConn.RemoteAddr().String(), rt, func() { clientConn.Close() })
+	defer conn.untrack()
+
+	tlsConn := tls.Server(clientConn, &tls.Config{
+		NextProtos: []string{"http/1.1"},
+		GetCertificate: func(hello *tls.ClientHelloInfo) (*tls.Certificate, error) {
+			name := hello.ServerName
+			if name == "" {
+				name = host
+			}
+			return leafCertificate(mapping.NormalizeHost(name))
+		},
+	})
+
+	srv := &http.Server{
+		Handler: http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+			forwardMITM(w, r, host, rt)
+		}),
+	}
+	srv.Serve(newSingleConnListener(tlsConn))
+}
+
+// Forward a request decrypted by handleMITM to the mapped target, over TLS
+// unless the mapping downgrades it to plain HTTP
+func forwardMITM(w http.ResponseWriter, r *http.Request, host string, rt route) {
+	via := forwarding{proto: "https", scheme: "https", transport: func(rt route) http.RoundTripper {
+		return cachedTransport(transportKey{serverName: host, unixPath: rt.unixPath(), mapped: rt.mapped, dnsServer: rt.dnsServer, guarded: rt.guarded, insecure: rt.options.InsecureSkipVerify, clientCert: rt.clientCert()})
+	}}
+	if rt.options.Scheme == "http" {
+		via.scheme = "http"
+		via.transport = transportFor
+	}
+	if rt.network == "file" {
+		via.transport = transportFor
+	}
+
+	logDebug("MITM %s https://%s%s -> %s://%s", r.Method, r.Host, r.URL.RequestURI(), via.scheme, rt.addr)
+
+	flow := newFlow("mitm", r.RemoteAddr, rt)
+	answer, err := requestChain(flow, r)
+	if refuse(w, err) {
+		return
+	}
+
+	trace := startTrace(r.RemoteAddr)
+	capture := startCapture(r, "https://"+r.Host+r.URL.RequestURI())
+	countersFor(rt).countRequest()
+	if answer != nil {
+		writeAnswer(w, r, answer, rt, trace, capture)
+		return
+	}
+
+	forwardHTTP(w, r, flow, rt, via, trace, capture)
+}
+
+// A net.Listener that yields one connection, then blocks until that
+// connection is closed, so an http.Server can serve a hijacked conn
+type singleConnListener struct {
+	conn chan net.Conn
+	done chan struct{}
+	addr net.Addr
+	once sync.Once
+}
+
+func newSingleConnListener(conn net.Conn) *singleConnListener {
+	l := &singleConnListener{
+		conn: make(chan net.Conn, 1),
+		done: make(chan struct{}),
+		addr: conn.LocalAddr(),
+	}
+	l.conn <- &notifyCloseConn{Conn: conn, closed: l.Close}
+	return l
+}
+
+func (l *singleConnListener) Accept() (net.Conn, error) {
+	select {
+	case conn := <-l.conn:
+		return conn, nil
+	case <-l.done:
+		return nil, io.EOF
+	}
+}
+
+func (l *singleConnListener) Close() error {
+	l.once.Do(func() { close(l.done) })
+	return nil
+}
+
+func (l *singleConnListener) Addr() net.Addr {
+	return l.addr
+}
+
+// A net.Conn that closes its listener when closed
+type notifyCloseConn struct {
+	net.Conn
+	closed func() error
+}
+
+func (c *notifyCloseConn) Close() error {
+	c.closed()
+	return c.Conn.Close()
+}
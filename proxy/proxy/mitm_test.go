@@ -0,0 +1,107 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"crypto/x509"
+	"fmt"
+	"io"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start a proxy terminating TLS for secure.test and forwarding it to a
+// TLS backend running handler
+func startMITMProxy(t *testing.T, handler http.Handler, options MappingOptions) *Proxy {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	backend := httptest.NewTLSServer(handler)
+	t.Cleanup(backend.Close)
+
+	options.MITM = true
+	options.InsecureSkipVerify = true
+	p := New(nil)
+	port := 0
+	err := p.Start(context.Background(), Message{
+		Port:     &port,
+		Mappings: map[string]string{"secure.test": strings.TrimPrefix(backend.URL, "https://")},
+		Options:  map[string]MappingOptions{"secure.test": options},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Stop)
+	return p
+}
+
+// Open a TLS connection to host:443 through the proxy, trusting its CA
+func dialMITM(t *testing.T, port int, host string) *tls.Conn {
+	t.Helper()
+	caPEM, err := exportCA()
+	if err != nil {
+		t.Fatal(err)
+	}
+	roots := x509.NewCertPool()
+	roots.AppendCertsFromPEM([]byte(caPEM))
+	conn, _ := openTunnel(t, port, host+":443")
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+	tlsConn := tls.Client(conn, &tls.Config{ServerName: host, RootCAs: roots})
+	if err := tlsConn.Handshake(); err != nil {
+		t.Fatal(err)
+	}
+	return tlsConn
+}
+
+func TestMITMStripsHopByHopHeaders(t *testing.T) {
+	p := startMITMProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		fmt.Fprintf(w, "hop=%q keep=%q", r.Header.Get("X-Hop"), r.Header.Get("X-Keep"))
+	}), MappingOptions{})
+
+	conn := dialMITM(t, p.Port(), "secure.test")
+	io.WriteString(conn, "GET / HTTP/1.1\r\nHost: secure.test\r\nConnection: X-Hop\r\nX-Hop: 1\r\nX-Keep: 1\r\n\r\n")
+	resp, err := http.ReadResponse(bufio.NewReader(conn), nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	body, _ := io.ReadAll(resp.Body)
+	resp.Body.Close()
+	if got, want := string(body), `hop="" keep="1"`; got != want {
+		t.Errorf("backend saw %s, want %s", got, want)
+	}
+}
+
+func TestMITMRelaysUpgrades(t *testing.T) {
+	p := startMITMProxy(t, http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		if r.Header.Get("Upgrade") != "echo" {
+			http.Error(w, "no upgrade", http.StatusBadRequest)
+			return
+		}
+		conn, buf, err := http.NewResponseController(w).Hijack()
+		if err != nil {
+			return
+		}
+		defer conn.Close()
+		buf.WriteString("HTTP/1.1 101 Switching Protocols\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+		buf.Flush()
+		io.Copy(conn, buf)
+	}), MappingOptions{})
+
+	conn := dialMITM(t, p.Port(), "secure.test")
+	io.WriteString(conn, "GET /ws HTTP/1.1\r\nHost: secure.test\r\nConnection: Upgrade\r\nUpgrade: echo\r\n\r\n")
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		t.Fatalf("status %d, want 101", resp.StatusCode)
+	}
+	io.WriteString(conn, "ping\n")
+	if line, err := br.ReadString('\n'); err != nil || line != "ping\n" {
+		t.Errorf("echo over the upgraded connection: %q, %v", line, err)
+	}
+}
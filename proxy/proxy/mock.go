@@ -0,0 +1,79 @@
+package proxy
+
+import (
+	"io"
+	"net/http"
+	"os"
+	"strconv"
+	"strings"
+)
+
+// A canned response for a host's requests, served without contacting a
+// target. A host's rules are tried in order and the first match answers.
+type MockRule struct {
+	Method   string            `json:"method,omitempty"` // Only requests with this method; any when empty
+	Path     string            `json:"path,omitempty"`   // Exact path, or a prefix ending in "*"; any when empty
+	Status   int               `json:"status,omitempty"` // Defaults to 200
+	Headers  map[string]string `json:"headers,omitempty"`
+	Body     string            `json:"body,omitempty"`
+	BodyFile string            `json:"bodyFile,omitempty"` // Read at each request, in place of Body
+}
+
+// Whether the rule answers req
+func (m MockRule) matches(req *http.Request) bool {
+	if m.Method != "" && !strings.EqualFold(m.Method, req.Method) {
+		return false
+	}
+	if prefix, ok := strings.CutSuffix(m.Path, "*"); ok {
+		return strings.HasPrefix(req.URL.Path, prefix)
+	}
+	return m.Path == "" || m.Path == req.URL.Path
+}
+
+// Build the rule's response. A body file that can't be read is answered
+// with 500, so a broken stub doesn't fall through to the real target.
+func (m MockRule) response(req *http.Request) *http.Response {
+	status := m.Status
+	if status == 0 {
+		status = http.StatusOK
+	}
+	body := m.Body
+	if m.BodyFile != "" {
+		data, err := os.ReadFile(m.BodyFile)
+		if err != nil {
+			logWarn("Mock body for %s%s unreadable: %v", req.Host, req.URL.Path, err)
+			return &http.Response{StatusCode: http.StatusInternalServerError, Header: make(http.Header), Body: http.NoBody}
+		}
+		body = string(data)
+	}
+
+	header := make(http.Header, len(m.Headers)+1)
+	for key, value := range m.Headers {
+		header.Set(key, value)
+	}
+	header.Set("Content-Length", strconv.Itoa(len(body)))
+	return &http.Response{
+		StatusCode:    status,
+		Header:        header,
+		ContentLength: int64(len(body)),
+		Body:          io.NopCloser(strings.NewReader(body)),
+	}
+}
+
+// Answers requests matching the host's mock rules. Only plain HTTP and MITM
+// requests are seen, so HTTPS hosts need the mitm option.
+type mockMiddleware struct{}
+
+func (mockMiddleware) OnConnect(f *Flow) error { return nil }
+
+func (mockMiddleware) OnRequest(f *Flow, req *http.Request) (*http.Response, error) {
+	for _, rule := range f.route.mocks {
+		if rule.matches(req) {
+			logDebug("Mocked %s %s%s", req.Method, f.Host, req.URL.Path)
+			return rule.response(req), nil
+		}
+	}
+	return nil, nil
+}
+
+func (mockMiddleware) OnResponse(f *Flow, req *http.Request, resp *http.Response) {}
@@ -0,0 +1,65 @@
+package proxy
+
+import (
+	"errors"
+	"net"
+	"slices"
+
+	"fhosts-proxy/mapping"
+)
+
+// Hosts set offline with setHostOffline, keyed like mappings. Connections
+// and requests to them fail at once as if the target refused them, so an
+// app's offline handling can be tried one dependency at a time. Like
+// pause, the list isn't saved.
+var errHostOffline = errors.New("connection refused (host set offline)")
+
+// Take hosts offline, or bring them back. Returns the hosts now offline.
+// The mappings revision is bumped as the PAC script lists offline hosts.
+func (p *Proxy) setHostsOffline(hosts []string, offline bool) []string {
+	p.offlineMu.Lock()
+	defer p.offlineMu.Unlock()
+	for _, host := range hosts {
+		if offline {
+			p.offlineHosts[mapping.NormalizeHost(host)] = true
+		} else {
+			delete(p.offlineHosts, mapping.NormalizeHost(host))
+		}
+	}
+	p.mappingsMu.Lock()
+	p.mappingsRevision++
+	p.mappingsMu.Unlock()
+	return p.offlineList()
+}
+
+// Sorted offline hosts. Callers hold p.offlineMu.
+func (p *Proxy) offlineList() []string {
+	list := make([]string, 0, len(p.offlineHosts))
+	for host := range p.offlineHosts {
+		list = append(list, host)
+	}
+	slices.Sort(list)
+	return list
+}
+
+func (p *Proxy) currentOfflineHosts() []string {
+	p.offlineMu.RLock()
+	defer p.offlineMu.RUnlock()
+	return p.offlineList()
+}
+
+func (p *Proxy) isOffline(host string) bool {
+	p.offlineMu.RLock()
+	defer p.offlineMu.RUnlock()
+	if len(p.offlineHosts) == 0 {
+		return false
+	}
+	_, ok := mapping.Match(p.offlineHosts, host)
+	return ok
+}
+
+// The error dialing an offline host fails with, a dial error like a real
+// refusal so it is answered and reported the same way
+func offlineError() error {
+	return &net.OpError{Op: "dial", Net: "tcp", Err: errHostOffline}
+}
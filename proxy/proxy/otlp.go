@@ -0,0 +1,244 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/rand"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"strconv"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Spans are exported as OTLP/HTTP JSON in batches, so a slow or missing
+// collector never holds up proxied traffic. Spans beyond maxQueuedSpans
+// are dropped.
+const (
+	otlpFlushInterval = 2 * time.Second
+	otlpBatchSize     = 100
+	maxQueuedSpans    = 2048
+)
+
+var (
+	otlpMu       sync.Mutex
+	otlpEndpoint string // Collector traces URL, empty while export is off
+	otlpQueue    []otlpSpan
+	otlpStop     chan struct{}
+	otlpFailing  bool // Last export failed, so further failures aren't logged
+
+	otlpClient = &http.Client{
+		Timeout:   5 * time.Second,
+		Transport: &http.Transport{Proxy: nil}, // Never through a proxy, least of all this one
+	}
+)
+
+// Start exporting spans to the collector's traces endpoint, replacing any
+// previous one. An empty endpoint turns export off.
+func startOTLP(endpoint string) {
+	stopOTLP()
+	if endpoint == "" {
+		return
+	}
+	otlpMu.Lock()
+	otlpEndpoint = endpoint
+	otlpStop = make(chan struct{})
+	stop := otlpStop
+	otlpMu.Unlock()
+
+	go func() {
+		ticker := time.NewTicker(otlpFlushInterval)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-ticker.C:
+				flushOTLP()
+			case <-stop:
+				return
+			}
+		}
+	}()
+}
+
+// Stop exporting after sending what is queued
+func stopOTLP() {
+	otlpMu.Lock()
+	stop := otlpStop
+	otlpStop = nil
+	otlpMu.Unlock()
+	if stop == nil {
+		return
+	}
+	close(stop)
+	flushOTLP()
+	otlpMu.Lock()
+	otlpEndpoint = ""
+	otlpMu.Unlock()
+}
+
+func otlpEnabled() bool {
+	otlpMu.Lock()
+	defer otlpMu.Unlock()
+	return otlpEndpoint != ""
+}
+
+// Trace context of one proxied request's span
+type spanContext struct {
+	traceID  [16]byte
+	spanID   [8]byte
+	parentID [8]byte // Zero for root spans
+}
+
+func newSpanContext() *spanContext {
+	sc := &spanContext{}
+	rand.Read(sc.traceID[:])
+	rand.Read(sc.spanID[:])
+	return sc
+}
+
+// Continue the trace named in a W3C traceparent header, if there is a
+// valid one, and replace the header so the target's spans become children
+// of this one
+func (sc *spanContext) propagate(h http.Header) {
+	if parts := strings.Split(h.Get("Traceparent"), "-"); len(parts) == 4 && len(parts[1]) == 32 && len(parts[2]) == 16 {
+		traceID, err1 := hex.DecodeString(parts[1])
+		parentID, err2 := hex.DecodeString(parts[2])
+		if err1 == nil && err2 == nil {
+			copy(sc.traceID[:], traceID)
+			copy(sc.parentID[:], parentID)
+		}
+	}
+	h.Set("Traceparent", fmt.Sprintf("00-%x-%x-01", sc.traceID, sc.spanID))
+}
+
+// OTLP/JSON encoding of a span (opentelemetry/proto/trace/v1)
+type otlpSpan struct {
+	TraceID      string          `json:"traceId"`
+	SpanID       string          `json:"spanId"`
+	ParentSpanID string          `json:"parentSpanId,omitempty"`
+	Name         string          `json:"name"`
+	Kind         int             `json:"kind"`
+	StartTime    string          `json:"startTimeUnixNano"`
+	EndTime      string          `json:"endTimeUnixNano"`
+	Attributes   []otlpAttribute `json:"attributes"`
+	Status       otlpStatus      `json:"status"`
+}
+
+type otlpAttribute struct {
+	Key   string    `json:"key"`
+	Value otlpValue `json:"value"`
+}
+
+type otlpValue struct {
+	StringValue *string `json:"stringValue,omitempty"`
+	IntValue    *string `json:"intValue,omitempty"` // int64 values are strings in OTLP/JSON
+	BoolValue   *bool   `json:"boolValue,omitempty"`
+}
+
+type otlpStatus struct {
+	Code int `json:"code,omitempty"` // 2 is error
+}
+
+const (
+	spanKindClient  = 3
+	spanStatusError = 2
+)
+
+func stringAttr(key, value string) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{StringValue: &value}}
+}
+
+func intAttr(key string, value int64) otlpAttribute {
+	s := strconv.FormatInt(value, 10)
+	return otlpAttribute{Key: key, Value: otlpValue{IntValue: &s}}
+}
+
+func boolAttr(key string, value bool) otlpAttribute {
+	return otlpAttribute{Key: key, Value: otlpValue{BoolValue: &value}}
+}
+
+// Queue the span for a finished request
+func exportSpan(sc *spanContext, entry AccessLogEntry, end time.Time) {
+	if sc == nil || !otlpEnabled() {
+		return
+	}
+	span := otlpSpan{
+		TraceID:   hex.EncodeToString(sc.traceID[:]),
+		SpanID:    hex.EncodeToString(sc.spanID[:]),
+		Name:      entry.Method + " " + entry.Host,
+		Kind:      spanKindClient,
+		StartTime: strconv.FormatInt(entry.Time.UnixNano(), 10),
+		EndTime:   strconv.FormatInt(end.UnixNano(), 10),
+		Attributes: []otlpAttribute{
+			stringAttr("http.request.method", entry.Method),
+			stringAttr("server.address", entry.Host),
+			stringAttr("fhosts.target", entry.Target),
+			boolAttr("fhosts.mapped", entry.Mapped),
+			stringAttr("client.address", entry.Client),
+			intAttr("fhosts.bytes_in", entry.BytesIn),
+			intAttr("fhosts.bytes_out", entry.BytesOut),
+		},
+	}
+	if sc.parentID != [8]byte{} {
+		span.ParentSpanID = hex.EncodeToString(sc.parentID[:])
+	}
+	if entry.Status != 0 {
+		span.Attributes = append(span.Attributes, intAttr("http.response.status_code", int64(entry.Status)))
+	}
+	if entry.Status >= 500 {
+		span.Status.Code = spanStatusError
+	}
+
+	otlpMu.Lock()
+	if len(otlpQueue) < maxQueuedSpans {
+		otlpQueue = append(otlpQueue, span)
+	}
+	full := len(otlpQueue) >= otlpBatchSize
+	otlpMu.Unlock()
+	if full {
+		go flushOTLP()
+	}
+}
+
+// Send the queued spans to the collector
+func flushOTLP() {
+	otlpMu.Lock()
+	spans, endpoint := otlpQueue, otlpEndpoint
+	otlpQueue = nil
+	otlpMu.Unlock()
+	if len(spans) == 0 || endpoint == "" {
+		return
+	}
+
+	body, _ := json.Marshal(map[string]any{
+		"resourceSpans": []any{map[string]any{
+			"resource": map[string]any{
+				"attributes": []otlpAttribute{
+					stringAttr("service.name", "fhosts-proxy"),
+					stringAttr("service.version", version),
+				},
+			},
+			"scopeSpans": []any{map[string]any{
+				"scope": map[string]string{"name": "fhosts-proxy", "version": version},
+				"spans": spans,
+			}},
+		}},
+	})
+	resp, err := otlpClient.Post(endpoint, "application/json", bytes.NewReader(body))
+	if err == nil {
+		resp.Body.Close()
+		if resp.StatusCode >= 300 {
+			err = fmt.Errorf("collector returned %s", resp.Status)
+		}
+	}
+
+	otlpMu.Lock()
+	wasFailing := otlpFailing
+	otlpFailing = err != nil
+	otlpMu.Unlock()
+	if err != nil && !wasFailing {
+		logWarn("Failed to export spans to %s: %v", endpoint, err)
+	}
+}
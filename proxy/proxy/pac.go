@@ -0,0 +1,109 @@
+package proxy
+
+import (
+	"encoding/json"
+	"fmt"
+	"net"
+	"net/http"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const pacPath = "/proxy.pac"
+
+// PAC script template. Hosts with a mapping or a rule go through the
+// proxy, everything else is DIRECT. Regex rules are compiled with the
+// browser's RegExp, so patterns using Go-only syntax are skipped.
+const pacTemplate = `var exact = %s;
+var suffixes = %s;
+var patterns = %s;
+var proxy = "PROXY %s";
+
+function FindProxyForURL(url, host) {
+  host = host.toLowerCase();
+  if (exact.indexOf(host) !== -1) {
+    return proxy;
+  }
+  for (var i = 0; i < suffixes.length; i++) {
+    if (dnsDomainIs(host, suffixes[i])) {
+      return proxy;
+    }
+  }
+  for (var j = 0; j < patterns.length; j++) {
+    try {
+      if (new RegExp(patterns[j]).test(host)) {
+        return proxy;
+      }
+    } catch (e) {}
+  }
+  return "DIRECT";
+}
+`
+
+// Render a PAC script that routes the proxy at addr only the hosts it acts
+// on: mapped ones, and those blocked, offline, mocked or given header or
+// body rules, which are skipped unless the browser sends them to the
+// proxy
+func (p *Proxy) buildPAC(addr string) string {
+	keys := make(map[string]bool)
+	patterns := []string{}
+
+	p.mappingsMu.RLock()
+	for key := range p.hostMappings {
+		keys[key] = true
+	}
+	for key := range p.blockedHosts {
+		keys[key] = true
+	}
+	for key := range p.mockRules {
+		keys[key] = true
+	}
+	for key := range p.headerRules {
+		keys[key] = true
+	}
+	for key := range p.bodyRules {
+		keys[key] = true
+	}
+	for _, rule := range p.regexMappings {
+		patterns = append(patterns, rule.Pattern())
+	}
+	p.mappingsMu.RUnlock()
+	for _, key := range p.currentOfflineHosts() {
+		keys[key] = true
+	}
+
+	exact := []string{}
+	suffixes := []string{}
+	for key := range keys {
+		if strings.HasPrefix(key, "*.") {
+			suffixes = append(suffixes, key[1:])
+		} else {
+			exact = append(exact, key)
+		}
+	}
+	sort.Strings(exact)
+	sort.Strings(suffixes)
+
+	exactJSON, _ := json.Marshal(exact)
+	suffixesJSON, _ := json.Marshal(suffixes)
+	patternsJSON, _ := json.Marshal(patterns)
+	return fmt.Sprintf(pacTemplate, exactJSON, suffixesJSON, patternsJSON, addr)
+}
+
+// Serve the PAC script for direct (non-proxy) requests to the listener.
+// It points at the address the request came in on, so clients on other
+// machines and extra listeners get their own entry point. The script is
+// built for every fetch, so it follows changes to mappings, rules and
+// offline hosts as soon as the client reloads it.
+func (p *Proxy) handlePAC(w http.ResponseWriter, r *http.Request) {
+	addr := net.JoinHostPort(loopbackHost, strconv.Itoa(p.Port()))
+	if local, ok := r.Context().Value(http.LocalAddrContextKey).(*net.TCPAddr); ok && !local.IP.IsLoopback() {
+		addr = local.String()
+	} else if ok {
+		addr = net.JoinHostPort(loopbackHost, strconv.Itoa(local.Port))
+	}
+	w.Header().Set("Content-Type", "application/x-ns-proxy-autoconfig")
+	w.Header().Set("Cache-Control", "no-cache")
+	fmt.Fprint(w, p.buildPAC(addr))
+}
@@ -0,0 +1,67 @@
+package proxy
+
+import (
+	"context"
+	"fmt"
+	"io"
+	"net/http"
+	"strings"
+	"testing"
+)
+
+// Fetch the PAC script from the proxy on port
+func fetchPAC(t *testing.T, port int) string {
+	t.Helper()
+	resp, err := http.Get(fmt.Sprintf("http://127.0.0.1:%d%s", port, pacPath))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return string(body)
+}
+
+func TestPACListsRuleHosts(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	p := New(nil)
+	port := 0
+	err := p.Start(context.Background(), Message{
+		Port:        &port,
+		Mappings:    map[string]string{"mapped.test": "127.0.0.1:3000"},
+		Blocked:     map[string]BlockRule{"*.ads.test": {}},
+		Mocks:       map[string][]MockRule{"mocked.test": {{Body: "ok"}}},
+		HeaderRules: map[string]HeaderRules{"headers.test": {}},
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer p.Stop()
+
+	pac := fetchPAC(t, p.Port())
+	for _, want := range []string{`"mapped.test"`, `".ads.test"`, `"mocked.test"`, `"headers.test"`} {
+		if !strings.Contains(pac, want) {
+			t.Errorf("PAC lacks %s:\n%s", want, pac)
+		}
+	}
+	if strings.Contains(pac, "offline.test") {
+		t.Fatal("PAC lists offline.test before it is set offline")
+	}
+
+	// Rule changes show up in the next fetch
+	_, before := p.mappingsState()
+	p.Do(Message{Action: "setHostOffline", Hosts: []string{"offline.test"}, Offline: true})
+	if _, after := p.mappingsState(); after == before {
+		t.Error("setHostOffline left the mappings revision alone")
+	}
+	p.Do(Message{Action: "removeMappings", Hosts: []string{"mocked.test"}})
+	pac = fetchPAC(t, p.Port())
+	if !strings.Contains(pac, `"offline.test"`) {
+		t.Errorf("PAC lacks the host set offline:\n%s", pac)
+	}
+	if strings.Contains(pac, "mocked.test") {
+		t.Errorf("PAC still lists a removed mock:\n%s", pac)
+	}
+}
@@ -0,0 +1,280 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+	"time"
+
+	"fhosts-proxy/mapping"
+)
+
+// Parent (upstream) proxy that traffic without a mapping is chained
+// through, for networks where the internet is only reachable via a
+// corporate proxy. Mapped targets and loopback hosts are always dialed
+// directly.
+type ParentProxy struct {
+	URL      string   `json:"url"`                // http://host:port
+	Auth     string   `json:"auth,omitempty"`     // "basic", "ntlm" or "negotiate"; basic when only a username is set
+	Username string   `json:"username,omitempty"` // DOMAIN\user for NTLM and Negotiate
+	Password string   `json:"password,omitempty"`
+	Bypass   []string `json:"bypass,omitempty"` // Hosts (or *.suffix patterns) dialed directly
+}
+
+// Supported Auth values
+const (
+	parentAuthBasic     = "basic"
+	parentAuthNTLM      = "ntlm"
+	parentAuthNegotiate = "negotiate"
+)
+
+// Rounds of 407 challenges answered before giving up on a CONNECT
+const maxParentAuthRounds = 3
+
+// A proxy's checked parent proxy
+type parentConfig struct {
+	ParentProxy
+	addr      string // host:port of the parent
+	bypass    map[string]bool
+	transport *http.Transport // Plain HTTP through the parent
+}
+
+// Check p and build its transport, to chain a proxy's unmapped traffic
+// through. Nil when p is nil or has no URL, so traffic goes direct.
+func newParentConfig(p *ParentProxy) (*parentConfig, error) {
+	if p == nil || p.URL == "" {
+		return nil, nil
+	}
+
+	u, err := url.Parse(p.URL)
+	if err != nil {
+		return nil, err
+	}
+	if u.Scheme != "http" || u.Host == "" {
+		return nil, fmt.Errorf("parent proxy %q must be an http:// URL", p.URL)
+	}
+	cfg := *p
+	cfg.Auth = strings.ToLower(cfg.Auth)
+	if cfg.Auth == "" && cfg.Username != "" {
+		cfg.Auth = parentAuthBasic
+	}
+	switch cfg.Auth {
+	case "", parentAuthBasic, parentAuthNTLM, parentAuthNegotiate:
+	default:
+		return nil, fmt.Errorf("unknown parent proxy auth %q", p.Auth)
+	}
+	if cfg.Auth == parentAuthBasic && cfg.Username == "" {
+		return nil, errors.New("basic parent proxy auth requires a username")
+	}
+	addr := withDefaultPort(u.Host, "80")
+	auth, err := newParentAuth(&cfg, addr) // Check the credentials can be used at all
+	if err != nil {
+		return nil, err
+	}
+	if auth != nil {
+		auth.close()
+	}
+	bypass := make(map[string]bool, len(cfg.Bypass))
+	for _, host := range cfg.Bypass {
+		bypass[mapping.NormalizeHost(host)] = true
+	}
+
+	// Basic credentials go with each request, so plain HTTP can use the
+	// parent as an ordinary proxy. NTLM and Negotiate authenticate a
+	// connection, so plain HTTP is tunneled with CONNECT like HTTPS.
+	t := shared().http.Clone()
+	t.TLSClientConfig = upstreamTLSConfig()
+	parent := &parentConfig{ParentProxy: cfg, addr: addr, bypass: bypass, transport: t}
+	if cfg.Auth == "" || cfg.Auth == parentAuthBasic {
+		proxyURL := &url.URL{Scheme: "http", Host: addr}
+		if cfg.Auth == parentAuthBasic {
+			proxyURL.User = url.UserPassword(cfg.Username, cfg.Password)
+		}
+		t.Proxy = http.ProxyURL(proxyURL)
+	} else {
+		t.DialContext = func(ctx context.Context, _, addr string) (net.Conn, error) {
+			return parent.dial(ctx, addr, false)
+		}
+	}
+
+	if cfg.Auth == "" {
+		logInfo("Chaining unmapped traffic through %s", addr)
+	} else {
+		logInfo("Chaining unmapped traffic through %s with %s auth", addr, cfg.Auth)
+	}
+	return parent, nil
+}
+
+// The parent proxy traffic to host goes through, nil when it goes direct
+func (s *proxySettings) parentFor(host string) *parentConfig {
+	if s == nil {
+		return nil
+	}
+	parent := s.parent.Load()
+	if parent == nil || !parent.via(host) {
+		return nil
+	}
+	return parent
+}
+
+// Whether traffic to host should go through the parent
+func (c *parentConfig) via(host string) bool {
+	host = mapping.NormalizeHost(host)
+	if host == "localhost" || strings.HasSuffix(host, ".localhost") {
+		return false
+	}
+	if ip := net.ParseIP(mapping.Unbracket(host)); ip != nil && ip.IsLoopback() {
+		return false
+	}
+	_, bypassed := mapping.Match(c.bypass, host)
+	return !bypassed
+}
+
+// Open a tunnel to addr through the parent with CONNECT, answering
+// its authentication challenges. With guarded set, addr is refused when
+// it resolves locally to only private addresses; names that only the
+// parent can resolve are passed on.
+func (c *parentConfig) dial(ctx context.Context, addr string, guarded bool) (net.Conn, error) {
+	cfg, proxyAddr := &c.ParentProxy, c.addr
+	if guarded {
+		if err := checkParentTarget(ctx, addr); err != nil {
+			return nil, err
+		}
+	}
+
+	conn, err := shared().dialer.DialContext(ctx, "tcp", proxyAddr)
+	if err != nil {
+		return nil, fmt.Errorf("parent proxy %s: %w", proxyAddr, err)
+	}
+	deadline := time.Now().Add(millis(shared().timeouts.Dial))
+	if d, ok := ctx.Deadline(); ok && d.Before(deadline) {
+		deadline = d
+	}
+	conn.SetDeadline(deadline)
+
+	auth, err := newParentAuth(cfg, proxyAddr)
+	if err != nil {
+		conn.Close()
+		return nil, err
+	}
+	if auth != nil {
+		defer auth.close()
+	}
+
+	br := bufio.NewReader(conn)
+	var challenge []byte
+	for round := 0; ; round++ {
+		req := &http.Request{
+			Method: http.MethodConnect,
+			URL:    &url.URL{Opaque: addr},
+			Host:   addr,
+			Header: make(http.Header),
+		}
+		if auth != nil {
+			authorization, err := auth.authorization(challenge)
+			if err != nil {
+				conn.Close()
+				return nil, fmt.Errorf("parent proxy %s auth: %w", proxyAddr, err)
+			}
+			req.Header.Set("Proxy-Authorization", authorization)
+		}
+		if err := req.Write(conn); err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("parent proxy %s: %w", proxyAddr, err)
+		}
+		resp, err := http.ReadResponse(br, req)
+		if err != nil {
+			conn.Close()
+			return nil, fmt.Errorf("parent proxy %s: %w", proxyAddr, err)
+		}
+
+		if resp.StatusCode == http.StatusOK {
+			conn.SetDeadline(time.Time{})
+			if br.Buffered() > 0 {
+				return &bufferedConn{Conn: conn, r: br}, nil
+			}
+			return conn, nil
+		}
+		io.Copy(io.Discard, io.LimitReader(resp.Body, 64<<10))
+		resp.Body.Close()
+		if resp.StatusCode != http.StatusProxyAuthRequired || auth == nil || round >= maxParentAuthRounds {
+			conn.Close()
+			return nil, fmt.Errorf("parent proxy %s refused CONNECT %s: %s", proxyAddr, addr, resp.Status)
+		}
+		challenge = parentChallenge(resp.Header, auth.scheme())
+		if resp.Close {
+			// NTLM and Negotiate can't survive this, but Basic can
+			conn.Close()
+			if conn, err = shared().dialer.DialContext(ctx, "tcp", proxyAddr); err != nil {
+				return nil, fmt.Errorf("parent proxy %s: %w", proxyAddr, err)
+			}
+			conn.SetDeadline(deadline)
+			br = bufio.NewReader(conn)
+		}
+	}
+}
+
+// Refuse addr when its host resolves locally to only private addresses
+func checkParentTarget(ctx context.Context, addr string) error {
+	host, _, err := net.SplitHostPort(addr)
+	if err != nil {
+		return err
+	}
+	ips := []net.IP{net.ParseIP(host)}
+	if ips[0] == nil {
+		if ips, err = lookupSystem(ctx, host); err != nil {
+			return nil // Left to the parent
+		}
+	}
+	for _, ip := range ips {
+		if err = checkPublic(ip); err == nil {
+			return nil
+		}
+	}
+	return &net.OpError{Op: "dial", Net: "tcp", Err: err}
+}
+
+// The token of the Proxy-Authenticate challenge for scheme, nil when there
+// is none
+func parentChallenge(h http.Header, scheme string) []byte {
+	for _, value := range h.Values("Proxy-Authenticate") {
+		name, token, _ := strings.Cut(strings.TrimSpace(value), " ")
+		if !strings.EqualFold(name, scheme) || token == "" {
+			continue
+		}
+		if data, err := base64.StdEncoding.DecodeString(strings.TrimSpace(token)); err == nil {
+			return data
+		}
+	}
+	return nil
+}
+
+// A connection with bytes already read into a bufio.Reader
+type bufferedConn struct {
+	net.Conn
+	r *bufio.Reader
+}
+
+func (c *bufferedConn) Read(p []byte) (int, error) {
+	return c.r.Read(p)
+}
+
+// Refuses requests for hosts checkParentTarget rejects before sending them
+// to the parent proxy
+type guardedTransport struct {
+	http.RoundTripper
+}
+
+func (t guardedTransport) RoundTrip(req *http.Request) (*http.Response, error) {
+	if err := checkParentTarget(req.Context(), withDefaultPort(req.URL.Host, "80")); err != nil {
+		return nil, err
+	}
+	return t.RoundTripper.RoundTrip(req)
+}
@@ -0,0 +1,83 @@
+package proxy
+
+import (
+	"encoding/base64"
+	"errors"
+	"net"
+
+	"github.com/Azure/go-ntlmssp"
+)
+
+var errParentAuthRejected = errors.New("credentials rejected")
+
+// One CONNECT's authentication exchange with the parent proxy
+type parentAuth interface {
+	scheme() string // As named in Proxy-Authenticate
+	// Proxy-Authorization value answering the last challenge's token, nil
+	// for the first request
+	authorization(challenge []byte) (string, error)
+	close()
+}
+
+// Start an exchange with the configured credentials, nil when the parent
+// needs none. NTLM with a password works everywhere; NTLM without one
+// (single sign-on as the logged-in user) and Negotiate use the platform's
+// security provider.
+func newParentAuth(cfg *ParentProxy, proxyAddr string) (parentAuth, error) {
+	switch {
+	case cfg.Auth == "":
+		return nil, nil
+	case cfg.Auth == parentAuthBasic:
+		return &basicAuth{username: cfg.Username, password: cfg.Password}, nil
+	case cfg.Auth == parentAuthNTLM && cfg.Password != "":
+		return &ntlmAuth{username: cfg.Username, password: cfg.Password}, nil
+	}
+	host, _, _ := net.SplitHostPort(proxyAddr)
+	return platformParentAuth(cfg, host)
+}
+
+type basicAuth struct {
+	username, password string
+	sent               bool
+}
+
+func (a *basicAuth) scheme() string { return "Basic" }
+
+func (a *basicAuth) authorization([]byte) (string, error) {
+	if a.sent {
+		return "", errParentAuthRejected
+	}
+	a.sent = true
+	return "Basic " + base64.StdEncoding.EncodeToString([]byte(a.username+":"+a.password)), nil
+}
+
+func (a *basicAuth) close() {}
+
+// NTLMv2 with an explicit DOMAIN\user and password
+type ntlmAuth struct {
+	username, password string
+	round              int
+}
+
+func (a *ntlmAuth) scheme() string { return "NTLM" }
+
+func (a *ntlmAuth) authorization(challenge []byte) (string, error) {
+	user, domain, domainNeeded := ntlmssp.GetDomain(a.username)
+	a.round++
+	var msg []byte
+	var err error
+	switch {
+	case a.round == 1:
+		msg, err = ntlmssp.NewNegotiateMessage(domain, "")
+	case a.round == 2 && challenge != nil:
+		msg, err = ntlmssp.ProcessChallenge(challenge, user, a.password, domainNeeded)
+	default:
+		return "", errParentAuthRejected
+	}
+	if err != nil {
+		return "", err
+	}
+	return "NTLM " + base64.StdEncoding.EncodeToString(msg), nil
+}
+
+func (a *ntlmAuth) close() {}
@@ -0,0 +1,13 @@
+//go:build !windows
+
+package proxy
+
+import "fmt"
+
+// Single sign-on needs SSPI, so only explicit NTLM credentials work here
+func platformParentAuth(cfg *ParentProxy, _ string) (parentAuth, error) {
+	if cfg.Auth == parentAuthNTLM {
+		return nil, fmt.Errorf("ntlm parent proxy auth needs a password outside Windows")
+	}
+	return nil, fmt.Errorf("%s parent proxy auth is only supported on Windows", cfg.Auth)
+}
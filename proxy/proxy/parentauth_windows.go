@@ -0,0 +1,85 @@
+//go:build windows
+
+package proxy
+
+import (
+	"encoding/base64"
+
+	"github.com/Azure/go-ntlmssp"
+	"github.com/alexbrainman/sspi"
+	"github.com/alexbrainman/sspi/negotiate"
+	"github.com/alexbrainman/sspi/ntlm"
+)
+
+// NTLM or Negotiate (Kerberos, falling back to NTLM) through SSPI, as the
+// logged-in user unless a username is configured
+func platformParentAuth(cfg *ParentProxy, proxyHost string) (parentAuth, error) {
+	acquire, name := negotiate.AcquireCurrentUserCredentials, "Negotiate"
+	acquireUser := negotiate.AcquireUserCredentials
+	if cfg.Auth == parentAuthNTLM {
+		acquire, name = ntlm.AcquireCurrentUserCredentials, "NTLM"
+		acquireUser = ntlm.AcquireUserCredentials
+	}
+	var cred *sspi.Credentials
+	var err error
+	if cfg.Username == "" {
+		cred, err = acquire()
+	} else {
+		user, domain, _ := ntlmssp.GetDomain(cfg.Username)
+		cred, err = acquireUser(domain, user, cfg.Password)
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &sspiAuth{name: name, cred: cred, spn: "HTTP/" + proxyHost}, nil
+}
+
+type sspiAuth struct {
+	name string
+	cred *sspi.Credentials
+	spn  string // Service principal name of the parent, for Kerberos
+
+	ntlmCtx *ntlm.ClientContext
+	negCtx  *negotiate.ClientContext
+	done    bool
+}
+
+func (a *sspiAuth) scheme() string { return a.name }
+
+func (a *sspiAuth) authorization(challenge []byte) (string, error) {
+	var token []byte
+	var err error
+	switch {
+	case a.done:
+		return "", errParentAuthRejected
+	case a.name == "NTLM" && a.ntlmCtx == nil:
+		a.ntlmCtx, token, err = ntlm.NewClientContext(a.cred)
+	case a.name == "NTLM":
+		if challenge == nil {
+			return "", errParentAuthRejected
+		}
+		token, err = a.ntlmCtx.Update(challenge)
+		a.done = true
+	case a.negCtx == nil:
+		a.negCtx, token, err = negotiate.NewClientContext(a.cred, a.spn)
+	default:
+		if challenge == nil {
+			return "", errParentAuthRejected
+		}
+		a.done, token, err = a.negCtx.Update(challenge)
+	}
+	if err != nil {
+		return "", err
+	}
+	return a.name + " " + base64.StdEncoding.EncodeToString(token), nil
+}
+
+func (a *sspiAuth) close() {
+	if a.ntlmCtx != nil {
+		a.ntlmCtx.Release()
+	}
+	if a.negCtx != nil {
+		a.negCtx.Release()
+	}
+	a.cred.Release()
+}
@@ -0,0 +1,141 @@
+package proxy
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+)
+
+// Named mapping sets kept by the host, so the extension can switch
+// environments (staging, localdev, ...) without re-sending everything
+const profilesFile = "profiles.json"
+
+type profileStore struct {
+	Active   string                 `json:"active,omitempty"`
+	Profiles map[string]ProxyConfig `json:"profiles"`
+}
+
+var profilesMu sync.Mutex
+
+var errNoProfileName = errors.New("profile name is required")
+
+func loadProfiles() (*profileStore, string, error) {
+	dir, err := configDir()
+	if err != nil {
+		return nil, "", err
+	}
+	path := filepath.Join(dir, profilesFile)
+	store := &profileStore{Profiles: make(map[string]ProxyConfig)}
+	data, err := os.ReadFile(path)
+	if errors.Is(err, os.ErrNotExist) {
+		return store, path, nil
+	}
+	if err != nil {
+		return nil, "", err
+	}
+	if err := json.Unmarshal(data, store); err != nil {
+		return nil, "", fmt.Errorf("%s: %v", profilesFile, err)
+	}
+	if store.Profiles == nil {
+		store.Profiles = make(map[string]ProxyConfig)
+	}
+	return store, path, nil
+}
+
+func (s *profileStore) save(path string) error {
+	data, err := json.MarshalIndent(s, "", "  ")
+	if err != nil {
+		return err
+	}
+	return writeFileAtomic(path, data)
+}
+
+// Save a profile from the mapping set in msg, or from the active set when
+// msg carries none
+func (p *Proxy) saveProfile(name string, msg *Message) error {
+	if name == "" {
+		return errNoProfileName
+	}
+	cfg := p.exportConfig()
+	if carriesMappings(msg) {
+		cfg = &ProxyConfig{
+			Version:     version,
+			Mappings:    msg.Mappings,
+			Regex:       msg.Regex,
+			Options:     msg.Options,
+			Blocked:     msg.Blocked,
+			HeaderRules: msg.HeaderRules,
+			Mocks:       msg.Mocks,
+			BodyRules:   msg.BodyRules,
+		}
+	}
+
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	store, path, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	store.Profiles[name] = *cfg
+	return store.save(path)
+}
+
+// Names of the saved profiles and the active one
+func listProfiles() ([]string, string, error) {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	store, _, err := loadProfiles()
+	if err != nil {
+		return nil, "", err
+	}
+	names := make([]string, 0, len(store.Profiles))
+	for name := range store.Profiles {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	return names, store.Active, nil
+}
+
+// Replace the active mapping set with a saved profile in one swap
+func (p *Proxy) switchProfile(name string) error {
+	if name == "" {
+		return errNoProfileName
+	}
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	store, path, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	cfg, ok := store.Profiles[name]
+	if !ok {
+		return fmt.Errorf("no profile named %q", name)
+	}
+	if err := p.importConfig(&cfg); err != nil {
+		return err
+	}
+	store.Active = name
+	return store.save(path)
+}
+
+// Remove a saved profile
+func deleteProfile(name string) error {
+	profilesMu.Lock()
+	defer profilesMu.Unlock()
+	store, path, err := loadProfiles()
+	if err != nil {
+		return err
+	}
+	if _, ok := store.Profiles[name]; !ok {
+		return fmt.Errorf("no profile named %q", name)
+	}
+	delete(store.Profiles, name)
+	if store.Active == name {
+		store.Active = ""
+	}
+	return store.save(path)
+}
@@ -0,0 +1,163 @@
+package proxy
+
+import (
+	"sync"
+
+	"fhosts-proxy/nativemsg"
+)
+
+// Native messaging protocol version. Bump when replies change in a way
+// older extensions cannot ignore.
+const protocolVersion = 1
+
+// Optional capabilities advertised in the ready and hello messages
+var supportedFeatures = []string{
+	"wildcardMappings",
+	"regexMappings",
+	"incrementalMappings",
+	"requestIds",
+	"errorCodes",
+	"socks",
+	"pac",
+	"mitm",
+	"unixSockets",
+	"throttle",
+	"latency",
+	"blocking",
+	"headerRules",
+	"rewriteRedirects",
+	"status",
+	"stats",
+	"traffic",
+	"restart",
+	"config",
+	"profiles",
+	"logLevels",
+	"pause",
+	"watchFile",
+	"accessLog",
+	"har",
+	"adminApi",
+	"dashboard",
+	"connections",
+	"timing",
+	"otlp",
+	"logRotation",
+	"dnsServers",
+	"dnsCache",
+	"failover",
+	"loadBalancing",
+	"healthChecks",
+	"docker",
+	"kubernetes",
+	"systemHosts",
+	"mappingBackend",
+	"proxyAuth",
+	"connectPorts",
+	"blockPrivate",
+	"clientCerts",
+	"caBundle",
+	"parentProxy",
+	"auditLog",
+	"middleware",
+	"grpc",
+	"listeners",
+	"bindAddress",
+	"mocks",
+	"tape",
+	"bodyRules",
+	"hooks",
+	"chaos",
+	"offlineHosts",
+	"fileMappings",
+	"testMapping",
+	"streaming",
+	"trailers",
+	"forwardedHeaders",
+	"hostHeader",
+	"tcpMappings",
+	"noCompression",
+}
+
+// Actions handled by handleMessage
+var supportedActions = []string{
+	"start", "restart", "stop", "startSocks",
+	"updateMappings", "addMappings", "removeMappings",
+	"importHostsFile", "exportHostsFile", "exportConfig", "importConfig",
+	"saveProfile", "listProfiles", "switchProfile", "deleteProfile",
+	"pause", "resume", "disableMappings", "enableMappings",
+	"startRecording", "stopRecording", "exportHar",
+	"subscribe", "unsubscribe", "setLogLevel", "rotateLogs",
+	"setParentProxy", "getAuditLog", "setTape", "setHostOffline",
+	"generateCA", "exportCA",
+	"listConnections", "closeConnection",
+	"flushDns", "testMapping",
+	"status", "getStats", "capabilities", "hello", "ping",
+}
+
+// Reply to the capabilities action
+type Capabilities struct {
+	Protocol       int      `json:"protocol"`
+	Version        string   `json:"version"`
+	Actions        []string `json:"actions"`
+	Features       []string `json:"features"`
+	MaxMessageSize int      `json:"maxMessageSize"` // Bytes, either direction
+	MaxMappings    int      `json:"maxMappings"`    // Host plus regex mappings
+	MaxConnections int      `json:"maxConnections"` // Current concurrent connection cap
+}
+
+func currentCapabilities() *Capabilities {
+	return &Capabilities{
+		Protocol:       protocolVersion,
+		Version:        version,
+		Actions:        supportedActions,
+		Features:       supportedFeatures,
+		MaxMessageSize: nativemsg.MaxMessageSize,
+		MaxMappings:    maxMappings,
+		MaxConnections: cap(currentSlots()),
+	}
+}
+
+// What the extension declared in its hello message
+var (
+	peerMu      sync.Mutex
+	peerVersion string
+)
+
+// Record the extension's hello and build the reply. The negotiated
+// protocol is the lower of both sides; features are narrowed to the ones
+// the extension asked for, or all of them if it sent none.
+func handleHello(msg *Message) Message {
+	peerMu.Lock()
+	peerVersion = msg.Version
+	peerMu.Unlock()
+
+	protocol := protocolVersion
+	if msg.Protocol > 0 && msg.Protocol < protocol {
+		protocol = msg.Protocol
+	}
+
+	features := supportedFeatures
+	if len(msg.Features) > 0 {
+		wanted := make(map[string]bool, len(msg.Features))
+		for _, f := range msg.Features {
+			wanted[f] = true
+		}
+		features = []string{}
+		for _, f := range supportedFeatures {
+			if wanted[f] {
+				features = append(features, f)
+			}
+		}
+	}
+
+	return Message{Type: "hello", Protocol: protocol, Version: version, Features: features}
+}
+
+// Extension version from the last hello, empty for extensions that never
+// sent one
+func extensionVersion() string {
+	peerMu.Lock()
+	defer peerMu.Unlock()
+	return peerVersion
+}
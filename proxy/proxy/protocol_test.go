@@ -0,0 +1,27 @@
+package proxy
+
+import (
+	"encoding/json"
+	"testing"
+
+	"fhosts-proxy/nativemsg"
+)
+
+func TestCapabilitiesJSON(t *testing.T) {
+	data, err := json.Marshal(currentCapabilities())
+	if err != nil {
+		t.Fatal(err)
+	}
+	var fields map[string]any
+	if err := json.Unmarshal(data, &fields); err != nil {
+		t.Fatal(err)
+	}
+	for _, name := range []string{"protocol", "version", "actions", "features", "maxMessageSize", "maxMappings", "maxConnections"} {
+		if _, ok := fields[name]; !ok {
+			t.Errorf("capabilities has no %q field: %s", name, data)
+		}
+	}
+	if got := fields["maxMessageSize"]; got != float64(nativemsg.MaxMessageSize) {
+		t.Errorf("maxMessageSize = %v, want %d", got, nativemsg.MaxMessageSize)
+	}
+}
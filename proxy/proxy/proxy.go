@@ -0,0 +1,235 @@
+// Package proxy is the fhosts proxy engine: the HTTP, CONNECT and SOCKS5
+// proxy that routes mapped hosts to their targets, and the actions the
+// extension drives it with. The fhosts-proxy command wires it to native
+// messaging; other programs, such as test harnesses, can embed it through
+// Proxy.
+//
+// A Proxy owns its listeners and server, its mapping tables and host rules,
+// its watched file and mapping backend, and the settings from its start
+// message: proxy auth, hooks, tape, parent proxy, health checks and the
+// routing options. So a program can run several side by side. The CA,
+// transports and timeouts, log and event output and the control, admin
+// and gRPC services are shared by the process, as are the stats push,
+// OTLP export, access log and k8s port-forwards, which run for the proxy
+// started last and stop with it. Only the native messaging host's proxy
+// runs the heartbeat watchdog.
+package proxy
+
+import (
+	"context"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+
+	"fhosts-proxy/mapping"
+)
+
+// A proxy: its server and listeners, which are only touched with
+// actionsMu held, and the tables and settings its handlers route by.
+// Embedded proxies don't save their mappings or write the audit log.
+type Proxy struct {
+	server    *http.Server
+	listeners []net.Listener
+	extra     []net.Listener     // HTTP listeners from the start message, kept by restart
+	bind      string             // Host the listeners are on, kept by restart
+	cancel    context.CancelFunc // Ends the context handlers run under
+	embedded  bool
+
+	// SOCKS5 listeners, the first being the startSocks one, and tcp
+	// forward listeners
+	socksListeners []net.Listener
+	tcpForwards    []tcpForward
+
+	// The watched file and mapping backend, and the mappings they last
+	// contributed
+	watch   watchState
+	backend backendState
+
+	// Port listened on, or 0 when stopped. Kept separately from listeners
+	// so handlers can read it while a restart swaps them.
+	port atomic.Int64
+
+	mappingsMu     sync.RWMutex
+	hostMappings   map[string]string
+	regexMappings  []mapping.Regex
+	mappingOptions map[string]MappingOptions
+	blockedHosts   map[string]BlockRule
+	headerRules    map[string]HeaderRules
+	mockRules      map[string][]MockRule
+	bodyRules      map[string][]BodyRule
+
+	// Host mappings switched off with disableMappings, kept so they can be
+	// switched back on. They take no part in routing.
+	disabledMappings map[string]string
+
+	// Bumped on every change to the tables above or to offlineHosts
+	mappingsRevision int64
+
+	// While paused, every host resolves as unmapped and traffic goes to
+	// the real hosts. The mapping tables are kept so resume restores them
+	// as-is.
+	paused atomic.Bool
+
+	// Hosts set offline with setHostOffline
+	offlineMu    sync.RWMutex
+	offlineHosts map[string]bool
+
+	// Settings from the start message, swapped whole so a request sees
+	// one consistent set
+	settings atomic.Pointer[proxySettings]
+}
+
+// The process's proxy, driven by the native host, daemon and control
+// clients
+var engine = newProxy()
+
+func newProxy() *Proxy {
+	return &Proxy{
+		hostMappings:     make(map[string]string),
+		mappingOptions:   make(map[string]MappingOptions),
+		blockedHosts:     make(map[string]BlockRule),
+		headerRules:      make(map[string]HeaderRules),
+		mockRules:        make(map[string][]MockRule),
+		bodyRules:        make(map[string][]BodyRule),
+		disabledMappings: make(map[string]string),
+		offlineHosts:     make(map[string]bool),
+	}
+}
+
+// Create a proxy with empty mappings. events receives the replies and
+// events the extension would (traffic, log, mappingsUpdated and so on);
+// nil drops them. Events are output for the whole process, so the last
+// non-nil events given receives those of every proxy.
+func New(events func(Message)) *Proxy {
+	if events != nil {
+		setOutput(events)
+	}
+	p := newProxy()
+	p.embedded = true
+	return p
+}
+
+// Start listening with the settings of a start message: Port (0 picks a
+// free one), Mappings, Options, Timeouts and the rest. The proxy stops
+// when ctx ends, and requests in flight see their contexts canceled.
+// Config file defaults apply only after Init.
+func (p *Proxy) Start(ctx context.Context, settings Message) error {
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+	applyFileDefaults(&settings)
+	return p.start(ctx, &settings)
+}
+
+// Stop listening and close open tunnels, including CONNECT, SOCKS, MITM
+// and upgraded ones. The mappings are kept for the next Start.
+func (p *Proxy) Stop() {
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+	p.stop()
+}
+
+// Port the proxy listens on, 0 while stopped
+func (p *Proxy) Port() int {
+	return int(p.port.Load())
+}
+
+func (p *Proxy) running() bool {
+	return p.Port() != 0
+}
+
+// Replace the host mappings. Regex mappings, options and rules are
+// cleared; send a full updateMappings message with Do to set those too.
+func (p *Proxy) UpdateMappings(mappings map[string]string) error {
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+	return p.setMappings(&Message{Mappings: mappings})
+}
+
+// Run a native messaging action and return its first reply. stop only
+// stops the proxy here, rather than exiting the process.
+func (p *Proxy) Do(msg Message) Message {
+	if msg.Action == "stop" {
+		p.Stop()
+		return Message{Type: "stopped", ID: msg.ID}
+	}
+	var reply Message
+	p.handleMessage(&msg, sourceEmbedded, func(resp Message) {
+		if reply.Type == "" {
+			reply = resp
+		}
+	})
+	return reply
+}
+
+// The settings a proxy's routes carry from its start message
+type proxySettings struct {
+	chain        []Middleware
+	connectPorts map[int]bool
+	socksPorts   map[int]bool
+	forwarded    string // forwardedHeaders policy
+	blockPrivate bool
+	systemHosts  bool
+	token        string // Proxy auth token, "" when proxyAuth is off
+	hooks        *hookSet
+	health       *healthState
+
+	// Replaced by setTape and setParentProxy while the proxy runs
+	tape   atomic.Pointer[activeTape]
+	parent atomic.Pointer[parentConfig]
+
+	// Set once the proxy is stopped; connections of its routes registered
+	// after that are closed straight away
+	stopped bool
+}
+
+// Settings from a start message, defaults for those it leaves out
+func newProxySettings(msg *Message) (*proxySettings, error) {
+	chain, err := buildChain(msg.Middleware)
+	if err != nil {
+		return nil, err
+	}
+	forwarded, err := forwardedPolicy(msg.ForwardedHeaders)
+	if err != nil {
+		return nil, err
+	}
+	hooks, err := newHookSet(msg.Hooks)
+	if err != nil {
+		return nil, err
+	}
+	parent, err := newParentConfig(msg.ParentProxy)
+	if err != nil {
+		return nil, err
+	}
+	tape, _, err := newTape(msg.Tape)
+	if err != nil {
+		return nil, err
+	}
+	settings := &proxySettings{
+		chain:        chain,
+		connectPorts: connectPortSet(msg.ConnectPorts, defaultConnectPorts),
+		socksPorts:   connectPortSet(msg.ConnectPorts, defaultSocksPorts),
+		forwarded:    forwarded,
+		blockPrivate: msg.BlockPrivate,
+		systemHosts:  msg.SystemHosts,
+		hooks:        hooks,
+		health:       newHealthState(),
+	}
+	settings.parent.Store(parent)
+	settings.tape.Store(tape)
+	if msg.ProxyAuth {
+		if settings.token, err = newProxyToken(); err != nil {
+			return nil, err
+		}
+	}
+	return settings, nil
+}
+
+// The proxy's settings, or the defaults while it is stopped
+func (p *Proxy) currentSettings() *proxySettings {
+	if settings := p.settings.Load(); settings != nil {
+		return settings
+	}
+	settings, _ := newProxySettings(&Message{})
+	return settings
+}
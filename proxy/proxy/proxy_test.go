@@ -0,0 +1,319 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+)
+
+// Backend answering with its name
+func namedBackend(t *testing.T, name string) string {
+	t.Helper()
+	srv := httptest.NewServer(http.HandlerFunc(func(w http.ResponseWriter, r *http.Request) {
+		io.WriteString(w, name)
+	}))
+	t.Cleanup(srv.Close)
+	return strings.TrimPrefix(srv.URL, "http://")
+}
+
+// Start p on a free port with mappings, stopping it when the test ends
+func startProxy(t *testing.T, p *Proxy, mappings map[string]string) {
+	t.Helper()
+	port := 0
+	if err := p.Start(context.Background(), Message{Port: &port, Mappings: mappings}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Stop)
+}
+
+// GET rawURL through the proxy listening on port
+func getVia(port int, rawURL string) (string, error) {
+	proxyURL := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", port)}
+	client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+	defer client.CloseIdleConnections()
+	resp, err := client.Get(rawURL)
+	if err != nil {
+		return "", err
+	}
+	defer resp.Body.Close()
+	body, err := io.ReadAll(resp.Body)
+	return string(body), err
+}
+
+func TestProxiesRouteIndependently(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	a, b := New(nil), New(nil)
+	backendA, backendB := namedBackend(t, "a"), namedBackend(t, "b")
+	startProxy(t, a, map[string]string{"app.test": backendA})
+	startProxy(t, b, map[string]string{"app.test": backendB})
+
+	for _, tt := range []struct {
+		p    *Proxy
+		want string
+	}{{a, "a"}, {b, "b"}} {
+		if got, err := getVia(tt.p.Port(), "http://app.test/"); err != nil || got != tt.want {
+			t.Errorf("proxy %s: got %q, %v", tt.want, got, err)
+		}
+	}
+
+	// Updating one leaves the other alone
+	if err := a.UpdateMappings(map[string]string{"app.test": backendB}); err != nil {
+		t.Fatal(err)
+	}
+	if got, err := getVia(a.Port(), "http://app.test/"); err != nil || got != "b" {
+		t.Errorf("updated proxy: got %q, %v", got, err)
+	}
+	b.Stop()
+	if got, err := getVia(a.Port(), "http://app.test/"); err != nil || got != "b" {
+		t.Errorf("after stopping the other proxy: got %q, %v", got, err)
+	}
+	if n, _ := b.mappingsState(); n != 1 {
+		t.Errorf("stopped proxy has %d mappings, want 1", n)
+	}
+}
+
+func TestProxyAuthPerProxy(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	backend := namedBackend(t, "ok")
+	a, b := New(nil), New(nil)
+	port := 0
+	err := a.Start(context.Background(), Message{Port: &port, ProxyAuth: true, Mappings: map[string]string{"app.test": backend}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(a.Stop)
+	token := a.currentSettings().token
+
+	status := func(p *Proxy, credential string) int {
+		t.Helper()
+		req, _ := http.NewRequest(http.MethodGet, "http://app.test/", nil)
+		if credential != "" {
+			req.Header.Set("Proxy-Authorization", "Bearer "+credential)
+		}
+		proxyURL := &url.URL{Scheme: "http", Host: fmt.Sprintf("127.0.0.1:%d", p.Port())}
+		client := &http.Client{Transport: &http.Transport{Proxy: http.ProxyURL(proxyURL)}}
+		defer client.CloseIdleConnections()
+		resp, err := client.Do(req)
+		if err != nil {
+			t.Fatal(err)
+		}
+		resp.Body.Close()
+		return resp.StatusCode
+	}
+	check := func(when string) {
+		t.Helper()
+		if got := status(a, ""); got != http.StatusProxyAuthRequired {
+			t.Errorf("%s: without the token got %d, want 407", when, got)
+		}
+		if got := status(a, token); got != http.StatusOK {
+			t.Errorf("%s: with the token got %d, want 200", when, got)
+		}
+	}
+
+	check("alone")
+	startProxy(t, b, map[string]string{"app.test": backend})
+	check("with another proxy running")
+	if got := status(b, ""); got != http.StatusOK {
+		t.Errorf("proxy without auth got %d, want 200", got)
+	}
+	b.Stop()
+	check("after the other proxy stopped")
+}
+
+func TestFailedStartLeavesNothingRunning(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	p := New(nil)
+	port := 0
+	err := p.Start(context.Background(), Message{
+		Port:      &port,
+		ProxyAuth: true,
+		Hooks:     []Hook{{Event: "mappingHit", Command: []string{"true"}}},
+		Listeners: []Listener{{Type: "socks"}, {Type: "bogus"}},
+	})
+	if err == nil {
+		p.Stop()
+		t.Fatal("start with an unknown listener type succeeded")
+	}
+	if p.running() || p.settings.Load() != nil || len(p.socksListeners) != 0 {
+		t.Error("failed start left the proxy half started")
+	}
+	if n := mappingHitHooks.Load(); n != 0 {
+		t.Errorf("failed start left %d mappingHit hooks counted", n)
+	}
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+	if servicesOwner == p {
+		t.Error("failed start took over the process services")
+	}
+}
+
+func TestEmbeddedIgnoresHeartbeatTimeout(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	p := New(nil)
+	port := 0
+	if err := p.Start(context.Background(), Message{Port: &port, HeartbeatTimeoutMs: 40}); err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Stop)
+	// A watchdog would have stopped the proxy and exited the test binary
+	time.Sleep(200 * time.Millisecond)
+	if !p.running() {
+		t.Error("embedded proxy stopped with no extension sending heartbeats")
+	}
+}
+
+func TestProxiesConcurrentStartStop(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	proxies := []*Proxy{New(nil), New(nil)}
+	backends := []string{namedBackend(t, "a"), namedBackend(t, "b")}
+
+	var wg, traffic sync.WaitGroup
+	done := make(chan struct{})
+	for i, p := range proxies {
+		i, p := i, p
+		wg.Add(2)
+		traffic.Add(1)
+		// Start, send a request, stop
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 20; j++ {
+				port := 0
+				if err := p.Start(context.Background(), Message{Port: &port}); err != nil {
+					t.Error(err)
+					return
+				}
+				if got, err := getVia(p.Port(), "http://app.test/"); err == nil && got != "a" && got != "b" {
+					t.Errorf("got %q from neither backend", got)
+				}
+				p.Stop()
+			}
+		}()
+		// Replace the mappings
+		go func() {
+			defer wg.Done()
+			for j := 0; j < 50; j++ {
+				if err := p.UpdateMappings(map[string]string{"app.test": backends[(i+j)%2]}); err != nil {
+					t.Error(err)
+					return
+				}
+			}
+		}()
+		// Send traffic whenever the proxy happens to be up
+		go func() {
+			defer traffic.Done()
+			for {
+				select {
+				case <-done:
+					return
+				default:
+				}
+				if port := p.Port(); port != 0 {
+					getVia(port, "http://app.test/")
+				}
+			}
+		}()
+	}
+	wg.Wait()
+	close(done)
+	traffic.Wait()
+
+	for _, p := range proxies {
+		if p.running() {
+			t.Error("proxy still running after its last Stop")
+		}
+	}
+}
+
+func TestNewReturnsFreshProxies(t *testing.T) {
+	a, b := New(nil), New(nil)
+	if a == b || a == engine || b == engine {
+		t.Fatal("New returned a shared proxy")
+	}
+	if err := a.UpdateMappings(map[string]string{"app.test": "127.0.0.1:3000"}); err != nil {
+		t.Fatal(err)
+	}
+	if rt := b.resolveRoute("app.test", "80"); rt.mapped {
+		t.Errorf("mapping on one proxy routes another: %s", rt.addr)
+	}
+}
+
+// TCP server echoing what it reads, returning its address
+func echoBackend(t *testing.T) string {
+	t.Helper()
+	ln, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { ln.Close() })
+	go func() {
+		for {
+			conn, err := ln.Accept()
+			if err != nil {
+				return
+			}
+			go func() {
+				defer conn.Close()
+				io.Copy(conn, conn)
+			}()
+		}
+	}()
+	return ln.Addr().String()
+}
+
+// Open a CONNECT tunnel to hostport through the proxy on port
+func openTunnel(t *testing.T, port int, hostport string) (net.Conn, *bufio.Reader) {
+	t.Helper()
+	conn, err := net.Dial("tcp", fmt.Sprintf("127.0.0.1:%d", port))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { conn.Close() })
+	fmt.Fprintf(conn, "CONNECT %s HTTP/1.1\r\nHost: %s\r\n\r\n", hostport, hostport)
+	br := bufio.NewReader(conn)
+	resp, err := http.ReadResponse(br, nil)
+	if err != nil || resp.StatusCode != http.StatusOK {
+		t.Fatalf("CONNECT %s: %v, %v", hostport, resp, err)
+	}
+	return conn, br
+}
+
+func TestStopClosesTunnels(t *testing.T) {
+	t.Setenv("HOME", t.TempDir())
+	a, b := New(nil), New(nil)
+	backend := echoBackend(t)
+	startProxy(t, a, map[string]string{"echo.test": backend})
+	startProxy(t, b, map[string]string{"echo.test": backend})
+	connA, readA := openTunnel(t, a.Port(), "echo.test:443")
+	connB, readB := openTunnel(t, b.Port(), "echo.test:443")
+	for _, tunnel := range []struct {
+		conn net.Conn
+		r    *bufio.Reader
+	}{{connA, readA}, {connB, readB}} {
+		io.WriteString(tunnel.conn, "ping\n")
+		if line, err := tunnel.r.ReadString('\n'); err != nil || line != "ping\n" {
+			t.Fatalf("echo through tunnel: %q, %v", line, err)
+		}
+	}
+
+	a.Stop()
+	connA.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if _, err := readA.ReadByte(); err != io.EOF {
+		t.Errorf("read from a stopped proxy's tunnel: %v, want EOF", err)
+	}
+
+	// The other proxy's tunnel stays up
+	io.WriteString(connB, "pong\n")
+	connB.SetReadDeadline(time.Now().Add(5 * time.Second))
+	if line, err := readB.ReadString('\n'); err != nil || line != "pong\n" {
+		t.Errorf("echo through the other proxy's tunnel: %q, %v", line, err)
+	}
+}
@@ -0,0 +1,61 @@
+package proxy
+
+import (
+	"net"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"fhosts-proxy/mapping"
+)
+
+// Rewrite Location headers and Set-Cookie domains that name the mapped
+// target back to the host the browser asked for, so follow-up requests
+// keep going through the mapping. scheme and requestHost describe the
+// browser's side of the request.
+func rewriteRedirects(h http.Header, rt route, scheme, requestHost string) {
+	targetHost := rt.targetHostname()
+	if targetHost == "" || targetHost == rt.host {
+		return
+	}
+
+	if location := h.Get("Location"); location != "" {
+		if u, err := url.Parse(location); err == nil && u.IsAbs() && mapping.NormalizeHost(u.Hostname()) == targetHost {
+			u.Scheme = scheme
+			u.Host = requestHost
+			h.Set("Location", u.String())
+		}
+	}
+
+	cookies := h.Values("Set-Cookie")
+	for i, cookie := range cookies {
+		cookies[i] = rewriteCookieDomain(cookie, targetHost, rt.host)
+	}
+}
+
+// Replace a Set-Cookie Domain attribute naming from with to
+func rewriteCookieDomain(cookie, from, to string) string {
+	parts := strings.Split(cookie, ";")
+	for i, part := range parts {
+		name, value, ok := strings.Cut(strings.TrimSpace(part), "=")
+		if !ok || !strings.EqualFold(name, "domain") {
+			continue
+		}
+		if mapping.NormalizeHost(strings.TrimPrefix(value, ".")) == from {
+			parts[i] = " Domain=" + to
+		}
+	}
+	return strings.Join(parts, ";")
+}
+
+// Hostname of the mapped target, empty for Unix socket routes
+func (rt route) targetHostname() string {
+	if rt.network != "tcp" {
+		return ""
+	}
+	host, _, err := net.SplitHostPort(rt.addr)
+	if err != nil {
+		return ""
+	}
+	return mapping.NormalizeHost(host)
+}
@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"context"
+	"net"
+	"strconv"
+)
+
+// Rebind the running proxy to the port and IPv6 setting in msg without
+// dropping traffic. New listeners are bound before the old ones close, and
+// since the same http.Server keeps running, in-flight requests and CONNECT
+// tunnels drain on their existing connections. Mappings, the bind address
+// and other settings are left alone; a stopped proxy is started instead.
+// Callers hold actionsMu.
+func (p *Proxy) restart(msg *Message) error {
+	if !p.running() {
+		return p.start(context.Background(), msg)
+	}
+	current := p.Port()
+	port, err := requestedPort(msg, current)
+	if err != nil {
+		return err
+	}
+	hasIPv6 := len(p.listeners) > 1
+	ipv6 := msg.IPv6 && p.bindHost() == loopbackHost
+	if port == current && ipv6 == hasIPv6 {
+		return nil // Nothing to rebind
+	}
+
+	var added, retired []net.Listener
+	if port == current {
+		// Same port: keep the IPv4 listener and only add or drop IPv6
+		if ipv6 {
+			l6, err := net.Listen("tcp", net.JoinHostPort("::1", strconv.Itoa(port)))
+			if err != nil {
+				return err
+			}
+			added = []net.Listener{l6}
+		} else {
+			retired = p.listeners[1:]
+		}
+		p.listeners = append(p.listeners[:1:1], added...)
+	} else {
+		added, err = listenProxy(p.bindHost(), port, ipv6)
+		if err != nil {
+			return err // Old listeners keep serving
+		}
+		retired = p.listeners
+		p.listeners = added
+	}
+
+	p.port.Store(int64(p.listeners[0].Addr().(*net.TCPAddr).Port))
+	for _, l := range added {
+		go serve(p.server, l, p.currentSettings())
+	}
+	for _, l := range retired {
+		l.Close()
+	}
+	return nil
+}
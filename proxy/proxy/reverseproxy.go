@@ -0,0 +1,100 @@
+package proxy
+
+import (
+	"context"
+	"log"
+	"net/http"
+	"net/http/httputil"
+	"strings"
+	"sync/atomic"
+)
+
+// How forwardHTTP reaches a route's target
+type forwarding struct {
+	proto     string // Scheme the client used: http, or https under MITM
+	scheme    string // Scheme the target is sent the request with
+	transport func(route) http.RoundTripper
+}
+
+// Plain HTTP proxy requests
+var plainForwarding = forwarding{proto: "http", scheme: "http", transport: transportFor}
+
+// Forward a request along its route with httputil.ReverseProxy, which
+// removes hop-by-hop headers, relays interim responses, trailers and
+// protocol upgrades, flushes streamed bodies and aborts the response when
+// its body fails partway. The mapping's failover, headers, middleware and
+// accounting are layered on through its hooks.
+func forwardHTTP(w http.ResponseWriter, r *http.Request, flow *Flow, rt route, via forwarding, trace *trafficTrace, capture *harCapture) {
+	// Listed by listConnections; closing it cancels the forward
+	ctx, cancel := context.WithCancel(r.Context())
+	defer cancel()
+	conn := trackConnection("http", r.RemoteAddr, rt, cancel)
+	defer conn.untrack()
+
+	counters := countersFor(rt)
+	var resp *http.Response // Once the target answered
+	var bytesIn atomic.Int64
+	defer func() {
+		// Also when the copy aborts the response
+		if resp != nil {
+			trace.finish(r.Method, rt, resp.StatusCode, bytesIn.Load())
+			capture.finish(resp, rt)
+		}
+	}()
+
+	proxy := &httputil.ReverseProxy{
+		Rewrite: func(pr *httputil.ProxyRequest) {
+			out := pr.Out
+			out.URL.Scheme = via.scheme
+			out.URL.Host = rt.urlHost(pr.In.Host)
+			out.Host = rt.hostHeader(pr.In.Host)
+			// Shared so trailer values read after the body are sent on too
+			out.Trailer = pr.In.Trailer
+			applyForwardedHeaders(out, pr.In, rt, via.proto)
+			trace.propagate(out.Header)
+
+			if out.Body != nil {
+				out.Body = conn.countBodyOut(trace.countBodyOut(counters.countBodyOut(capture.requestBody(out.Body))))
+			}
+		},
+		Transport: roundTripperFunc(func(req *http.Request) (*http.Response, error) {
+			res, final, err := roundTripFailover(trace.withClientTrace(req), rt, r.Host, r.Body != http.NoBody, via.transport)
+			rt = final
+			return res, err
+		}),
+		ModifyResponse: func(res *http.Response) error {
+			if rt.options.RewriteRedirects {
+				rewriteRedirects(res.Header, rt, via.proto, r.Host)
+			}
+			responseChain(flow, r, res)
+			resp = res
+			if res.StatusCode == http.StatusSwitchingProtocols {
+				return nil // ReverseProxy needs the writable body to relay the upgrade
+			}
+			body := conn.countBodyIn(capture.responseBody(res.Body))
+			body = counters.countBodyIn(body)
+			res.Body = readCloser(&countingReader{Reader: body, n: &bytesIn}, body)
+			if rt.options.Chaos != nil {
+				res.Body = flushOnTruncation(res.Body, w)
+			}
+			return nil
+		},
+		ErrorHandler: func(w http.ResponseWriter, req *http.Request, err error) {
+			counters.countError()
+			sendError(rt.settings, forwardErrorCode(err), "%s proxy error: %v", strings.ToUpper(via.proto), err)
+			status := forwardErrorStatus(err)
+			http.Error(w, http.StatusText(status), status)
+			trace.finish(r.Method, rt, status, 0)
+			capture.finish(nil, rt)
+		},
+		ErrorLog: log.New(&logWriter{prefix: "HTTP forward: "}, "", 0),
+	}
+	proxy.ServeHTTP(w, r.WithContext(ctx))
+}
+
+// An http.RoundTripper from a function
+type roundTripperFunc func(*http.Request) (*http.Response, error)
+
+func (f roundTripperFunc) RoundTrip(req *http.Request) (*http.Response, error) {
+	return f(req)
+}
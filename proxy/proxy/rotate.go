@@ -0,0 +1,140 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"sort"
+	"sync"
+	"time"
+)
+
+// Rotation and retention for the log file and the access log. Zero values
+// turn each limit off.
+type LogRotation struct {
+	MaxSizeMB  int `json:"maxSizeMB,omitempty"`  // Rotate once the file would grow past this
+	MaxAgeDays int `json:"maxAgeDays,omitempty"` // Rotate files open this long, and delete older rotated ones
+	MaxBackups int `json:"maxBackups,omitempty"` // Rotated files to keep
+}
+
+var (
+	logRotation   LogRotation
+	logRotationMu sync.Mutex
+)
+
+func configureLogRotation(r LogRotation) {
+	logRotationMu.Lock()
+	logRotation = r
+	logRotationMu.Unlock()
+}
+
+func currentLogRotation() LogRotation {
+	logRotationMu.Lock()
+	defer logRotationMu.Unlock()
+	return logRotation
+}
+
+// An append-only file that renames itself to path.<timestamp> and starts
+// over when it hits the rotation limits
+type rotatingFile struct {
+	mu     sync.Mutex
+	path   string
+	f      *os.File
+	size   int64
+	opened time.Time
+}
+
+func openRotatingFile(path string) (*rotatingFile, error) {
+	r := &rotatingFile{path: path}
+	if err := r.open(); err != nil {
+		return nil, err
+	}
+	return r, nil
+}
+
+func (r *rotatingFile) open() error {
+	f, err := os.OpenFile(r.path, os.O_CREATE|os.O_WRONLY|os.O_APPEND, 0600)
+	if err != nil {
+		return err
+	}
+	info, err := f.Stat()
+	if err != nil {
+		f.Close()
+		return err
+	}
+	r.f, r.size, r.opened = f, info.Size(), time.Now()
+	return nil
+}
+
+func (r *rotatingFile) Write(p []byte) (int, error) {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+
+	limits := currentLogRotation()
+	tooBig := limits.MaxSizeMB > 0 && r.size > 0 && r.size+int64(len(p)) > int64(limits.MaxSizeMB)<<20
+	tooOld := limits.MaxAgeDays > 0 && time.Since(r.opened) > time.Duration(limits.MaxAgeDays)*24*time.Hour
+	if tooBig || tooOld {
+		r.rotateLocked() // On failure keep appending to the current file
+	}
+	if r.f == nil {
+		return 0, os.ErrClosed
+	}
+	n, err := r.f.Write(p)
+	r.size += int64(n)
+	return n, err
+}
+
+// Start a new file now
+func (r *rotatingFile) Rotate() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	return r.rotateLocked()
+}
+
+func (r *rotatingFile) rotateLocked() error {
+	if r.f == nil {
+		return os.ErrClosed
+	}
+	r.f.Close()
+	r.f = nil
+	renameErr := os.Rename(r.path, r.path+"."+time.Now().Format("20060102-150405.000"))
+	if err := r.open(); err != nil {
+		return err
+	}
+	go pruneRotated(r.path)
+	return renameErr
+}
+
+func (r *rotatingFile) Close() error {
+	r.mu.Lock()
+	defer r.mu.Unlock()
+	if r.f == nil {
+		return nil
+	}
+	err := r.f.Close()
+	r.f = nil
+	return err
+}
+
+// Delete rotated copies of path beyond MaxBackups or older than MaxAgeDays
+func pruneRotated(path string) {
+	limits := currentLogRotation()
+	matches, _ := filepath.Glob(path + ".*")
+	sort.Sort(sort.Reverse(sort.StringSlice(matches))) // Newest first, by timestamp suffix
+
+	kept := 0
+	for _, name := range matches {
+		if _, err := time.Parse("20060102-150405.000", name[len(path)+1:]); err != nil {
+			continue // Not one of ours
+		}
+		info, err := os.Stat(name)
+		if err != nil {
+			continue
+		}
+		expired := limits.MaxAgeDays > 0 && time.Since(info.ModTime()) > time.Duration(limits.MaxAgeDays)*24*time.Hour
+		if expired || (limits.MaxBackups > 0 && kept >= limits.MaxBackups) {
+			os.Remove(name)
+			continue
+		}
+		kept++
+	}
+}
@@ -0,0 +1,198 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"crypto/tls"
+	"fmt"
+	"net"
+	"net/http"
+	"strings"
+	"time"
+
+	"fhosts-proxy/mapping"
+)
+
+// The result of a testMapping action: the host's route checked step by
+// step, so the extension can show a mapping as verified before it is
+// relied on. A failed step skips the ones after it.
+type MappingTest struct {
+	Host   string     `json:"host"`
+	Mapped bool       `json:"mapped"`
+	Target string     `json:"target"` // Address, socket path or directory tested
+	OK     bool       `json:"ok"`
+	Steps  []TestStep `json:"steps"`
+}
+
+type TestStep struct {
+	Name       string `json:"name"` // dns, dial, tls or head
+	OK         bool   `json:"ok"`
+	Skipped    bool   `json:"skipped,omitempty"` // Not needed for this target, or an earlier step failed
+	Detail     string `json:"detail,omitempty"`  // What the step found, or why it failed
+	DurationMs int64  `json:"durationMs"`
+}
+
+// The whole test gives up after this long
+const mappingTestTimeout = 10 * time.Second
+
+// Test host ("name" or "name:port") along its route. scheme is https (the
+// default, port 443 and a TLS handshake) or http.
+func (p *Proxy) testMapping(host, scheme string) (*MappingTest, error) {
+	if scheme == "" {
+		scheme = "https"
+	}
+	if scheme != "http" && scheme != "https" {
+		return nil, fmt.Errorf("unknown scheme %q", scheme)
+	}
+	port := "443"
+	if scheme == "http" {
+		port = "80"
+	}
+	if h, p, err := net.SplitHostPort(host); err == nil {
+		host, port = h, p
+	}
+	host = mapping.Unbracket(host)
+	if host == "" {
+		return nil, fmt.Errorf("no host to test")
+	}
+
+	rt := p.resolveRoute(host, port)
+	result := &MappingTest{Host: mapping.NormalizeHost(host), Mapped: rt.mapped, Target: rt.addr}
+	ctx, cancel := context.WithTimeout(context.Background(), mappingTestTimeout)
+	defer cancel()
+
+	step := func(name string, run func() (string, error)) bool {
+		start := time.Now()
+		detail, err := run()
+		s := TestStep{Name: name, OK: err == nil, Detail: detail, DurationMs: time.Since(start).Milliseconds()}
+		if err != nil {
+			s.Detail = err.Error()
+		}
+		result.Steps = append(result.Steps, s)
+		return err == nil
+	}
+	skip := func(name, detail string) {
+		result.Steps = append(result.Steps, TestStep{Name: name, OK: true, Skipped: true, Detail: detail})
+	}
+	fail := func(names ...string) {
+		for _, name := range names {
+			result.Steps = append(result.Steps, TestStep{Name: name, Skipped: true, Detail: "earlier step failed"})
+		}
+	}
+
+	// Directories have nothing to resolve or dial
+	if rt.network == "file" {
+		skip("dns", "file mapping")
+		skip("dial", "file mapping")
+		skip("tls", "file mapping")
+		result.OK = step("head", func() (string, error) {
+			req, _ := http.NewRequestWithContext(ctx, http.MethodHead, "http://"+host+"/", nil)
+			return headStatus(fileTransport(rt).RoundTrip(req))
+		})
+		return result, nil
+	}
+
+	switch {
+	case rt.network == "unix":
+		skip("dns", "Unix socket")
+	case rt.parent != nil:
+		skip("dns", "resolved by the parent proxy")
+	default:
+		target, _, _ := net.SplitHostPort(rt.addr)
+		if net.ParseIP(target) != nil {
+			skip("dns", "IP address")
+			break
+		}
+		ok := step("dns", func() (string, error) {
+			lookup := lookupSystem
+			if rt.mapped {
+				lookup = func(ctx context.Context, host string) ([]net.IP, error) {
+					return resolveCached(ctx, host, rt.dnsServer)
+				}
+			}
+			ips, err := lookup(ctx, target)
+			names := make([]string, len(ips))
+			for i, ip := range ips {
+				names[i] = ip.String()
+			}
+			return strings.Join(names, ", "), err
+		})
+		if !ok {
+			fail("dial", "tls", "head")
+			return result, nil
+		}
+	}
+
+	var conn net.Conn
+	ok := step("dial", func() (string, error) {
+		var err error
+		if rt.offline {
+			err = offlineError()
+		} else {
+			conn, err = rt.dialOnce(ctx)
+		}
+		if err != nil {
+			return "", err
+		}
+		return conn.RemoteAddr().String(), nil
+	})
+	if !ok {
+		fail("tls", "head")
+		return result, nil
+	}
+	defer func() { conn.Close() }()
+	deadline, _ := ctx.Deadline()
+	conn.SetDeadline(deadline)
+
+	// The proxy only speaks TLS to the target itself in MITM mode, but the
+	// browser does the same handshake through a tunnel
+	if scheme == "http" || rt.options.Scheme == "http" {
+		skip("tls", "plain HTTP")
+	} else {
+		ok := step("tls", func() (string, error) {
+			config := upstreamTLSConfig()
+			config.ServerName = host
+			config.InsecureSkipVerify = rt.options.InsecureSkipVerify
+			if cert := rt.clientCert(); cert != (ClientCert{}) {
+				config.GetClientCertificate = cert.provider()
+			}
+			tlsConn := tls.Client(conn, config)
+			if err := tlsConn.HandshakeContext(ctx); err != nil {
+				return "", err
+			}
+			conn = tlsConn
+			state := tlsConn.ConnectionState()
+			return tls.VersionName(state.Version) + ", " + state.PeerCertificates[0].Subject.CommonName, nil
+		})
+		if !ok {
+			fail("head")
+			return result, nil
+		}
+	}
+
+	result.OK = step("head", func() (string, error) {
+		req, err := http.NewRequestWithContext(ctx, http.MethodHead, scheme+"://"+host+"/", nil)
+		if err != nil {
+			return "", err
+		}
+		req.Header.Set("User-Agent", "fhosts-proxy/"+version+" self-test")
+		req.Close = true
+		if err := req.Write(conn); err != nil {
+			return "", err
+		}
+		return headStatus(http.ReadResponse(bufio.NewReader(conn), req))
+	})
+	return result, nil
+}
+
+// The status line of a HEAD response; 5xx counts as a failure
+func headStatus(resp *http.Response, err error) (string, error) {
+	if err != nil {
+		return "", err
+	}
+	resp.Body.Close()
+	if resp.StatusCode >= 500 {
+		return "", fmt.Errorf("HEAD / returned %s", resp.Status)
+	}
+	return resp.Status, nil
+}
@@ -0,0 +1,1040 @@
+package proxy
+
+import (
+	"bufio"
+	"context"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"net/http"
+	"os"
+	"slices"
+	"strconv"
+	"strings"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"sigs.k8s.io/yaml"
+
+	"fhosts-proxy/mapping"
+	"fhosts-proxy/nativemsg"
+)
+
+const defaultProxyPort = 8899
+
+// Native messaging message types
+type Message struct {
+	Action             string                    `json:"action,omitempty"`
+	Type               string                    `json:"type,omitempty"`
+	ID                 json.RawMessage           `json:"id,omitempty"` // Echoed back in replies
+	Mappings           mapping.Set               `json:"mappings,omitempty"`
+	Disabled           mapping.Set               `json:"disabled,omitempty"` // Host mappings kept but switched off
+	Regex              []mapping.RegexMapping    `json:"regexMappings,omitempty"`
+	Options            map[string]MappingOptions `json:"options,omitempty"`
+	Message            string                    `json:"message,omitempty"`
+	ErrorCode          string                    `json:"errorCode,omitempty"`
+	Port               *int                      `json:"port,omitempty"` // 0 picks a free port
+	IPv6               bool                      `json:"ipv6,omitempty"`
+	Count              int                       `json:"count,omitempty"`
+	Cert               string                    `json:"cert,omitempty"`
+	Timeouts           *Timeouts                 `json:"timeouts,omitempty"`
+	MaxConnections     int                       `json:"maxConnections,omitempty"`
+	Blocked            map[string]BlockRule      `json:"blocked,omitempty"`
+	HeaderRules        map[string]HeaderRules    `json:"headerRules,omitempty"`
+	Mocks              map[string][]MockRule     `json:"mocks,omitempty"`
+	BodyRules          map[string][]BodyRule     `json:"bodyRules,omitempty"`
+	Hosts              []string                  `json:"hosts,omitempty"`
+	Revision           int64                     `json:"revision,omitempty"`
+	Status             *ProxyStatus              `json:"status,omitempty"`
+	Stats              map[string]HostStats      `json:"stats,omitempty"`
+	StatsIntervalMs    int                       `json:"statsIntervalMs,omitempty"`
+	Protocol           int                       `json:"protocol,omitempty"` // Native messaging protocol version
+	Version            string                    `json:"version,omitempty"`
+	Features           []string                  `json:"features,omitempty"`
+	HeartbeatTimeoutMs int                       `json:"heartbeatTimeoutMs,omitempty"` // Exit when the extension is silent this long
+	Level              string                    `json:"level,omitempty"`              // debug, info, warn or error
+	Logs               []LogEntry                `json:"logs,omitempty"`               // Batched log lines
+	Traffic            *TrafficEvent             `json:"traffic,omitempty"`
+	Config             *ProxyConfig              `json:"config,omitempty"`
+	Capabilities       *Capabilities             `json:"capabilities,omitempty"`
+	Path               string                    `json:"path,omitempty"`    // File on the host's filesystem
+	Content            string                    `json:"content,omitempty"` // Inline file contents
+	Profile            string                    `json:"profile,omitempty"` // Profile name
+	Profiles           []string                  `json:"profiles,omitempty"`
+	Daemon             bool                      `json:"daemon,omitempty"`    // Hand the proxy to a detached daemon
+	WatchFile          string                    `json:"watchFile,omitempty"` // Hosts or JSON file to hot-reload mappings from
+	AccessLog          string                    `json:"accessLog,omitempty"` // File to append JSON access log lines to
+	AdminPort          int                       `json:"adminPort,omitempty"` // Loopback port for the admin HTTP API
+	Connections        []ConnectionInfo          `json:"connections,omitempty"`
+	ConnectionID       int64                     `json:"connectionId,omitempty"`     // Connection for closeConnection
+	OTLPEndpoint       string                    `json:"otlpEndpoint,omitempty"`     // OTLP/HTTP traces URL to export spans to
+	Host               string                    `json:"host,omitempty"`             // Mapping host of a targetDown or targetUp event; host[:port] to testMapping
+	Target             string                    `json:"target,omitempty"`           // Target address of a targetDown or targetUp event
+	SystemHosts        bool                      `json:"systemHosts,omitempty"`      // Fall back to the system hosts file for unmapped hosts
+	Backend            *MappingBackend           `json:"backend,omitempty"`          // Consul or etcd prefix to sync mappings from
+	ProxyAuth          bool                      `json:"proxyAuth,omitempty"`        // Require the proxyToken from clients
+	ProxyToken         string                    `json:"proxyToken,omitempty"`       // Credential clients must present when proxyAuth is on
+	ConnectPorts       []int                     `json:"connectPorts,omitempty"`     // Ports CONNECT and SOCKS may reach; 443, and 80 for SOCKS, when empty
+	BlockPrivate       bool                      `json:"blockPrivate,omitempty"`     // Refuse unmapped hosts on private addresses
+	CABundle           string                    `json:"caBundle,omitempty"`         // PEM file of extra CAs trusted for targets' certificates
+	ParentProxy        *ParentProxy              `json:"parentProxy,omitempty"`      // Upstream proxy for unmapped traffic (start, setParentProxy)
+	Audit              []AuditEntry              `json:"audit,omitempty"`            // Entries of the auditLog reply
+	Middleware         []string                  `json:"middleware,omitempty"`       // Names of the middleware chain, in order
+	GRPC               string                    `json:"grpc,omitempty"`             // "unix" or a loopback host:port for the gRPC control API
+	Listeners          []Listener                `json:"listeners,omitempty"`        // Extra listeners for start; every bound one in started
+	BindAddress        string                    `json:"bindAddress,omitempty"`      // Address to listen on instead of 127.0.0.1
+	AllowRemote        bool                      `json:"allowRemote,omitempty"`      // Confirm a bindAddress reachable from the network
+	Tape               *Tape                     `json:"tape,omitempty"`             // Record or replay responses (start, setTape)
+	Hooks              []Hook                    `json:"hooks,omitempty"`            // Commands to run on events
+	Offline            bool                      `json:"offline,omitempty"`          // setHostOffline: take hosts offline, or back online when false
+	Scheme             string                    `json:"scheme,omitempty"`           // testMapping: https (the default) or http
+	MappingTest        *MappingTest              `json:"mappingTest,omitempty"`      // Reply to testMapping
+	ForwardedHeaders   string                    `json:"forwardedHeaders,omitempty"` // preserve (default), append or strip proxy headers on forwarded requests
+}
+
+// Read a native messaging message from stdin
+func readMessage(reader *bufio.Reader) (*Message, error) {
+	data, err := nativemsg.Read(reader)
+	if err != nil {
+		return nil, err
+	}
+	var msg Message
+	if err := json.Unmarshal(data, &msg); err != nil {
+		return nil, err
+	}
+	return &msg, nil
+}
+
+// Where sendMessage delivers replies and events: the extension over stdout
+// for a native messaging host, stderr in standalone mode, control clients
+// in the daemon, or an embedding program's callback. Nil drops them.
+var output atomic.Pointer[func(Message)]
+
+func setOutput(out func(Message)) {
+	output.Store(&out)
+}
+
+func sendMessage(msg Message) {
+	if out := output.Load(); out != nil && *out != nil {
+		(*out)(msg)
+	}
+	publishEvent(msg)
+}
+
+// Serializes writes to stdout, since replies and events are sent from
+// many goroutines
+var stdoutMu sync.Mutex
+
+// Write a native messaging message to stdout
+func writeNative(msg Message) {
+	messageBytes, err := json.Marshal(msg)
+	if err != nil {
+		return
+	}
+	if len(messageBytes) > nativemsg.MaxMessageSize {
+		// The browser would drop the frame and disconnect us
+		messageBytes, _ = json.Marshal(Message{Type: "error", ID: msg.ID, ErrorCode: ErrCodeFrameTooLarge,
+			Message: fmt.Sprintf("%s reply of %d bytes exceeds the message size limit", msg.Type, len(messageBytes))})
+	}
+
+	stdoutMu.Lock()
+	defer stdoutMu.Unlock()
+	nativemsg.Write(os.Stdout, messageBytes)
+}
+
+// Handle HTTPS CONNECT tunneling
+func (p *Proxy) handleConnect(w http.ResponseWriter, r *http.Request) {
+	// Parse host:port from request
+	host, port, err := net.SplitHostPort(r.Host)
+	if err != nil {
+		host = mapping.Unbracket(r.Host)
+		port = "443"
+	}
+	// Look up mapping
+	rt := p.resolveRoute(host, port)
+	targetAddr := rt.addr
+
+	// Raw TCP mappings reach any port
+	if !rt.options.TCP && rejectConnectPort(w, rt, host, port) {
+		return
+	}
+
+	flow := newFlow("connect", r.RemoteAddr, rt)
+	if refuse(w, connectChain(flow)) {
+		return
+	}
+
+	if rt.mapped {
+		logInfo("Tunneling %s -> %s", r.Host, targetAddr)
+	}
+
+	// Terminate TLS ourselves for hosts in MITM mode or downgraded to HTTP
+	if rt.terminatesTLS() {
+		clientConn, ok := hijackConnect(w)
+		if ok {
+			handleMITM(clientConn, host, rt)
+		}
+		return
+	}
+
+	trace := startTrace(r.RemoteAddr)
+	countersFor(rt).countRequest()
+
+	// Connect to target
+	targetConn, rt, err := trace.dial(rt)
+	if err != nil {
+		countersFor(rt).countError()
+		sendError(rt.settings, forwardErrorCode(err), "Failed to connect to %s: %v", rt.addr, err)
+		status := forwardErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		trace.finishTunnel("CONNECT", rt, status, 0, 0)
+		return
+	}
+
+	clientConn, ok := hijackConnect(w)
+	if !ok {
+		targetConn.Close()
+		return
+	}
+
+	in, out := tunnel("connect", clientConn, targetConn, rt, flow)
+	trace.finishTunnel("CONNECT", rt, http.StatusOK, in, out)
+}
+
+// Hijack the client connection of a CONNECT request and send 200 Connection
+// Established. On failure an error response has already been written.
+func hijackConnect(w http.ResponseWriter) (net.Conn, bool) {
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return nil, false
+	}
+
+	clientConn, _, err := hijacker.Hijack()
+	if err != nil {
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return nil, false
+	}
+
+	// Send 200 Connection Established
+	clientConn.Write([]byte("HTTP/1.1 200 Connection Established\r\n\r\n"))
+	return clientConn, true
+}
+
+// Tunnel data bidirectionally between the client and the target. When one
+// direction hits EOF only that half is shut down, so protocols relying on
+// TCP half-close keep working; both conns are closed once both are done or
+// the tunnel has been idle for the idleTunnel timeout. Traffic is limited
+// by the limiters the throttle middleware gave flow and cut short by the
+// mapping's chaos byte budget. The tunnel is listed by listConnections
+// under kind. Blocks until the tunnel is torn down.
+func tunnel(kind string, clientConn, targetConn net.Conn, rt route, flow *Flow) (bytesIn, bytesOut int64) {
+	activeTunnels.Add(1)
+	defer activeTunnels.Add(-1)
+	conn := trackConnection(kind, clientConn.RemoteAddr().String(), rt, func() {
+		clientConn.Close()
+		targetConn.Close()
+	})
+	defer conn.untrack()
+
+	up, down := flow.up, flow.down
+	counters := countersFor(rt)
+	budget := newTunnelBudget(rt, clientConn, targetConn)
+
+	var lastActive atomic.Int64
+	lastActive.Store(time.Now().UnixNano())
+
+	done := make(chan struct{})
+	if idle := millis(shared().timeouts.IdleTunnel); idle > 0 {
+		go func() {
+			ticker := time.NewTicker(idle / 4)
+			defer ticker.Stop()
+			for {
+				select {
+				case <-done:
+					return
+				case now := <-ticker.C:
+					if now.Sub(time.Unix(0, lastActive.Load())) > idle {
+						clientConn.Close()
+						targetConn.Close()
+						return
+					}
+				}
+			}
+		}()
+	}
+
+	var wg sync.WaitGroup
+	wg.Add(2)
+	go func() {
+		defer wg.Done()
+		src := counters.countOut(throttle(&activityReader{Reader: clientConn, lastActive: &lastActive}, up))
+		pipe(targetConn, clientConn, budget.wrap(&countingReader{Reader: src, n: &conn.out}))
+	}()
+	go func() {
+		defer wg.Done()
+		src := counters.countIn(throttle(&activityReader{Reader: targetConn, lastActive: &lastActive}, down))
+		pipe(clientConn, targetConn, budget.wrap(&countingReader{Reader: src, n: &conn.in}))
+	}()
+	wg.Wait()
+	close(done)
+	clientConn.Close()
+	targetConn.Close()
+	return conn.in.Load(), conn.out.Load()
+}
+
+// Copy one direction of a tunnel (reading src through r), then half-close it
+func pipe(dst, src net.Conn, r io.Reader) {
+	copyBuffered(dst, r)
+	if c, ok := src.(interface{ CloseRead() error }); ok {
+		c.CloseRead()
+	}
+	if c, ok := dst.(interface{ CloseWrite() error }); ok {
+		c.CloseWrite()
+	} else {
+		// Can't half-close, so end both directions
+		dst.Close()
+		src.Close()
+	}
+}
+
+// A reader that records when it last returned data
+type activityReader struct {
+	io.Reader
+	lastActive *atomic.Int64
+}
+
+func (r *activityReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.lastActive.Store(time.Now().UnixNano())
+	}
+	return n, err
+}
+
+// Buffers for tunnel copies, reused across connections
+var copyBufPool = sync.Pool{
+	New: func() interface{} {
+		buf := make([]byte, 32*1024)
+		return &buf
+	},
+}
+
+// Copy src to dst through a pooled buffer. The reader and writer are
+// wrapped so io.CopyBuffer can't fall back to ReadFrom/WriteTo, which
+// allocate their own buffer on most platforms.
+func copyBuffered(dst io.Writer, src io.Reader) (int64, error) {
+	buf := copyBufPool.Get().(*[]byte)
+	defer copyBufPool.Put(buf)
+	return io.CopyBuffer(struct{ io.Writer }{dst}, struct{ io.Reader }{src}, *buf)
+}
+
+// Check whether a request asks for a protocol upgrade (e.g. WebSocket)
+func isUpgradeRequest(r *http.Request) bool {
+	if r.Header.Get("Upgrade") == "" {
+		return false
+	}
+	for _, value := range r.Header.Values("Connection") {
+		for _, token := range strings.Split(value, ",") {
+			if strings.EqualFold(strings.TrimSpace(token), "upgrade") {
+				return true
+			}
+		}
+	}
+	return false
+}
+
+// Handle plain-HTTP upgrade requests (ws://) by replaying the handshake to
+// the target and tunneling raw bytes, so the 101 response and frames pass
+// through untouched
+func handleUpgrade(w http.ResponseWriter, r *http.Request, rt route, flow *Flow, trace *trafficTrace) {
+	targetConn, rt, err := trace.dial(rt)
+	if err != nil {
+		countersFor(rt).countError()
+		sendError(rt.settings, forwardErrorCode(err), "Failed to connect to %s: %v", rt.addr, err)
+		status := forwardErrorStatus(err)
+		http.Error(w, http.StatusText(status), status)
+		trace.finishTunnel(r.Method, rt, status, 0, 0)
+		return
+	}
+
+	hijacker, ok := w.(http.Hijacker)
+	if !ok {
+		targetConn.Close()
+		http.Error(w, "Hijacking not supported", http.StatusInternalServerError)
+		return
+	}
+
+	clientConn, clientBuf, err := hijacker.Hijack()
+	if err != nil {
+		targetConn.Close()
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	// Forward the handshake in origin form, keeping the original Host
+	r.Header.Del("Proxy-Connection")
+	r.Header.Del("Proxy-Authorization")
+	trace.propagate(r.Header)
+	if err := r.Write(targetConn); err != nil {
+		clientConn.Close()
+		targetConn.Close()
+		return
+	}
+
+	// Pass on anything the client sent after the handshake
+	if n := clientBuf.Reader.Buffered(); n > 0 {
+		buffered, _ := clientBuf.Reader.Peek(n)
+		targetConn.Write(buffered)
+	}
+
+	in, out := tunnel("upgrade", clientConn, targetConn, rt, flow)
+	trace.finishTunnel(r.Method, rt, http.StatusSwitchingProtocols, in, out)
+}
+
+// Handle regular HTTP proxy requests
+func (p *Proxy) handleHTTP(w http.ResponseWriter, r *http.Request) {
+	// Parse the target URL
+	host := r.URL.Hostname()
+	port := r.URL.Port()
+	if port == "" {
+		port = "80"
+	}
+
+	// Look up mapping
+	rt := p.resolveRoute(host, port)
+	targetAddr := rt.addr
+
+	flow := newFlow("http", r.RemoteAddr, rt)
+	answer, err := requestChain(flow, r)
+	if refuse(w, err) {
+		return
+	}
+
+	if rt.mapped {
+		logInfo("Proxying HTTP %s -> %s", host, targetAddr)
+	}
+
+	trace := startTrace(r.RemoteAddr)
+	capture := startCapture(r, r.URL.String())
+	countersFor(rt).countRequest()
+
+	if answer != nil {
+		writeAnswer(w, r, answer, rt, trace, capture)
+		return
+	}
+
+	if isUpgradeRequest(r) {
+		handleUpgrade(w, r, rt, flow, trace)
+		return
+	}
+
+	forwardHTTP(w, r, flow, rt, plainForwarding, trace, capture)
+}
+
+// Copy a backend response to the client, counting the bytes
+func writeResponse(w http.ResponseWriter, resp *http.Response, rt route) int64 {
+	resp.Body = countersFor(rt).countBodyIn(resp.Body)
+
+	// Copy response headers, announcing the trailers
+	for key, values := range resp.Header {
+		for _, value := range values {
+			w.Header().Add(key, value)
+		}
+	}
+	announced := make([]string, 0, len(resp.Trailer))
+	for key := range resp.Trailer {
+		announced = append(announced, key)
+	}
+	if len(announced) > 0 {
+		w.Header().Set("Trailer", strings.Join(announced, ", "))
+	}
+	w.WriteHeader(resp.StatusCode)
+
+	// Copy response body
+	var n int64
+	var err error
+	if isStreaming(resp) || len(announced) > 0 {
+		// Send the headers now, as an event stream may not start for a
+		// while; this also keeps a body with trailers chunked
+		http.NewResponseController(w).Flush()
+		n, err = flushingCopy(w, resp.Body)
+	} else {
+		n, err = io.Copy(w, resp.Body)
+	}
+	if errors.Is(err, errChaosTruncated) {
+		// Send what was copied, then drop the connection (or reset the
+		// HTTP/2 stream) so the client sees the body cut off rather than
+		// a short one that looks complete
+		http.NewResponseController(w).Flush()
+		panic(http.ErrAbortHandler)
+	}
+
+	// Trailers arrive with the end of the body. Ones the target didn't
+	// announce are sent with the TrailerPrefix.
+	for key, values := range resp.Trailer {
+		if slices.Contains(announced, key) {
+			w.Header()[key] = values
+		} else {
+			w.Header()[http.TrailerPrefix+key] = values
+		}
+	}
+	return n
+}
+
+// Main proxy handler
+func (p *Proxy) proxyHandler(w http.ResponseWriter, r *http.Request) {
+	release, ok := acquireConnection()
+	if !ok {
+		http.Error(w, "Too many connections", http.StatusServiceUnavailable)
+		return
+	}
+	defer release()
+	totalRequests.Add(1)
+
+	// Browsers fetch the PAC file without proxy credentials
+	isPAC := r.URL.Host == "" && r.URL.Path == pacPath
+	if !isPAC && !authorizeProxy(w, r, p.currentSettings().token) {
+		return
+	}
+
+	if r.Method == http.MethodConnect {
+		p.handleConnect(w, r)
+	} else if isPAC {
+		p.handlePAC(w, r)
+	} else {
+		p.handleHTTP(w, r)
+	}
+}
+
+// Start the proxy server with the mappings and settings from a start
+// message. It listens on msg.Port, or defaultProxyPort when omitted; port 0
+// lets the OS pick one. With ipv6 set it also listens on the IPv6 loopback
+// address. Handlers run under a context derived from ctx, and the proxy
+// stops when ctx ends. Callers hold actionsMu.
+func (p *Proxy) start(ctx context.Context, msg *Message) error {
+	if p.running() {
+		return nil // Already running
+	}
+	port, err := requestedPort(msg, defaultProxyPort)
+	if err != nil {
+		return err
+	}
+	host, err := bindHost(msg)
+	if err != nil {
+		return err
+	}
+	// The parent proxy's transport is built from the CA bundle and
+	// timeouts, so they go first. Nothing else outside this proxy changes
+	// until its listeners are bound, so a failed start leaves the rest of
+	// the process as it was.
+	configureUpstreamCAs(msg.CABundle)
+	configureTimeouts(msg.Timeouts)
+	settings, err := newProxySettings(msg)
+	if err != nil {
+		return err
+	}
+
+	// Update mappings
+	if carriesMappings(msg) {
+		if err := p.setMappings(msg); err != nil {
+			return err
+		}
+		p.saveState()
+	}
+
+	// Create listeners, unless systemd passed them. The settings are in
+	// place first, since SOCKS and tcp listeners accept as they are bound.
+	ls := takeActivatedProxy()
+	if ls == nil {
+		if ls, err = listenProxy(host, port, msg.IPv6); err != nil {
+			return err
+		}
+	}
+	p.settings.Store(settings)
+	extra, err := p.bindListeners(msg, host)
+	if err != nil {
+		p.stopSocks()
+		p.stopTCPForwards()
+		p.settings.Store(nil)
+		closeConnections(settings)
+		for _, l := range ls {
+			l.Close()
+		}
+		return err
+	}
+	if settings.hooks.hasHits() {
+		mappingHitHooks.Add(1)
+	}
+	configureConnectionLimit(msg.MaxConnections)
+	ctx, cancel := context.WithCancel(ctx)
+	p.listeners = ls
+	p.extra = extra
+	p.bind = host
+	p.cancel = cancel
+	p.port.Store(int64(ls[0].Addr().(*net.TCPAddr).Port))
+
+	// Create server
+	p.server = &http.Server{
+		Handler:           http.HandlerFunc(p.proxyHandler),
+		ReadHeaderTimeout: 30 * time.Second,
+		IdleTimeout:       idleConnTimeout,
+		BaseContext:       func(net.Listener) context.Context { return ctx },
+	}
+
+	servicesOwner = p
+	startedAt = time.Now()
+	startStatsPush(msg.StatsIntervalMs)
+	if p == engine {
+		startWatchdog(msg.HeartbeatTimeoutMs)
+	}
+	if err := startAdmin(msg.AdminPort); err != nil {
+		logWarn("Failed to start admin API: %v", err)
+	}
+	if err := startGRPC(msg.GRPC); err != nil {
+		logWarn("Failed to start gRPC API: %v", err)
+	}
+	startOTLP(msg.OTLPEndpoint)
+	p.startHealthChecks(settings)
+	if err := openAccessLog(msg.AccessLog); err != nil {
+		logWarn("Failed to open access log: %v", err)
+	}
+	if err := p.startWatch(msg.WatchFile); err != nil {
+		logWarn("Failed to watch %s: %v", msg.WatchFile, err)
+	}
+	if err := p.startBackend(msg.Backend); err != nil {
+		logWarn("Failed to start mapping backend: %v", err)
+	}
+
+	// Start serving in background
+	for _, l := range append(p.listeners, p.extra...) {
+		go serve(p.server, l, settings)
+	}
+	go p.stopWhenDone(ctx, p.server)
+
+	bound := p.Port()
+	settings.hooks.run(Message{Type: "started", Port: &bound}, "")
+	return nil
+}
+
+// Stop the proxy once the context it was started with ends, unless it was
+// stopped first
+func (p *Proxy) stopWhenDone(ctx context.Context, srv *http.Server) {
+	<-ctx.Done()
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+	if p.server == srv {
+		p.stop()
+	}
+}
+
+// Port from a start or restart message, or fallback when omitted
+func requestedPort(msg *Message, fallback int) (int, error) {
+	port := fallback
+	if msg.Port != nil {
+		port = *msg.Port
+	}
+	if port < 0 || port > 65535 {
+		return 0, fmt.Errorf("%w: %d", errInvalidPort, port)
+	}
+	return port, nil
+}
+
+// Serve one listener until it or the server is closed
+func serve(srv *http.Server, l net.Listener, settings *proxySettings) {
+	err := srv.Serve(l)
+	if err != nil && err != http.ErrServerClosed && !errors.Is(err, net.ErrClosed) {
+		sendError(settings, ErrCodeServerError, "Server error: %v", err)
+	}
+}
+
+// Listen on host, and on the IPv6 loopback address as well when host is
+// the IPv4 one and ipv6 is set. The IPv6 listener reuses the IPv4 port, so
+// an OS-assigned port (0) is the same on both.
+func listenProxy(host string, port int, ipv6 bool) ([]net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	ls := []net.Listener{l}
+	if ipv6 && host == loopbackHost {
+		port = l.Addr().(*net.TCPAddr).Port
+		l6, err := net.Listen("tcp", net.JoinHostPort("::1", strconv.Itoa(port)))
+		if err != nil {
+			l.Close()
+			return nil, err
+		}
+		ls = append(ls, l6)
+	}
+	return ls, nil
+}
+
+// The proxy that last started the stats push, OTLP export, access log
+// and k8s port-forwards, which are shared by the process and
+// stop with it. Guarded by actionsMu.
+var servicesOwner *Proxy
+
+// Stop the proxy server. Callers hold actionsMu.
+func (p *Proxy) stop() {
+	if p.server != nil {
+		p.cancel()
+		p.server.Close()
+		p.server = nil
+		p.currentSettings().hooks.run(Message{Type: "stopped"}, "")
+	}
+	for _, l := range append(p.listeners, p.extra...) {
+		l.Close()
+	}
+	p.listeners = nil
+	p.extra = nil
+	p.bind = ""
+	p.port.Store(0)
+	p.stopSocks()
+	p.stopTCPForwards()
+	p.stopWatch()
+	p.stopBackend()
+	if p == engine {
+		stopWatchdog()
+	}
+	if servicesOwner == p {
+		servicesOwner = nil
+		stopStatsPush()
+		closeAccessLog()
+		stopOTLP()
+		stopPortForwards()
+	}
+	if settings := p.settings.Swap(nil); settings != nil {
+		stopHealthChecks(settings)
+		if settings.hooks.hasHits() {
+			mappingHitHooks.Add(-1)
+		}
+		closeConnections(settings)
+	}
+}
+
+// Serializes actions from the extension and the control socket
+var actionsMu sync.Mutex
+
+// Handle one message from the extension or a control client (source, for
+// the audit log), passing replies to send. Replies echo the message's id
+// so the sender can match them to the command that caused them.
+func (p *Proxy) handleMessage(msg *Message, source string, send func(Message)) {
+	actionsMu.Lock()
+	defer actionsMu.Unlock()
+
+	failed := false
+	reply := func(resp Message) {
+		resp.ID = msg.ID
+		send(resp)
+	}
+	replyError := func(code, format string, args ...interface{}) {
+		failed = true
+		reply(Message{Type: "error", ErrorCode: code, Message: fmt.Sprintf(format, args...)})
+	}
+	if auditedActions[msg.Action] {
+		before := p.exportConfig()
+		defer func() {
+			if !failed {
+				p.auditChange(AuditEntry{Source: source, Action: msg.Action, Profile: msg.Profile, Path: msg.Path}, before)
+			}
+		}()
+	}
+
+	switch msg.Action {
+	case "start":
+		applyFileDefaults(msg)
+		if err := p.start(context.Background(), msg); err != nil {
+			replyError(startErrorCode(err), "Failed to start proxy: %v", err)
+			break
+		}
+		port := p.Port()
+		reply(Message{Type: "started", Port: &port, ProxyToken: p.currentSettings().token, Listeners: p.boundListeners()})
+
+	case "restart":
+		applyFileDefaults(msg)
+		if err := p.restart(msg); err != nil {
+			replyError(startErrorCode(err), "Failed to restart proxy: %v", err)
+			break
+		}
+		port := p.Port()
+		reply(Message{Type: "restarted", Port: &port})
+
+	case "setLogLevel":
+		if err := setLogLevel(msg.Level); err != nil {
+			replyError(ErrCodeBadMessage, "Failed to set log level: %v", err)
+			break
+		}
+		reply(Message{Type: "logLevelSet", Level: msg.Level})
+
+	case "setParentProxy":
+		if msg.ParentProxy == nil {
+			msg.ParentProxy = fileConfig.ParentProxy
+		}
+		parent, err := newParentConfig(msg.ParentProxy)
+		if err != nil {
+			replyError(ErrCodeBadMessage, "Failed to set parent proxy: %v", err)
+			break
+		}
+		p.currentSettings().parent.Store(parent)
+		reply(Message{Type: "parentProxySet"})
+
+	case "setTape":
+		if msg.Tape == nil {
+			msg.Tape = fileConfig.Tape
+		}
+		tape, count, err := newTape(msg.Tape)
+		if err != nil {
+			replyError(ErrCodeBadMessage, "Failed to set tape: %v", err)
+			break
+		}
+		p.currentSettings().tape.Store(tape)
+		reply(Message{Type: "tapeSet", Count: count})
+
+	case "importHostsFile":
+		if msg.Path == "" && msg.Content == "" {
+			replyError(ErrCodeBadMessage, "importHostsFile requires a path or content")
+			break
+		}
+		if _, err := p.importHostsFile(msg.Path, msg.Content); err != nil {
+			replyError(ErrCodeInvalidMapping, "Failed to import hosts file: %v", err)
+			break
+		}
+		p.saveState()
+		count, revision := p.mappingsState()
+		reply(Message{Type: "mappingsUpdated", Count: count, Revision: revision})
+
+	case "exportHostsFile":
+		reply(Message{Type: "hostsFile", Content: p.renderHostsFile()})
+
+	case "saveProfile":
+		if err := p.saveProfile(msg.Profile, msg); err != nil {
+			replyError(ErrCodeProfileError, "Failed to save profile: %v", err)
+			break
+		}
+		reply(Message{Type: "profileSaved", Profile: msg.Profile})
+
+	case "listProfiles":
+		names, active, err := listProfiles()
+		if err != nil {
+			replyError(ErrCodeProfileError, "Failed to list profiles: %v", err)
+			break
+		}
+		reply(Message{Type: "profiles", Profiles: names, Profile: active})
+
+	case "switchProfile":
+		if err := p.switchProfile(msg.Profile); err != nil {
+			replyError(ErrCodeProfileError, "Failed to switch profile: %v", err)
+			break
+		}
+		p.saveState()
+		count, revision := p.mappingsState()
+		reply(Message{Type: "mappingsUpdated", Count: count, Revision: revision, Profile: msg.Profile})
+
+	case "deleteProfile":
+		if err := deleteProfile(msg.Profile); err != nil {
+			replyError(ErrCodeProfileError, "Failed to delete profile: %v", err)
+			break
+		}
+		reply(Message{Type: "profileDeleted", Profile: msg.Profile})
+
+	case "getAuditLog":
+		entries, err := readAuditLog(msg.Count)
+		if err != nil {
+			replyError(ErrCodeFileError, "Failed to read audit log: %v", err)
+			break
+		}
+		reply(Message{Type: "auditLog", Audit: entries})
+
+	case "exportConfig":
+		reply(Message{Type: "config", Config: p.exportConfig()})
+
+	case "importConfig":
+		if msg.Config == nil && msg.Content != "" {
+			// Inline document text, JSON or YAML
+			msg.Config = &ProxyConfig{}
+			if err := yaml.Unmarshal([]byte(msg.Content), msg.Config); err != nil {
+				replyError(ErrCodeBadMessage, "Invalid config: %v", err)
+				break
+			}
+		}
+		if msg.Config == nil {
+			replyError(ErrCodeBadMessage, "importConfig requires a config")
+			break
+		}
+		if err := p.importConfig(msg.Config); err != nil {
+			replyError(ErrCodeInvalidMapping, "Failed to import config: %v", err)
+			break
+		}
+		p.saveState()
+		count, revision := p.mappingsState()
+		reply(Message{Type: "mappingsUpdated", Count: count, Revision: revision})
+
+	case "subscribe":
+		trafficSubscribed.Store(true)
+		reply(Message{Type: "subscribed"})
+
+	case "unsubscribe":
+		trafficSubscribed.Store(false)
+		reply(Message{Type: "unsubscribed"})
+
+	case "startRecording":
+		startRecording()
+		reply(Message{Type: "recordingStarted"})
+
+	case "stopRecording":
+		recording.Store(false)
+		_, count := exportHAR()
+		reply(Message{Type: "recordingStopped", Count: count})
+
+	case "exportHar":
+		data, count := exportHAR()
+		if msg.Path == "" {
+			reply(Message{Type: "har", Content: string(data), Count: count})
+			break
+		}
+		if err := writeFileAtomic(msg.Path, data); err != nil {
+			replyError(ErrCodeFileError, "Failed to write HAR file: %v", err)
+			break
+		}
+		reply(Message{Type: "har", Path: msg.Path, Count: count})
+
+	case "rotateLogs":
+		if err := rotateLogs(); err != nil {
+			replyError(ErrCodeFileError, "Failed to rotate logs: %v", err)
+			break
+		}
+		reply(Message{Type: "logsRotated"})
+
+	case "setHostOffline":
+		reply(Message{Type: "hostOffline", Hosts: p.setHostsOffline(msg.Hosts, msg.Offline)})
+
+	case "pause":
+		p.paused.Store(true)
+		reply(Message{Type: "paused"})
+
+	case "resume":
+		p.paused.Store(false)
+		reply(Message{Type: "resumed"})
+
+	case "startSocks":
+		port := defaultSocksPort
+		if msg.Port != nil {
+			port = *msg.Port
+		}
+		port, err := p.startSocks(port)
+		if err != nil {
+			replyError(listenErrorCode(err), "Failed to start SOCKS proxy: %v", err)
+			break
+		}
+		reply(Message{Type: "socksStarted", Port: &port})
+
+	case "updateMappings":
+		if err := p.setMappings(msg); err != nil {
+			replyError(ErrCodeInvalidMapping, "Failed to update mappings: %v", err)
+			break
+		}
+		p.saveState()
+		count, revision := p.mappingsState()
+		reply(Message{Type: "mappingsUpdated", Count: count, Revision: revision})
+
+	case "addMappings":
+		if err := p.mergeMappings(msg); err != nil {
+			replyError(ErrCodeInvalidMapping, "Failed to add mappings: %v", err)
+			break
+		}
+		p.saveState()
+		count, revision := p.mappingsState()
+		reply(Message{Type: "mappingsUpdated", Count: count, Revision: revision})
+
+	case "removeMappings":
+		p.deleteMappings(msg.Hosts)
+		p.saveState()
+		count, revision := p.mappingsState()
+		reply(Message{Type: "mappingsUpdated", Count: count, Revision: revision})
+
+	case "disableMappings", "enableMappings":
+		p.setMappingsEnabled(msg.Hosts, msg.Action == "enableMappings")
+		p.saveState()
+		count, revision := p.mappingsState()
+		reply(Message{Type: "mappingsUpdated", Count: count, Revision: revision})
+
+	case "stop":
+		p.stop()
+		reply(Message{Type: "stopped"})
+		exit(0)
+
+	case "generateCA":
+		if err := regenerateCA(); err != nil {
+			replyError(ErrCodeCAError, "Failed to generate CA: %v", err)
+			break
+		}
+		cert, _ := exportCA()
+		reply(Message{Type: "caCert", Cert: cert})
+
+	case "exportCA":
+		cert, err := exportCA()
+		if err != nil {
+			replyError(ErrCodeCAError, "Failed to export CA: %v", err)
+			break
+		}
+		reply(Message{Type: "caCert", Cert: cert})
+
+	case "listConnections":
+		reply(Message{Type: "connections", Connections: listConnections()})
+
+	case "closeConnection":
+		if !closeConnection(msg.ConnectionID) {
+			replyError(ErrCodeNotFound, "No open connection %d", msg.ConnectionID)
+			break
+		}
+		reply(Message{Type: "connectionClosed", ConnectionID: msg.ConnectionID})
+
+	case "testMapping":
+		result, err := p.testMapping(msg.Host, msg.Scheme)
+		if err != nil {
+			replyError(ErrCodeBadMessage, "Failed to test mapping: %v", err)
+			break
+		}
+		reply(Message{Type: "mappingTested", MappingTest: result})
+
+	case "flushDns":
+		reply(Message{Type: "dnsFlushed", Count: flushDNSCache()})
+
+	case "status":
+		reply(Message{Type: "status", Status: p.currentStatus()})
+
+	case "getStats":
+		reply(Message{Type: "stats", Stats: snapshotStats()})
+
+	case "capabilities":
+		reply(Message{Type: "capabilities", Capabilities: currentCapabilities()})
+
+	case "hello":
+		reply(handleHello(msg))
+
+	case "ping":
+		reply(Message{Type: "pong"})
+
+	default:
+		replyError(ErrCodeUnknownAction, "Unknown action: %s", msg.Action)
+	}
+}
+
+// Release process-wide resources and exit
+func exit(code int) {
+	release()
+	os.Exit(code)
+}
+
+// Release process-wide resources: the control channel, APIs and PID file
+func release() {
+	stopControl()
+	stopAdmin()
+	stopGRPC()
+	stopPortForwards()
+	removePIDFile()
+	waitHooks(5 * time.Second)
+}
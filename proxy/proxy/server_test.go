@@ -0,0 +1,87 @@
+package proxy
+
+import (
+	"io"
+	"net"
+	"testing"
+)
+
+// Bytes sent each way through each benchmarked tunnel
+const benchTunnelBytes = 256 << 10
+
+// Run one tunnel between two in-memory pipes, sending payload from the
+// client to the target and back into echo
+func runPipedTunnel(b *testing.B, rt route, payload, echo []byte) {
+	client, clientSide := net.Pipe()
+	targetSide, target := net.Pipe()
+	done := make(chan struct{})
+	go func() {
+		defer close(done)
+		tunnel("connect", clientSide, targetSide, rt, &Flow{})
+	}()
+	// The target echoes what it reads, with a pooled buffer so only the
+	// tunnel's own allocations are counted
+	go func() {
+		copyBuffered(target, target)
+		target.Close()
+	}()
+
+	go func() {
+		client.Write(payload)
+	}()
+	if _, err := io.ReadFull(client, echo); err != nil {
+		b.Error(err)
+	}
+	client.Close()
+	<-done
+}
+
+// Allocations per tunnel with many running at once (raise -cpu for more),
+// which the pooled copy buffers keep under the two 32KB buffers io.Copy
+// would take for each
+func BenchmarkTunnel(b *testing.B) {
+	rt := route{host: "bench.test", network: "tcp", mapped: true}
+	payload := make([]byte, benchTunnelBytes)
+	b.ReportAllocs()
+	b.SetBytes(2 * benchTunnelBytes)
+	b.SetParallelism(16)
+	b.RunParallel(func(pb *testing.PB) {
+		echo := make([]byte, benchTunnelBytes)
+		for pb.Next() {
+			runPipedTunnel(b, rt, payload, echo)
+		}
+	})
+}
+
+// One direction of a tunnel through copyBuffered, against io.Copy, which
+// allocates a fresh 32KB buffer for every copy between plain conns
+func BenchmarkCopy(b *testing.B) {
+	payload := make([]byte, benchTunnelBytes)
+	for _, bc := range []struct {
+		name string
+		copy func(io.Writer, io.Reader) (int64, error)
+	}{
+		{"pooled", copyBuffered},
+		{"io.Copy", io.Copy},
+	} {
+		b.Run(bc.name, func(b *testing.B) {
+			b.ReportAllocs()
+			b.SetBytes(benchTunnelBytes)
+			b.RunParallel(func(pb *testing.PB) {
+				for pb.Next() {
+					src, w := net.Pipe()
+					r, dst := net.Pipe()
+					go func() {
+						w.Write(payload)
+						w.Close()
+					}()
+					go func() {
+						bc.copy(dst, src)
+						dst.Close()
+					}()
+					io.Copy(io.Discard, r)
+				}
+			})
+		})
+	}
+}
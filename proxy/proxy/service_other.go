@@ -0,0 +1,11 @@
+//go:build !windows
+
+package proxy
+
+import "errors"
+
+// Service mode is Windows only; elsewhere daemon mode keeps the proxy
+// running across browser restarts
+func RunService(command string) error {
+	return errors.New("service mode is only available on Windows")
+}
@@ -0,0 +1,112 @@
+//go:build windows
+
+package proxy
+
+import (
+	"fmt"
+	"os"
+	"time"
+
+	"golang.org/x/sys/windows/svc"
+	"golang.org/x/sys/windows/svc/mgr"
+)
+
+// Service mode: "fhosts-proxy -service install", run elevated, registers
+// the helper as a Windows service that starts with the machine and runs
+// the daemon for the installing user. The native messaging hosts the
+// browser launches attach to it over the control pipe, so recycled hosts
+// and browser restarts don't take the proxy down.
+const serviceName = "fhosts"
+
+// Run "fhosts-proxy -service install|uninstall|run"
+func RunService(command string) error {
+	switch command {
+	case "install":
+		return installService()
+	case "uninstall":
+		return uninstallService()
+	case "run":
+		return svc.Run(serviceName, fhostsService{})
+	}
+	return fmt.Errorf("unknown service command %q, want install, uninstall or run", command)
+}
+
+// Register and start the service. It runs as SYSTEM, so it is told the
+// installing user's config directory and SID, whose pipe it serves.
+func installService() error {
+	exe, err := os.Executable()
+	if err != nil {
+		return err
+	}
+	dir, err := configDir()
+	if err != nil {
+		return err
+	}
+	sid, err := controlUser()
+	if err != nil {
+		return err
+	}
+
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager (run as administrator): %v", err)
+	}
+	defer m.Disconnect()
+	s, err := m.CreateService(serviceName, exe, mgr.Config{
+		DisplayName: "fhosts proxy helper",
+		Description: "Routes mapped hosts for the fhosts browser extension",
+		StartType:   mgr.StartAutomatic,
+	}, "-service", "run", "-config-dir", dir, "-service-user", sid)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	return s.Start()
+}
+
+// Stop and remove the service
+func uninstallService() error {
+	m, err := mgr.Connect()
+	if err != nil {
+		return fmt.Errorf("connecting to the service manager (run as administrator): %v", err)
+	}
+	defer m.Disconnect()
+	s, err := m.OpenService(serviceName)
+	if err != nil {
+		return err
+	}
+	defer s.Close()
+	if status, err := s.Control(svc.Stop); err == nil {
+		for deadline := time.Now().Add(10 * time.Second); status.State != svc.Stopped && time.Now().Before(deadline); time.Sleep(100 * time.Millisecond) {
+			if status, err = s.Query(); err != nil {
+				break
+			}
+		}
+	}
+	return s.Delete()
+}
+
+type fhostsService struct{}
+
+// Run the daemon until the service manager stops the service
+func (fhostsService) Execute(args []string, requests <-chan svc.ChangeRequest, status chan<- svc.Status) (bool, uint32) {
+	status <- svc.Status{State: svc.StartPending}
+	if err := startDaemon(); err != nil {
+		logWarn("Service failed to start: %v", err)
+		return true, 1
+	}
+	status <- svc.Status{State: svc.Running, Accepts: svc.AcceptStop | svc.AcceptShutdown}
+
+	for req := range requests {
+		switch req.Cmd {
+		case svc.Interrogate:
+			status <- req.CurrentStatus
+		case svc.Stop, svc.Shutdown:
+			status <- svc.Status{State: svc.StopPending}
+			engine.Stop()
+			release()
+			return false, 0
+		}
+	}
+	return false, 0
+}
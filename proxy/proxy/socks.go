@@ -0,0 +1,262 @@
+package proxy
+
+import (
+	"encoding/binary"
+	"errors"
+	"fmt"
+	"io"
+	"net"
+	"strconv"
+	"time"
+)
+
+const defaultSocksPort = 8900
+
+// SOCKS5 protocol constants (RFC 1928)
+const (
+	socksVersion              = 0x05
+	socksNoAuth               = 0x00
+	socksUserPass             = 0x02
+	socksUserPassVersion      = 0x01
+	socksNoAcceptable         = 0xff
+	socksCmdConnect           = 0x01
+	socksAtypIPv4             = 0x01
+	socksAtypDomain           = 0x03
+	socksAtypIPv6             = 0x04
+	socksReplySuccess         = 0x00
+	socksReplyFailure         = 0x01
+	socksReplyNotAllowed      = 0x02
+	socksReplyRefused         = 0x05
+	socksReplyCmdUnsupported  = 0x07
+	socksReplyAddrUnsupported = 0x08
+)
+
+// Start the SOCKS5 listener on the proxy's bind address, applying the same
+// host mappings as the HTTP proxy. Port 0 lets the OS pick one. Returns the
+// port it listens on.
+func (p *Proxy) startSocks(port int) (int, error) {
+	if len(p.socksListeners) > 0 {
+		return p.socksListeners[0].Addr().(*net.TCPAddr).Port, nil // Already running
+	}
+	l, err := p.addSocksListener(p.bindHost(), port)
+	if err != nil {
+		return 0, err
+	}
+	return l.Addr().(*net.TCPAddr).Port, nil
+}
+
+// Listen for SOCKS5 clients on another port of host
+func (p *Proxy) addSocksListener(host string, port int) (net.Listener, error) {
+	l, err := net.Listen("tcp", net.JoinHostPort(host, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	p.socksListeners = append(p.socksListeners, l)
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return // Listener closed
+			}
+			go p.handleSocks(conn)
+		}
+	}()
+	return l, nil
+}
+
+// Stop the SOCKS5 listeners
+func (p *Proxy) stopSocks() {
+	for _, l := range p.socksListeners {
+		l.Close()
+	}
+	p.socksListeners = nil
+}
+
+// Handle a single SOCKS5 client: no-auth negotiation, then CONNECT. The
+// handshake gets the TLS handshake timeout, so clients that connect and
+// stall don't hold the connection open.
+func (p *Proxy) handleSocks(conn net.Conn) {
+	conn.SetReadDeadline(time.Now().Add(millis(shared().timeouts.TLSHandshake)))
+	host, port, err := socksHandshake(conn, p.currentSettings().token)
+	if err != nil {
+		conn.Close()
+		return
+	}
+	conn.SetReadDeadline(time.Time{})
+
+	release, ok := acquireConnection()
+	if !ok {
+		socksReply(conn, socksReplyFailure)
+		conn.Close()
+		return
+	}
+	defer release()
+	totalRequests.Add(1)
+
+	rt := p.resolveRoute(host, port)
+
+	// Raw TCP mappings reach any port
+	if !rt.options.TCP && !socksPortAllowed(rt, port) {
+		sendError(rt.settings, ErrCodePortNotAllowed, "Refused SOCKS connection to %s: port %s is not in connectPorts", host, port)
+		socksReply(conn, socksReplyNotAllowed)
+		conn.Close()
+		return
+	}
+
+	flow := newFlow("socks", conn.RemoteAddr().String(), rt)
+	if err := connectChain(flow); err != nil {
+		if refusalFor(err).Reset {
+			resetConn(conn)
+			return
+		}
+		socksReply(conn, socksReplyNotAllowed)
+		conn.Close()
+		return
+	}
+	if rt.mapped {
+		logInfo("SOCKS tunneling %s -> %s", net.JoinHostPort(host, port), rt.addr)
+	}
+
+	trace := startTrace(conn.RemoteAddr().String())
+	countersFor(rt).countRequest()
+	targetConn, rt, err := trace.dial(rt)
+	if err != nil {
+		countersFor(rt).countError()
+		sendError(rt.settings, forwardErrorCode(err), "Failed to connect to %s: %v", rt.addr, err)
+		reply := byte(socksReplyRefused)
+		if errors.Is(err, errPrivateTarget) {
+			reply = socksReplyNotAllowed
+		}
+		socksReply(conn, reply)
+		conn.Close()
+		trace.finishTunnel("SOCKS", rt, 0, 0, 0)
+		return
+	}
+
+	if err := socksReply(conn, socksReplySuccess); err != nil {
+		conn.Close()
+		targetConn.Close()
+		return
+	}
+
+	in, out := tunnel("socks", conn, targetConn, rt, flow)
+	trace.finishTunnel("SOCKS", rt, 0, in, out)
+}
+
+// Negotiate the auth method (username/password with the proxy token as
+// password when proxy auth is on, no-auth otherwise) and read the CONNECT
+// request, returning the requested host and port
+func socksHandshake(conn net.Conn, token string) (string, string, error) {
+	// Greeting: VER NMETHODS METHODS...
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return "", "", err
+	}
+	if header[0] != socksVersion {
+		return "", "", fmt.Errorf("unsupported SOCKS version %d", header[0])
+	}
+	methods := make([]byte, header[1])
+	if _, err := io.ReadFull(conn, methods); err != nil {
+		return "", "", err
+	}
+	want := byte(socksNoAuth)
+	if token != "" {
+		want = socksUserPass
+	}
+	offered := false
+	for _, method := range methods {
+		if method == want {
+			offered = true
+		}
+	}
+	if !offered {
+		conn.Write([]byte{socksVersion, socksNoAcceptable})
+		return "", "", errors.New("client does not offer a usable auth method")
+	}
+	if _, err := conn.Write([]byte{socksVersion, want}); err != nil {
+		return "", "", err
+	}
+	if want == socksUserPass {
+		if err := socksAuthenticate(conn, token); err != nil {
+			return "", "", err
+		}
+	}
+
+	// Request: VER CMD RSV ATYP DST.ADDR DST.PORT
+	request := make([]byte, 4)
+	if _, err := io.ReadFull(conn, request); err != nil {
+		return "", "", err
+	}
+	if request[1] != socksCmdConnect {
+		socksReply(conn, socksReplyCmdUnsupported)
+		return "", "", fmt.Errorf("unsupported SOCKS command %d", request[1])
+	}
+
+	var host string
+	switch request[3] {
+	case socksAtypIPv4, socksAtypIPv6:
+		size := net.IPv4len
+		if request[3] == socksAtypIPv6 {
+			size = net.IPv6len
+		}
+		ip := make([]byte, size)
+		if _, err := io.ReadFull(conn, ip); err != nil {
+			return "", "", err
+		}
+		host = net.IP(ip).String()
+	case socksAtypDomain:
+		size := make([]byte, 1)
+		if _, err := io.ReadFull(conn, size); err != nil {
+			return "", "", err
+		}
+		domain := make([]byte, size[0])
+		if _, err := io.ReadFull(conn, domain); err != nil {
+			return "", "", err
+		}
+		host = string(domain)
+	default:
+		socksReply(conn, socksReplyAddrUnsupported)
+		return "", "", fmt.Errorf("unsupported SOCKS address type %d", request[3])
+	}
+
+	portBytes := make([]byte, 2)
+	if _, err := io.ReadFull(conn, portBytes); err != nil {
+		return "", "", err
+	}
+	port := strconv.Itoa(int(binary.BigEndian.Uint16(portBytes)))
+	return host, port, nil
+}
+
+// Check username/password credentials (RFC 1929) against the proxy token
+func socksAuthenticate(conn net.Conn, token string) error {
+	// VER ULEN UNAME PLEN PASSWD
+	header := make([]byte, 2)
+	if _, err := io.ReadFull(conn, header); err != nil {
+		return err
+	}
+	if header[0] != socksUserPassVersion {
+		return fmt.Errorf("unsupported SOCKS auth version %d", header[0])
+	}
+	user := make([]byte, int(header[1])+1) // Username and the password length
+	if _, err := io.ReadFull(conn, user); err != nil {
+		return err
+	}
+	password := make([]byte, user[len(user)-1])
+	if _, err := io.ReadFull(conn, password); err != nil {
+		return err
+	}
+	if !validProxyToken(token, string(password)) {
+		conn.Write([]byte{socksUserPassVersion, socksReplyFailure})
+		return errors.New("wrong SOCKS password")
+	}
+	_, err := conn.Write([]byte{socksUserPassVersion, socksReplySuccess})
+	return err
+}
+
+// Send a SOCKS5 reply. The bound address is not meaningful to clients here,
+// so it is reported as 0.0.0.0:0.
+func socksReply(conn net.Conn, code byte) error {
+	_, err := conn.Write([]byte{socksVersion, code, 0x00, socksAtypIPv4, 0, 0, 0, 0, 0, 0})
+	return err
+}
@@ -0,0 +1,98 @@
+package proxy
+
+import (
+	"context"
+	"encoding/json"
+	"fmt"
+	"net"
+	"os"
+	"os/signal"
+	"strconv"
+	"strings"
+	"syscall"
+)
+
+// Set in standalone mode, where messages go to stderr as text instead of
+// to the extension over stdout
+var standalone bool
+
+// Run the proxy without a browser extension: mappings come from flags and
+// files, logs go to stderr, and it runs until interrupted
+func RunStandalone() error {
+	standalone = true
+	setOutput(writeStandalone)
+
+	var cfg ProxyConfig
+	if options.MappingsFile != "" {
+		data, err := os.ReadFile(options.MappingsFile)
+		if err != nil {
+			return err
+		}
+		if err := decodeConfig(options.MappingsFile, data, &cfg); err != nil {
+			return fmt.Errorf("%s: %v", options.MappingsFile, err)
+		}
+	}
+	if err := engine.importConfig(&cfg); err != nil {
+		return err
+	}
+	if err := engine.importHostsFlags(); err != nil {
+		return err
+	}
+	extra := make(map[string]string)
+	for _, m := range options.Maps {
+		host, target, ok := strings.Cut(m, "=")
+		if !ok || host == "" || target == "" {
+			return fmt.Errorf("invalid -map %q, want host=target", m)
+		}
+		extra[host] = target
+	}
+	if err := engine.mergeMappings(&Message{Mappings: extra}); err != nil {
+		return err
+	}
+
+	msg := Message{IPv6: options.IPv6, BindAddress: options.BindAddress, AllowRemote: options.AllowRemote, AdminPort: options.AdminPort, SystemHosts: options.SystemHosts, ProxyAuth: options.ProxyAuth}
+	if options.Port >= 0 {
+		msg.Port = &options.Port
+	}
+	if err := engine.Start(context.Background(), msg); err != nil {
+		return err
+	}
+	if err := startControl(); err != nil {
+		logWarn("Control socket unavailable: %v", err)
+	}
+	count, _ := engine.mappingsState()
+	fmt.Fprintf(os.Stderr, "fhosts-proxy %s listening on %s with %d mappings\n", version, net.JoinHostPort(engine.bind, strconv.Itoa(engine.Port())), count)
+	if token := engine.currentSettings().token; token != "" {
+		fmt.Fprintf(os.Stderr, "Proxy token: %s\n", token)
+	}
+	if url := dashboardURL(); url != "" {
+		fmt.Fprintf(os.Stderr, "Dashboard: %s\n", url)
+	}
+
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	<-signals
+	stopControl()
+	stopAdmin()
+	stopGRPC()
+	engine.Stop()
+	return nil
+}
+
+// Print a message meant for the extension to stderr
+func writeStandalone(msg Message) {
+	switch msg.Type {
+	case "log":
+		for _, entry := range msg.Logs {
+			fmt.Fprintf(os.Stderr, "%-5s %s\n", entry.Level, entry.Message)
+		}
+		if msg.Count > 0 {
+			fmt.Fprintf(os.Stderr, "warn  %s\n", msg.Message)
+		}
+	case "error":
+		fmt.Fprintf(os.Stderr, "error %s: %s\n", msg.ErrorCode, msg.Message)
+	default:
+		data, _ := json.Marshal(msg)
+		fmt.Fprintf(os.Stderr, "%s\n", data)
+	}
+}
@@ -0,0 +1,49 @@
+package proxy
+
+import (
+	"encoding/json"
+	"os"
+	"path/filepath"
+)
+
+// Mapping set saved after every change and restored at startup, so the
+// proxy has the last known mappings before the extension reconnects
+const stateFile = "state.json"
+
+// Write the active mapping set to the state file
+func (p *Proxy) saveState() {
+	if standalone || p.embedded {
+		return // Don't clobber the extension's saved mappings
+	}
+	dir, err := configDir()
+	if err != nil {
+		logWarn("Failed to save mappings: %v", err)
+		return
+	}
+	data, err := json.MarshalIndent(p.exportConfig(), "", "  ")
+	if err != nil {
+		return
+	}
+
+	if err := writeFileAtomic(filepath.Join(dir, stateFile), data); err != nil {
+		logWarn("Failed to save mappings: %v", err)
+	}
+}
+
+// Load the saved mapping set, if any, over the static mappings
+func (p *Proxy) restoreState() {
+	dir, err := configDir()
+	if err != nil {
+		return
+	}
+	var cfg ProxyConfig
+	if data, err := os.ReadFile(filepath.Join(dir, stateFile)); err == nil {
+		if err := json.Unmarshal(data, &cfg); err != nil {
+			logWarn("Ignoring unreadable %s: %v", stateFile, err)
+		}
+	}
+	// Import even when nothing was saved, so static mappings apply
+	if err := p.importConfig(&cfg); err != nil {
+		logWarn("Ignoring saved mappings: %v", err)
+	}
+}
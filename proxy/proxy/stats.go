@@ -0,0 +1,153 @@
+package proxy
+
+import (
+	"io"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// Traffic totals for one mapped hostname. BytesIn flows from the target to
+// the browser, BytesOut from the browser to the target.
+type HostStats struct {
+	Requests int64 `json:"requests"`
+	BytesIn  int64 `json:"bytesIn"`
+	BytesOut int64 `json:"bytesOut"`
+	Errors   int64 `json:"errors"`
+}
+
+type hostCounters struct {
+	requests, bytesIn, bytesOut, errors atomic.Int64
+}
+
+var (
+	hostStats   = make(map[string]*hostCounters)
+	hostStatsMu sync.Mutex
+	statsStop   chan struct{}
+)
+
+// Get the counters for a route's host. Only mapped hosts are tracked, so
+// unmapped routes get nil, which every count helper ignores.
+func countersFor(rt route) *hostCounters {
+	if !rt.mapped {
+		return nil
+	}
+
+	hostStatsMu.Lock()
+	defer hostStatsMu.Unlock()
+
+	c, ok := hostStats[rt.host]
+	if !ok {
+		c = &hostCounters{}
+		hostStats[rt.host] = c
+	}
+	return c
+}
+
+func (c *hostCounters) countRequest() {
+	if c != nil {
+		c.requests.Add(1)
+	}
+}
+
+func (c *hostCounters) countError() {
+	if c != nil {
+		c.errors.Add(1)
+	}
+}
+
+// Wrap r so bytes read from it are added to the in or out counter
+func (c *hostCounters) countIn(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return &countingReader{Reader: r, n: &c.bytesIn}
+}
+
+func (c *hostCounters) countOut(r io.Reader) io.Reader {
+	if c == nil {
+		return r
+	}
+	return &countingReader{Reader: r, n: &c.bytesOut}
+}
+
+// Same as countIn/countOut for request and response bodies
+func (c *hostCounters) countBodyIn(body io.ReadCloser) io.ReadCloser {
+	if c == nil || body == nil {
+		return body
+	}
+	return readCloser(c.countIn(body), body)
+}
+
+func (c *hostCounters) countBodyOut(body io.ReadCloser) io.ReadCloser {
+	if c == nil || body == nil {
+		return body
+	}
+	return readCloser(c.countOut(body), body)
+}
+
+type countingReader struct {
+	io.Reader
+	n *atomic.Int64
+}
+
+func (r *countingReader) Read(p []byte) (int, error) {
+	n, err := r.Reader.Read(p)
+	r.n.Add(int64(n))
+	return n, err
+}
+
+// Combine a wrapped reader with the original body's Close
+func readCloser(r io.Reader, body io.ReadCloser) io.ReadCloser {
+	return struct {
+		io.Reader
+		io.Closer
+	}{r, body}
+}
+
+// Snapshot the per-host counters
+func snapshotStats() map[string]HostStats {
+	hostStatsMu.Lock()
+	defer hostStatsMu.Unlock()
+
+	stats := make(map[string]HostStats, len(hostStats))
+	for host, c := range hostStats {
+		stats[host] = HostStats{
+			Requests: c.requests.Load(),
+			BytesIn:  c.bytesIn.Load(),
+			BytesOut: c.bytesOut.Load(),
+			Errors:   c.errors.Load(),
+		}
+	}
+	return stats
+}
+
+// Push stats events to the extension every interval until stopStatsPush
+func startStatsPush(intervalMs int) {
+	stopStatsPush()
+	if intervalMs <= 0 {
+		return
+	}
+
+	stop := make(chan struct{})
+	statsStop = stop
+	go func() {
+		ticker := time.NewTicker(millis(intervalMs))
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				sendMessage(Message{Type: "stats", Stats: snapshotStats()})
+			}
+		}
+	}()
+}
+
+func stopStatsPush() {
+	if statsStop != nil {
+		close(statsStop)
+		statsStop = nil
+	}
+}
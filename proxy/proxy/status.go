@@ -0,0 +1,56 @@
+package proxy
+
+import (
+	"os"
+	"sync/atomic"
+	"time"
+)
+
+// Host version, overridable at build time with -ldflags "-X main.version=..."
+var version = "1.0.1"
+
+// Runtime counters reported by the status action
+var (
+	startedAt     time.Time
+	activeTunnels atomic.Int64
+	totalRequests atomic.Int64
+)
+
+// Runtime details returned by the status action
+type ProxyStatus struct {
+	Running       bool           `json:"running"`
+	Paused        bool           `json:"paused"`
+	Daemon        bool           `json:"daemon,omitempty"`
+	Port          int            `json:"port,omitempty"`
+	UptimeSeconds int64          `json:"uptimeSeconds"`
+	ActiveTunnels int64          `json:"activeTunnels"`
+	TotalRequests int64          `json:"totalRequests"`
+	PID           int            `json:"pid"`
+	Version       string         `json:"version"`
+	Extension     string         `json:"extensionVersion,omitempty"`
+	DNSCache      *DNSCacheStats `json:"dnsCache"`
+	DownTargets   []string       `json:"downTargets,omitempty"` // Targets balancing skips for now
+	OfflineHosts  []string       `json:"offlineHosts,omitempty"`
+}
+
+// Snapshot the proxy's runtime state
+func (p *Proxy) currentStatus() *ProxyStatus {
+	status := &ProxyStatus{
+		Running:       p.running(),
+		Paused:        p.paused.Load(),
+		Daemon:        daemon,
+		ActiveTunnels: activeTunnels.Load(),
+		TotalRequests: totalRequests.Load(),
+		PID:           os.Getpid(),
+		Version:       version,
+		Extension:     extensionVersion(),
+		DNSCache:      dnsCacheStats(),
+		DownTargets:   downTargets(p.currentSettings().health),
+		OfflineHosts:  p.currentOfflineHosts(),
+	}
+	if status.Running {
+		status.Port = p.Port()
+		status.UptimeSeconds = int64(time.Since(startedAt).Seconds())
+	}
+	return status
+}
@@ -0,0 +1,42 @@
+package proxy
+
+import (
+	"errors"
+	"io"
+	"mime"
+	"net/http"
+)
+
+// Whether a response is streamed to the client, each read flushed rather
+// than left in the server's write buffer: Server-Sent Events, and chunked
+// or unknown-length bodies such as long polls
+func isStreaming(resp *http.Response) bool {
+	mediaType, _, _ := mime.ParseMediaType(resp.Header.Get("Content-Type"))
+	return resp.ContentLength < 0 || mediaType == "text/event-stream"
+}
+
+// Copy body to w, flushing after every write
+func flushingCopy(w http.ResponseWriter, body io.Reader) (int64, error) {
+	rc := http.NewResponseController(w)
+	buf := make([]byte, 32<<10)
+	var n int64
+	for {
+		nr, readErr := body.Read(buf)
+		if nr > 0 {
+			nw, err := w.Write(buf[:nr])
+			n += int64(nw)
+			if err != nil {
+				return n, err
+			}
+			if err := rc.Flush(); err != nil && !errors.Is(err, http.ErrNotSupported) {
+				return n, err
+			}
+		}
+		if readErr == io.EOF {
+			return n, nil
+		}
+		if readErr != nil {
+			return n, readErr
+		}
+	}
+}
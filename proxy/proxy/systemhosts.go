@@ -0,0 +1,74 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"runtime"
+	"strings"
+	"sync"
+	"time"
+
+	"fhosts-proxy/mapping"
+)
+
+// With systemHosts on, hosts without a mapping are looked up in the
+// system hosts file, so overrides there still apply to traffic routed
+// through the proxy. The file is re-read when it changes.
+const systemHostsRecheck = 5 * time.Second
+
+var (
+	systemHosts        map[string]string
+	systemHostsModTime time.Time
+	systemHostsChecked time.Time
+	systemHostsMu      sync.Mutex
+)
+
+func systemHostsPath() string {
+	if runtime.GOOS == "windows" {
+		root := os.Getenv("SystemRoot")
+		if root == "" {
+			root = `C:\Windows`
+		}
+		return filepath.Join(root, "System32", "drivers", "etc", "hosts")
+	}
+	return "/etc/hosts"
+}
+
+// Find hostname in the system hosts file
+func lookupSystemHosts(hostname string) (string, bool) {
+	systemHostsMu.Lock()
+	defer systemHostsMu.Unlock()
+	if time.Since(systemHostsChecked) > systemHostsRecheck {
+		systemHostsChecked = time.Now()
+		reloadSystemHosts()
+	}
+	ip, ok := systemHosts[mapping.NormalizeHost(hostname)]
+	return ip, ok
+}
+
+// Re-read the hosts file if it changed. Callers must hold systemHostsMu.
+func reloadSystemHosts() {
+	path := systemHostsPath()
+	info, err := os.Stat(path)
+	if err != nil || info.ModTime().Equal(systemHostsModTime) {
+		return
+	}
+	f, err := os.Open(path)
+	if err != nil {
+		return
+	}
+	defer f.Close()
+	entries, err := mapping.ParseHostsFile(f)
+	if err != nil {
+		logWarn("Failed to read %s: %v", path, err)
+		return
+	}
+	for name := range entries {
+		// The stock entries resolve the same way without the proxy's help
+		if name == "localhost" || name == "localhost.localdomain" || name == "broadcasthost" || strings.HasPrefix(name, "ip6-") {
+			delete(entries, name)
+		}
+	}
+	systemHosts, systemHostsModTime = entries, info.ModTime()
+	logDebug("Loaded %d entries from %s", len(entries), path)
+}
@@ -0,0 +1,201 @@
+package proxy
+
+import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"time"
+
+	"fhosts-proxy/mapping"
+)
+
+// Record-and-replay for demos of apps that depend on live APIs. In record
+// mode the responses of the tape's hosts are saved to its directory, one
+// JSON file per request; in replay mode they are served from there without
+// contacting the targets. Requests match on method, host, path and query,
+// plus a hash of the body with matchBody.
+type Tape struct {
+	Mode        string   `json:"mode"`                  // record or replay; off otherwise
+	Hosts       []string `json:"hosts,omitempty"`       // Keyed like mappings; every host when empty
+	Dir         string   `json:"dir,omitempty"`         // Defaults to tapes in the config directory
+	MatchBody   bool     `json:"matchBody,omitempty"`   // Tell requests apart by their body too
+	Passthrough bool     `json:"passthrough,omitempty"` // Replay: forward requests that weren't recorded instead of answering 404
+}
+
+// Bodies past this size aren't recorded
+const maxTapeBodySize = 10 << 20
+
+// A proxy's active tape, with its hosts as a set for mapping.Match
+type activeTape struct {
+	Tape
+	hosts map[string]bool
+}
+
+// A recorded response
+type tapeEntry struct {
+	Method   string      `json:"method"`
+	URL      string      `json:"url"`
+	Status   int         `json:"status"`
+	Header   http.Header `json:"header"`
+	Body     []byte      `json:"body,omitempty"`
+	Recorded string      `json:"recorded"`
+}
+
+var errTapeMode = errors.New(`tape mode must be "record" or "replay"`)
+
+// Check tape and create its directory, returning it with the number of
+// recordings there. Nil when tape is nil or its mode empty, which turns
+// the tape off.
+func newTape(tape *Tape) (*activeTape, int, error) {
+	if tape == nil || tape.Mode == "" {
+		return nil, 0, nil
+	}
+	if tape.Mode != "record" && tape.Mode != "replay" {
+		return nil, 0, errTapeMode
+	}
+	active := &activeTape{Tape: *tape, hosts: make(map[string]bool, len(tape.Hosts))}
+	if active.Dir == "" {
+		dir, err := configDir()
+		if err != nil {
+			return nil, 0, err
+		}
+		active.Dir = filepath.Join(dir, "tapes")
+	}
+	if err := os.MkdirAll(active.Dir, 0o700); err != nil {
+		return nil, 0, err
+	}
+	for _, host := range tape.Hosts {
+		active.hosts[mapping.NormalizeHost(host)] = true
+	}
+
+	recorded, _ := filepath.Glob(filepath.Join(active.Dir, "*.json"))
+	return active, len(recorded), nil
+}
+
+// The proxy's tape if it covers host, else nil
+func (s *proxySettings) tapeFor(host string) *activeTape {
+	tape := s.tape.Load()
+	if tape == nil || len(tape.hosts) == 0 {
+		return tape
+	}
+	if _, ok := mapping.Match(tape.hosts, host); !ok {
+		return nil
+	}
+	return tape
+}
+
+// File a request is recorded under. Range requests are told apart by their
+// range. With matchBody the start of the body is read to hash it and put
+// back for forwarding.
+func (t *activeTape) path(f *Flow, req *http.Request) (string, error) {
+	h := sha256.New()
+	fmt.Fprintf(h, "%s\n%s\n%s\n", req.Method, f.Host, req.URL.RequestURI())
+	if r := req.Header.Get("Range"); r != "" {
+		fmt.Fprintf(h, "range %s\n", r)
+	}
+	if t.MatchBody && req.Body != nil && req.Body != http.NoBody {
+		body, err := io.ReadAll(io.LimitReader(req.Body, maxTapeBodySize))
+		if err != nil {
+			return "", err
+		}
+		req.Body = readCloser(io.MultiReader(bytes.NewReader(body), req.Body), req.Body)
+		h.Write(body)
+	}
+	return filepath.Join(t.Dir, hex.EncodeToString(h.Sum(nil))[:32]+".json"), nil
+}
+
+// Records and replays the tape's hosts
+type tapeMiddleware struct{}
+
+func (tapeMiddleware) OnConnect(f *Flow) error { return nil }
+
+func (tapeMiddleware) OnRequest(f *Flow, req *http.Request) (*http.Response, error) {
+	tape := f.route.settings.tapeFor(f.Host)
+	if tape == nil {
+		return nil, nil
+	}
+	path, err := tape.path(f, req)
+	if err != nil {
+		return nil, err
+	}
+	if tape.Mode == "record" {
+		f.tapePath = path
+		return nil, nil
+	}
+
+	data, err := os.ReadFile(path)
+	if err != nil {
+		if tape.Passthrough {
+			return nil, nil
+		}
+		logDebug("No recording of %s %s%s", req.Method, f.Host, req.URL.RequestURI())
+		return &http.Response{StatusCode: http.StatusNotFound, Header: make(http.Header), Body: http.NoBody}, nil
+	}
+	var entry tapeEntry
+	if err := json.Unmarshal(data, &entry); err != nil {
+		logWarn("Recording %s unreadable: %v", path, err)
+		return &http.Response{StatusCode: http.StatusInternalServerError, Header: make(http.Header), Body: http.NoBody}, nil
+	}
+	return &http.Response{
+		StatusCode:    entry.Status,
+		Header:        entry.Header,
+		ContentLength: int64(len(entry.Body)),
+		Body:          io.NopCloser(bytes.NewReader(entry.Body)),
+	}, nil
+}
+
+func (tapeMiddleware) OnResponse(f *Flow, req *http.Request, resp *http.Response) {
+	if f.tapePath == "" {
+		return
+	}
+	entry := tapeEntry{
+		Method:   req.Method,
+		URL:      tapeScheme(f) + "://" + f.Host + req.URL.RequestURI(),
+		Status:   resp.StatusCode,
+		Header:   resp.Header.Clone(),
+		Recorded: time.Now().UTC().Format(time.RFC3339),
+	}
+	resp.Body = &tapeRecorder{ReadCloser: resp.Body, path: f.tapePath, entry: entry}
+}
+
+func tapeScheme(f *Flow) string {
+	if f.Kind == "mitm" {
+		return "https"
+	}
+	return "http"
+}
+
+// Copies a response body as it is read and saves the recording once the
+// body has been read to the end
+type tapeRecorder struct {
+	io.ReadCloser
+	path  string
+	entry tapeEntry
+	buf   bytes.Buffer
+	done  bool
+}
+
+func (r *tapeRecorder) Read(p []byte) (int, error) {
+	n, err := r.ReadCloser.Read(p)
+	if r.buf.Len()+n <= maxTapeBodySize {
+		r.buf.Write(p[:n])
+	} else {
+		r.done = true // Too large to record
+	}
+	if err == io.EOF && !r.done {
+		r.done = true
+		r.entry.Body = r.buf.Bytes()
+		data, _ := json.MarshalIndent(r.entry, "", "  ")
+		if err := writeFileAtomic(r.path, data); err != nil {
+			logWarn("Failed to save recording of %s: %v", r.entry.URL, err)
+		}
+	}
+	return n, err
+}
@@ -0,0 +1,88 @@
+package proxy
+
+import (
+	"fmt"
+	"net"
+	"strconv"
+)
+
+// A tcp listener forwards every connection to one host:port through the
+// mappings, for clients that can't use an HTTP or SOCKS proxy (database
+// shells, SMTP tools, custom protocols): pointed at the listener they reach
+// whatever the host is mapped to. Connections aren't authenticated, so the
+// listeners stay on loopback whatever the bind address.
+type tcpForward struct {
+	net.Listener
+	target string // host:port
+}
+
+// Listen on port and forward connections to target
+func (p *Proxy) addTCPForward(port int, target string) (net.Listener, error) {
+	host, targetPort, err := net.SplitHostPort(target)
+	if err != nil || host == "" {
+		return nil, fmt.Errorf("tcp listener needs a host:port to forward to, got %q", target)
+	}
+	l, err := net.Listen("tcp", net.JoinHostPort(loopbackHost, strconv.Itoa(port)))
+	if err != nil {
+		return nil, err
+	}
+	p.tcpForwards = append(p.tcpForwards, tcpForward{Listener: l, target: target})
+
+	go func() {
+		for {
+			conn, err := l.Accept()
+			if err != nil {
+				return // Listener closed
+			}
+			go p.handleTCPForward(conn, host, targetPort)
+		}
+	}()
+	return l, nil
+}
+
+// Stop the tcp listeners
+func (p *Proxy) stopTCPForwards() {
+	for _, f := range p.tcpForwards {
+		f.Close()
+	}
+	p.tcpForwards = nil
+}
+
+// Tunnel one connection to host:port along its route
+func (p *Proxy) handleTCPForward(conn net.Conn, host, port string) {
+	release, ok := acquireConnection()
+	if !ok {
+		conn.Close()
+		return
+	}
+	defer release()
+	totalRequests.Add(1)
+
+	rt := p.resolveRoute(host, port)
+	flow := newFlow("tcp", conn.RemoteAddr().String(), rt)
+	if err := connectChain(flow); err != nil {
+		if refusalFor(err).Reset {
+			resetConn(conn)
+			return
+		}
+		conn.Close()
+		return
+	}
+	if rt.mapped {
+		logInfo("TCP forwarding %s -> %s", net.JoinHostPort(host, port), rt.addr)
+	}
+
+	trace := startTrace(conn.RemoteAddr().String())
+	countersFor(rt).countRequest()
+	targetConn, rt, err := trace.dial(rt)
+	if err != nil {
+		countersFor(rt).countError()
+		sendError(rt.settings, forwardErrorCode(err), "Failed to connect to %s: %v", rt.addr, err)
+		conn.Close()
+		trace.finishTunnel("TCP", rt, 0, 0, 0)
+		return
+	}
+
+	in, out := tunnel("tcp", conn, targetConn, rt, flow)
+	trace.finishTunnel("TCP", rt, 0, in, out)
+}
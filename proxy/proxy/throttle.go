@@ -0,0 +1,152 @@
+package proxy
+
+import (
+	"io"
+	"math/rand"
+	"net/http"
+	"sync"
+	"time"
+)
+
+// A token bucket limiting throughput to a fixed number of bytes per second
+type rateLimiter struct {
+	mu     sync.Mutex
+	rate   float64 // Bytes per second
+	burst  float64
+	tokens float64
+	last   time.Time
+}
+
+func newRateLimiter(kbps int) *rateLimiter {
+	rate := float64(kbps) * 1000 / 8
+	// Allow bursts of a quarter second of traffic, but at least one read
+	burst := rate / 4
+	if burst < 1024 {
+		burst = 1024
+	}
+	return &rateLimiter{rate: rate, burst: burst, tokens: burst, last: time.Now()}
+}
+
+// Largest read that should be attempted in one go
+func (l *rateLimiter) chunk() int {
+	return int(l.burst)
+}
+
+// Take n bytes worth of tokens, sleeping until they are available
+func (l *rateLimiter) wait(n int) {
+	l.mu.Lock()
+	now := time.Now()
+	l.tokens += now.Sub(l.last).Seconds() * l.rate
+	if l.tokens > l.burst {
+		l.tokens = l.burst
+	}
+	l.last = now
+	l.tokens -= float64(n)
+	deficit := -l.tokens
+	l.mu.Unlock()
+
+	if deficit > 0 {
+		time.Sleep(time.Duration(deficit / l.rate * float64(time.Second)))
+	}
+}
+
+// Upload and download buckets for one host, shared by all its connections
+type hostLimiters struct {
+	kbps     int
+	up, down *rateLimiter
+}
+
+var (
+	throttles   = make(map[string]*hostLimiters)
+	throttlesMu sync.Mutex
+)
+
+// Get the upload and download limiters for a route, or nils when the
+// mapping has no maxKbps
+func throttleFor(rt route) (up, down *rateLimiter) {
+	kbps := rt.options.MaxKbps
+	if kbps <= 0 {
+		return nil, nil
+	}
+
+	throttlesMu.Lock()
+	defer throttlesMu.Unlock()
+
+	limiters, ok := throttles[rt.host]
+	if !ok || limiters.kbps != kbps {
+		limiters = &hostLimiters{kbps: kbps, up: newRateLimiter(kbps), down: newRateLimiter(kbps)}
+		throttles[rt.host] = limiters
+	}
+	return limiters.up, limiters.down
+}
+
+// A reader whose throughput is limited by a rateLimiter
+type throttledReader struct {
+	io.Reader
+	limiter *rateLimiter
+}
+
+func (r *throttledReader) Read(p []byte) (int, error) {
+	if chunk := r.limiter.chunk(); len(p) > chunk {
+		p = p[:chunk]
+	}
+	n, err := r.Reader.Read(p)
+	if n > 0 {
+		r.limiter.wait(n)
+	}
+	return n, err
+}
+
+// Wrap r with limiter, if there is one
+func throttle(r io.Reader, limiter *rateLimiter) io.Reader {
+	if limiter == nil {
+		return r
+	}
+	return &throttledReader{Reader: r, limiter: limiter}
+}
+
+// Wrap a request or response body with limiter, if there is one
+func throttleBody(body io.ReadCloser, limiter *rateLimiter) io.ReadCloser {
+	if limiter == nil || body == nil || body == http.NoBody {
+		return body
+	}
+	return readCloser(throttle(body, limiter), body)
+}
+
+// Applies the mapping's maxKbps and latency. Tunnels get the limiters
+// through their flow; requests and responses have their bodies wrapped.
+type throttleMiddleware struct{}
+
+func (throttleMiddleware) OnConnect(f *Flow) error {
+	f.up, f.down = throttleFor(f.route)
+	// Requests on a terminated connection get the latency one by one
+	if !f.route.terminatesTLS() {
+		injectLatency(f.route)
+	}
+	return nil
+}
+
+func (throttleMiddleware) OnRequest(f *Flow, req *http.Request) (*http.Response, error) {
+	f.up, f.down = throttleFor(f.route)
+	req.Body = throttleBody(req.Body, f.up)
+	injectLatency(f.route)
+	return nil, nil
+}
+
+func (throttleMiddleware) OnResponse(f *Flow, req *http.Request, resp *http.Response) {
+	// An upgraded connection's body must stay writable
+	if resp.StatusCode != http.StatusSwitchingProtocols {
+		resp.Body = throttleBody(resp.Body, f.down)
+	}
+}
+
+// Sleep for the mapping's artificial latency, if any
+func injectLatency(rt route) {
+	delay := millis(rt.options.LatencyMs)
+	if rt.options.JitterMs > 0 {
+		delay += time.Duration(rand.Int63n(int64(millis(rt.options.JitterMs)) + 1))
+	}
+	if delay > 0 {
+		time.Sleep(delay)
+	}
+}
@@ -0,0 +1,69 @@
+package proxy
+
+import (
+	"context"
+	"io"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Start a proxy with one mapping, its options and middleware list
+func startThrottledProxy(t *testing.T, target string, options MappingOptions, middleware []string) *Proxy {
+	t.Helper()
+	t.Setenv("HOME", t.TempDir())
+	p := New(nil)
+	port := 0
+	err := p.Start(context.Background(), Message{
+		Port:       &port,
+		Mappings:   map[string]string{"slow.test": target},
+		Options:    map[string]MappingOptions{"slow.test": options},
+		Middleware: middleware,
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(p.Stop)
+	return p
+}
+
+func TestThrottleMiddlewareLatency(t *testing.T) {
+	const latency = 200 * time.Millisecond
+	backend := namedBackend(t, "ok")
+	for _, tt := range []struct {
+		name       string
+		middleware []string
+		delayed    bool
+	}{
+		{"default chain", nil, true},
+		{"left out", []string{"block"}, false},
+	} {
+		t.Run(tt.name, func(t *testing.T) {
+			p := startThrottledProxy(t, backend, MappingOptions{LatencyMs: int(latency / time.Millisecond)}, tt.middleware)
+			start := time.Now()
+			if got, err := getVia(p.Port(), "http://slow.test/"); err != nil || got != "ok" {
+				t.Fatalf("got %q, %v", got, err)
+			}
+			if delayed := time.Since(start) >= latency; delayed != tt.delayed {
+				t.Errorf("request took %s, want delayed %v", time.Since(start), tt.delayed)
+			}
+		})
+	}
+}
+
+func TestThrottleMiddlewareTunnel(t *testing.T) {
+	// 800 kbps is 100KB/s after a 25KB burst
+	p := startThrottledProxy(t, echoBackend(t), MappingOptions{MaxKbps: 800}, nil)
+	conn, r := openTunnel(t, p.Port(), "slow.test:443")
+	conn.SetDeadline(time.Now().Add(10 * time.Second))
+
+	data := strings.Repeat("x", 75<<10)
+	start := time.Now()
+	go io.WriteString(conn, data)
+	if _, err := io.ReadFull(r, make([]byte, len(data))); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed < 400*time.Millisecond {
+		t.Errorf("75KB through an 800 kbps tunnel took %s", elapsed)
+	}
+}
@@ -0,0 +1,175 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"io"
+	"net"
+	"net/http"
+	"net/http/httptrace"
+	"sync"
+	"sync/atomic"
+	"time"
+)
+
+// One proxied request, sent to subscribed extensions when it completes.
+// For tunnels the byte counts cover the whole connection.
+type TrafficEvent struct {
+	Method     string  `json:"method"` // HTTP method, CONNECT or SOCKS
+	Host       string  `json:"host"`
+	Target     string  `json:"target"`
+	Mapped     bool    `json:"mapped"`
+	Status     int     `json:"status,omitempty"`
+	DurationMs int64   `json:"durationMs"`
+	BytesIn    int64   `json:"bytesIn"`
+	BytesOut   int64   `json:"bytesOut"`
+	Timing     *Timing `json:"timing,omitempty"`
+}
+
+// Phases of a request in milliseconds, to the microsecond. TTFB counts
+// from when the proxy received the request. DNS, connect and TLS are zero
+// when a pooled connection was reused; for tunnels connect includes any
+// DNS lookup.
+type Timing struct {
+	DNSMs     float64 `json:"dnsMs"`
+	ConnectMs float64 `json:"connectMs"`
+	TLSMs     float64 `json:"tlsMs"`
+	TTFBMs    float64 `json:"ttfbMs,omitempty"`
+	Reused    bool    `json:"reused,omitempty"`
+}
+
+// Whether the extension asked for traffic events
+var trafficSubscribed atomic.Bool
+
+// Timing and request-body bytes for one in-flight request. startTrace
+// returns nil when nobody is subscribed and there is no access log,
+// dashboard or mappingHit hook, and every method ignores nil.
+type trafficTrace struct {
+	start  time.Time
+	client string
+	out    atomic.Int64
+
+	mu     sync.Mutex // Guards timing, which httptrace hooks fill in
+	timing Timing
+
+	span *spanContext // Set while exporting OTLP spans
+}
+
+func startTrace(client string) *trafficTrace {
+	exporting := otlpEnabled()
+	if !trafficSubscribed.Load() && trafficStreams.Load() == 0 && !accessLogOpen() && !keepRecent.Load() && !exporting && mappingHitHooks.Load() == 0 {
+		return nil
+	}
+	t := &trafficTrace{start: time.Now(), client: client}
+	if exporting {
+		t.span = newSpanContext()
+	}
+	return t
+}
+
+// Pass the request's span on to the target in a traceparent header
+func (t *trafficTrace) propagate(h http.Header) {
+	if t != nil && t.span != nil {
+		t.span.propagate(h)
+	}
+}
+
+// Wrap a request body so its bytes show up as BytesOut
+func (t *trafficTrace) countBodyOut(body io.ReadCloser) io.ReadCloser {
+	if t == nil || body == nil {
+		return body
+	}
+	return readCloser(&countingReader{Reader: body, n: &t.out}, body)
+}
+
+// Dial the route's target, timing the connect (including any failover)
+func (t *trafficTrace) dial(rt route) (net.Conn, route, error) {
+	if t == nil {
+		return rt.dial()
+	}
+	start := time.Now()
+	conn, rt, err := rt.dial()
+	t.mu.Lock()
+	t.timing.ConnectMs = millisSince(start)
+	t.mu.Unlock()
+	return conn, rt, err
+}
+
+// Attach hooks timing the DNS, connect, TLS and first-byte phases of a
+// forwarded request
+func (t *trafficTrace) withClientTrace(req *http.Request) *http.Request {
+	if t == nil {
+		return req
+	}
+	var dnsStart, connectStart, tlsStart time.Time
+	record := func(f func(*Timing)) {
+		t.mu.Lock()
+		f(&t.timing)
+		t.mu.Unlock()
+	}
+	ct := &httptrace.ClientTrace{
+		GotConn: func(info httptrace.GotConnInfo) {
+			record(func(tm *Timing) { tm.Reused = info.Reused })
+		},
+		DNSStart: func(httptrace.DNSStartInfo) { dnsStart = time.Now() },
+		DNSDone: func(httptrace.DNSDoneInfo) {
+			record(func(tm *Timing) { tm.DNSMs = millisSince(dnsStart) })
+		},
+		ConnectStart: func(string, string) { connectStart = time.Now() },
+		ConnectDone: func(string, string, error) {
+			record(func(tm *Timing) { tm.ConnectMs = millisSince(connectStart) })
+		},
+		TLSHandshakeStart: func() { tlsStart = time.Now() },
+		TLSHandshakeDone: func(tls.ConnectionState, error) {
+			record(func(tm *Timing) { tm.TLSMs = millisSince(tlsStart) })
+		},
+		GotFirstResponseByte: func() {
+			record(func(tm *Timing) { tm.TTFBMs = millisSince(t.start) })
+		},
+	}
+	return req.WithContext(httptrace.WithClientTrace(req.Context(), ct))
+}
+
+func millisSince(start time.Time) float64 {
+	return float64(time.Since(start).Microseconds()) / 1000
+}
+
+// Send the event for a finished HTTP request
+func (t *trafficTrace) finish(method string, rt route, status int, bytesIn int64) {
+	if t == nil {
+		return
+	}
+	t.finishTunnel(method, rt, status, bytesIn, t.out.Load())
+}
+
+// Send the event for a finished request with explicit byte counts, and
+// record it in the access log, the dashboard's recent list and the span
+// export
+func (t *trafficTrace) finishTunnel(method string, rt route, status int, bytesIn, bytesOut int64) {
+	if t == nil {
+		return
+	}
+	event := TrafficEvent{
+		Method:     method,
+		Host:       rt.host,
+		Target:     rt.addr,
+		Mapped:     rt.mapped,
+		Status:     status,
+		DurationMs: time.Since(t.start).Milliseconds(),
+		BytesIn:    bytesIn,
+		BytesOut:   bytesOut,
+	}
+	t.mu.Lock()
+	timing := t.timing
+	t.mu.Unlock()
+	event.Timing = &timing
+	if trafficSubscribed.Load() || trafficStreams.Load() > 0 {
+		sendMessage(Message{Type: "traffic", Traffic: &event})
+	}
+	if rt.mapped && rt.settings != nil && rt.settings.hooks.hasHits() {
+		rt.settings.hooks.run(Message{Type: "mappingHit", Traffic: &event}, rt.host)
+	}
+	entry := AccessLogEntry{Time: t.start, Client: t.client, TrafficEvent: event}
+	writeAccessLog(entry)
+	recordRecent(entry)
+	exportSpan(t.span, entry, time.Now())
+}
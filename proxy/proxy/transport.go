@@ -0,0 +1,260 @@
+package proxy
+
+import (
+	"context"
+	"crypto/tls"
+	"net"
+	"net/http"
+	"sync"
+	"sync/atomic"
+	"time"
+
+	"golang.org/x/net/http2"
+
+	"fhosts-proxy/mapping"
+)
+
+// Connection pool limits for forwarded requests
+const (
+	maxIdleConns        = 100
+	maxIdleConnsPerHost = 16
+	idleConnTimeout     = 90 * time.Second
+)
+
+// Timeouts from the start message, in milliseconds. Omitted (zero) fields
+// keep their defaults.
+type Timeouts struct {
+	Dial           int `json:"dial,omitempty"`           // Connecting to a target
+	TLSHandshake   int `json:"tlsHandshake,omitempty"`   // TLS handshake with a target, SOCKS handshake with a client
+	ResponseHeader int `json:"responseHeader,omitempty"` // Waiting for a target's response headers
+	IdleTunnel     int `json:"idleTunnel,omitempty"`     // Tunnel with no traffic either way (default: never)
+}
+
+var defaultTimeouts = Timeouts{
+	Dial:           30000,
+	TLSHandshake:   10000,
+	ResponseHeader: 120000,
+}
+
+// The active timeouts, merged with the defaults, and the dialer and
+// transports built from them. They are shared by every proxy in the
+// process and replaced whole, so a start can't change them under requests
+// in flight.
+type upstream struct {
+	timeouts Timeouts
+	dialer   *net.Dialer // Used by all transports and tunnels
+
+	// Shared transports for forwarded requests, so keep-alive connections
+	// to mapped backends are pooled and reused. HTTP/2 is negotiated via
+	// ALPN for TLS backends; h2c speaks cleartext HTTP/2 for mappings that
+	// opt in.
+	http *http.Transport
+	h2c  *http2.Transport
+}
+
+var activeUpstream atomic.Pointer[upstream]
+
+func newUpstream(t Timeouts) *upstream {
+	d := newDialer(t)
+	return &upstream{timeouts: t, dialer: d, http: newHTTPTransport(t, d), h2c: newH2CTransport("")}
+}
+
+// The active upstream, the defaults until configureTimeouts runs
+func shared() *upstream {
+	if u := activeUpstream.Load(); u != nil {
+		return u
+	}
+	activeUpstream.CompareAndSwap(nil, newUpstream(defaultTimeouts))
+	return activeUpstream.Load()
+}
+
+// Fill t's omitted (zero) fields from fallback
+func (t Timeouts) withDefaults(fallback Timeouts) Timeouts {
+	if t.Dial == 0 {
+		t.Dial = fallback.Dial
+	}
+	if t.TLSHandshake == 0 {
+		t.TLSHandshake = fallback.TLSHandshake
+	}
+	if t.ResponseHeader == 0 {
+		t.ResponseHeader = fallback.ResponseHeader
+	}
+	if t.IdleTunnel == 0 {
+		t.IdleTunnel = fallback.IdleTunnel
+	}
+	return t
+}
+
+// Convert a millisecond timeout to a time.Duration
+func millis(ms int) time.Duration {
+	return time.Duration(ms) * time.Millisecond
+}
+
+func newDialer(t Timeouts) *net.Dialer {
+	return &net.Dialer{
+		Timeout:   millis(t.Dial),
+		KeepAlive: 30 * time.Second,
+	}
+}
+
+// Transport for hosts that aren't mapped; mapping targets get a variant
+// dialing through the DNS cache
+func newHTTPTransport(t Timeouts, d *net.Dialer) *http.Transport {
+	return &http.Transport{
+		DialContext:           d.DialContext,
+		TLSClientConfig:       upstreamTLSConfig(),
+		ForceAttemptHTTP2:     true,
+		MaxIdleConns:          maxIdleConns,
+		MaxIdleConnsPerHost:   maxIdleConnsPerHost,
+		IdleConnTimeout:       idleConnTimeout,
+		TLSHandshakeTimeout:   millis(t.TLSHandshake),
+		ResponseHeaderTimeout: millis(t.ResponseHeader),
+		ExpectContinueTimeout: time.Second,
+		// Responses pass through with the encoding the target chose; left
+		// on, requests without Accept-Encoding would get gzip decoded here
+		DisableCompression: true,
+	}
+}
+
+// Cleartext HTTP/2 transport dialing mapping targets like the HTTP/1
+// ones, through the DNS cache and dnsServer if given
+func newH2CTransport(dnsServer string) *http2.Transport {
+	return &http2.Transport{
+		AllowHTTP: true,
+		DialTLSContext: func(ctx context.Context, network, addr string, _ *tls.Config) (net.Conn, error) {
+			return dialContext(ctx, network, addr, dnsServer)
+		},
+		ReadIdleTimeout:    idleConnTimeout,
+		DisableCompression: true,
+	}
+}
+
+// Apply timeouts from the start message, rebuilding the dialer and
+// transports. The replaced transports close their idle connections;
+// requests in flight on them finish first.
+func configureTimeouts(requested *Timeouts) {
+	var t Timeouts
+	if requested != nil {
+		t = *requested
+	}
+	old := activeUpstream.Swap(newUpstream(t.withDefaults(defaultTimeouts)))
+
+	transportsMu.Lock()
+	replaced, replacedH2C := transports, h2cTransports
+	transports = make(map[transportKey]*http.Transport)
+	h2cTransports = make(map[string]*http2.Transport)
+	transportsMu.Unlock()
+
+	if old != nil {
+		old.http.CloseIdleConnections()
+		old.h2c.CloseIdleConnections()
+	}
+	for _, t := range replaced {
+		t.CloseIdleConnections()
+	}
+	for _, t := range replacedH2C {
+		t.CloseIdleConnections()
+	}
+}
+
+// Variants of the shared transport, keyed by what they override
+type transportKey struct {
+	serverName string // TLS server name for re-encrypted (MITM) requests
+	unixPath   string // Unix socket every connection goes to
+	mapped     bool   // Resolve target hostnames through the DNS cache
+	dnsServer  string // DNS server resolving target hostnames
+	guarded    bool   // Refuse private addresses (blockPrivate)
+	insecure   bool   // Skip verifying the target's certificate
+	clientCert ClientCert
+}
+
+var (
+	transports    = make(map[transportKey]*http.Transport)
+	h2cTransports = make(map[string]*http2.Transport) // By DNS server
+	transportsMu  sync.Mutex
+)
+
+// Get the shared transport's variant for key, creating it on first use
+func cachedTransport(key transportKey) *http.Transport {
+	if key == (transportKey{}) {
+		return shared().http
+	}
+
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	if t, ok := transports[key]; ok {
+		return t
+	}
+	t := shared().http.Clone()
+	t.TLSClientConfig = upstreamTLSConfig()
+	t.TLSClientConfig.ServerName = key.serverName
+	if key.clientCert != (ClientCert{}) {
+		t.TLSClientConfig.GetClientCertificate = key.clientCert.provider()
+	}
+	if key.insecure {
+		logWarn("TLS certificate verification is OFF for %s (insecureSkipVerify)", key.serverName)
+		t.TLSClientConfig.InsecureSkipVerify = true
+	}
+	switch {
+	case key.guarded:
+		t.DialContext = dialPublic
+	case key.mapped:
+		server := key.dnsServer
+		t.DialContext = func(ctx context.Context, network, addr string) (net.Conn, error) {
+			return dialContext(ctx, network, addr, server)
+		}
+	}
+	if key.unixPath != "" {
+		path := key.unixPath
+		t.DialContext = func(ctx context.Context, _, _ string) (net.Conn, error) {
+			return shared().dialer.DialContext(ctx, "unix", path)
+		}
+	}
+	transports[key] = t
+	return t
+}
+
+// Get the shared h2c transport's variant resolving through dnsServer,
+// creating it on first use
+func cachedH2CTransport(dnsServer string) *http2.Transport {
+	if dnsServer == "" {
+		return shared().h2c
+	}
+
+	transportsMu.Lock()
+	defer transportsMu.Unlock()
+
+	if t, ok := h2cTransports[dnsServer]; ok {
+		return t
+	}
+	t := newH2CTransport(dnsServer)
+	h2cTransports[dnsServer] = t
+	return t
+}
+
+// Pick the transport for forwarding plain HTTP along a route
+func transportFor(rt route) http.RoundTripper {
+	if rt.network == "file" {
+		return fileTransport(rt)
+	}
+	if rt.parent != nil {
+		t := rt.parent.transport
+		if rt.guarded {
+			return guardedTransport{t}
+		}
+		return t
+	}
+	if rt.options.H2C && rt.network == "tcp" && !rt.guarded {
+		return cachedH2CTransport(rt.dnsServer)
+	}
+	return cachedTransport(transportKey{unixPath: rt.unixPath(), mapped: rt.mapped, dnsServer: rt.dnsServer, guarded: rt.guarded})
+}
+
+// Add port to addr unless it already has one
+func withDefaultPort(addr, port string) string {
+	if _, _, err := net.SplitHostPort(addr); err == nil {
+		return addr
+	}
+	return net.JoinHostPort(mapping.Unbracket(addr), port)
+}
@@ -0,0 +1,40 @@
+package proxy
+
+import (
+	"crypto/tls"
+	"crypto/x509"
+	"errors"
+	"os"
+	"sync/atomic"
+)
+
+// Roots for verifying targets' certificates: the system's plus the
+// caBundle file's. Nil means the system roots alone.
+var upstreamRoots atomic.Pointer[x509.CertPool]
+
+// Trust the CAs in a PEM bundle for targets, on top of the system roots.
+// Must be called before configureTimeouts rebuilds the transports.
+func configureUpstreamCAs(path string) {
+	upstreamRoots.Store(nil)
+	if path == "" {
+		return
+	}
+	data, err := os.ReadFile(path)
+	if err == nil {
+		pool, poolErr := x509.SystemCertPool()
+		if poolErr != nil {
+			pool = x509.NewCertPool()
+		}
+		if pool.AppendCertsFromPEM(data) {
+			upstreamRoots.Store(pool)
+			return
+		}
+		err = errors.New("no certificates found")
+	}
+	logWarn("Ignoring CA bundle %s: %v", path, err)
+}
+
+// TLS settings for connections the proxy opens to targets
+func upstreamTLSConfig() *tls.Config {
+	return &tls.Config{RootCAs: upstreamRoots.Load()}
+}
@@ -0,0 +1,156 @@
+package proxy
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+
+	"github.com/fsnotify/fsnotify"
+
+	"fhosts-proxy/mapping"
+)
+
+// Reloads of a watched file wait this long for writes to settle, since
+// editors and generators often touch a file several times in a row
+const watchDebounce = 200 * time.Millisecond
+
+// A proxy's watched file
+type watchState struct {
+	watcher *fsnotify.Watcher
+	hosts   map[string]bool // Hosts the file contributed last time
+
+	// The file's last good contents, layered under every full mapping set
+	// so updateMappings doesn't drop them
+	config ProxyConfig
+}
+
+// Watch a hosts-format or JSON (exportConfig format) file and merge its
+// mappings into the active set whenever it changes. Hosts dropped from the
+// file are removed again; the extension's other mappings are left alone.
+func (p *Proxy) startWatch(path string) error {
+	p.stopWatch()
+	if path == "" {
+		return nil
+	}
+	path, err := filepath.Abs(path)
+	if err != nil {
+		return err
+	}
+
+	w, err := fsnotify.NewWatcher()
+	if err != nil {
+		return err
+	}
+	// Watch the directory, since files replaced by rename lose a direct watch
+	if err := w.Add(filepath.Dir(path)); err != nil {
+		w.Close()
+		return err
+	}
+	p.watch.watcher = w
+	// Callers of Proxy.start already hold actionsMu
+	p.applyWatched(path)
+
+	go func() {
+		var timer *time.Timer
+		for {
+			select {
+			case event, ok := <-w.Events:
+				if !ok {
+					return
+				}
+				if filepath.Clean(event.Name) != path {
+					continue
+				}
+				if timer != nil {
+					timer.Stop()
+				}
+				timer = time.AfterFunc(watchDebounce, func() {
+					actionsMu.Lock()
+					defer actionsMu.Unlock()
+					if p.watch.watcher == w {
+						p.applyWatched(path)
+					}
+				})
+			case err, ok := <-w.Errors:
+				if !ok {
+					return
+				}
+				logWarn("Watching %s: %v", path, err)
+			}
+		}
+	}()
+	return nil
+}
+
+func (p *Proxy) stopWatch() {
+	if p.watch.watcher != nil {
+		p.watch.watcher.Close()
+	}
+	p.watch = watchState{}
+}
+
+// Apply the watched file's current contents and tell the extension.
+// Callers must hold actionsMu.
+func (p *Proxy) applyWatched(path string) {
+	cfg, err := readMappingsFile(path)
+	if err != nil {
+		logWarn("Failed to reload %s: %v", path, err)
+		return
+	}
+
+	before := p.exportConfig()
+	hosts, err := p.syncMappings(cfg, p.watch.hosts)
+	if err != nil {
+		logWarn("Failed to reload %s: %v", path, err)
+		return
+	}
+	p.auditChange(AuditEntry{Source: sourceFile, Action: "reload", Path: path}, before)
+	p.watch.config, p.watch.hosts = *cfg, hosts
+	p.saveState()
+
+	logInfo("Reloaded %d mappings from %s", len(cfg.Mappings), path)
+	count, revision := p.mappingsState()
+	sendMessage(Message{Type: "mappingsUpdated", Count: count, Revision: revision})
+}
+
+// Merge a source's mappings into the active set, removing the hosts it
+// contributed before (previous) but no longer has. Returns the hosts it
+// contributes now.
+func (p *Proxy) syncMappings(cfg *ProxyConfig, previous map[string]bool) (map[string]bool, error) {
+	current := mapping.NormalizeKeys(cfg.Mappings)
+	var gone []string
+	for host := range previous {
+		if _, ok := current[host]; !ok {
+			gone = append(gone, host)
+		}
+	}
+	p.deleteMappings(gone)
+	if err := p.mergeMappings(&Message{Mappings: cfg.Mappings, Options: cfg.Options, Blocked: cfg.Blocked, HeaderRules: cfg.HeaderRules, Mocks: cfg.Mocks, BodyRules: cfg.BodyRules}); err != nil {
+		return previous, err
+	}
+	hosts := make(map[string]bool, len(current))
+	for host := range current {
+		hosts[host] = true
+	}
+	return hosts, nil
+}
+
+// Read a mappings file: the exportConfig format for .json, .yaml and .yml
+// files, hosts-file syntax otherwise
+func readMappingsFile(path string) (*ProxyConfig, error) {
+	data, err := os.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+	var cfg ProxyConfig
+	if strings.EqualFold(filepath.Ext(path), ".json") || isYAML(path) {
+		err = decodeConfig(path, data, &cfg)
+	} else {
+		cfg.Mappings, err = mapping.ParseHostsFile(strings.NewReader(string(data)))
+	}
+	if err != nil {
+		return nil, err
+	}
+	return &cfg, nil
+}
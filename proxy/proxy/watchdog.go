@@ -0,0 +1,60 @@
+package proxy
+
+import (
+	"sync/atomic"
+	"time"
+)
+
+// Time the last message arrived from the extension, in Unix nanoseconds
+var lastMessageAt atomic.Int64
+
+var watchdogStop chan struct{}
+
+// Set while serving the extension over native messaging, the only place an
+// idle watchdog may exit the process
+var nativeHost bool
+
+// Record that the extension is still talking to us
+func touchWatchdog() {
+	lastMessageAt.Store(time.Now().UnixNano())
+}
+
+// Exit the native messaging host if no message arrives within timeoutMs.
+// Browsers that crash do not always close stdin, which would otherwise
+// leave the host holding the proxy port forever. Zero disables the
+// watchdog, and a daemon, which is meant to outlive the browser, never
+// runs it; nor do embedding programs, which have no extension to hear from.
+func startWatchdog(timeoutMs int) {
+	stopWatchdog()
+	if timeoutMs <= 0 || daemon || !nativeHost {
+		return
+	}
+
+	timeout := millis(timeoutMs)
+	touchWatchdog()
+	stop := make(chan struct{})
+	watchdogStop = stop
+	go func() {
+		ticker := time.NewTicker(timeout / 4)
+		defer ticker.Stop()
+		for {
+			select {
+			case <-stop:
+				return
+			case <-ticker.C:
+				if time.Since(time.Unix(0, lastMessageAt.Load())) >= timeout {
+					engine.Stop()
+					sendMessage(Message{Type: "stopped", Message: "No message from extension within heartbeat timeout"})
+					exit(0)
+				}
+			}
+		}
+	}()
+}
+
+func stopWatchdog() {
+	if watchdogStop != nil {
+		close(watchdogStop)
+		watchdogStop = nil
+	}
+}